@@ -0,0 +1,64 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// benchmark fingerprints every image under dir and reports how fast it went, without matching.
+func benchmark(w io.Writer, h *hasher, dir string, extensions []string, caseSensitive, includeHidden bool) error {
+	var images int
+	var decodeTime, pipelineTime time.Duration
+	start := time.Now()
+	err := filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && !includeHidden && isHidden(info.Name()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || !hasExtension(path, extensions, caseSensitive) {
+			return nil
+		}
+		imf, err := os.Open(path)
+		if err != nil {
+			return nil
+		}
+		defer imf.Close()
+		t0 := time.Now()
+		im, err := h.decode(imf)
+		if err != nil && !errors.Is(err, errPartialImage) {
+			return nil
+		}
+		t1 := time.Now()
+		_, _ = h.fingerprintDecoded(im)
+		decodeTime += t1.Sub(t0)
+		pipelineTime += time.Since(t1)
+		images++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+	if images == 0 {
+		_, err = fmt.Fprintf(w, "No images found in %s\n", dir)
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Fingerprinted %d images in %v (%.1f images/sec)\n", images, elapsed, float64(images)/elapsed.Seconds())
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Average decode time: %v\nAverage pipeline time: %v\n",
+		decodeTime/time.Duration(images), pipelineTime/time.Duration(images))
+	return err
+}
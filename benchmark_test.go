@@ -0,0 +1,36 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBenchmarkReportsThroughput(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-benchmark", "testdata"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	lines := strings.Split(stdout.String(), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines, want 3 and no matches:\n%s", len(lines)-1, stdout.String())
+	}
+	var images int
+	var elapsed string
+	var rate float64
+	if _, err := fmt.Sscanf(lines[0], "Fingerprinted %d images in %s (%f images/sec)", &images, &elapsed, &rate); err != nil {
+		t.Fatalf("%q: %v", lines[0], err)
+	}
+	if images != len(testdataImages) || rate <= 0 {
+		t.Errorf("%d images at %g images/sec, want %d at a positive rate", images, rate, len(testdataImages))
+	}
+	for i, prefix := range []string{"Average decode time: ", "Average pipeline time: "} {
+		d, err := time.ParseDuration(strings.TrimPrefix(lines[i+1], prefix))
+		if !strings.HasPrefix(lines[i+1], prefix) || err != nil || d <= 0 {
+			t.Errorf("line %q, want a positive duration after %q", lines[i+1], prefix)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// checkpoint saves fingerprints to a file as they are computed, so that an interrupted scan can
+// be resumed without fingerprinting the same files again. It uses the -export-fingerprints format.
+type checkpoint struct {
+	name    string
+	f       *os.File
+	w       *bufio.Writer
+	enc     *json.Encoder
+	version string
+	// done holds the fingerprints saved by an earlier run, by path.
+	done map[string]imageInfo
+}
+
+// openCheckpoint reads the fingerprints saved in the named file by an earlier run, if there is one,
+// and opens it to save more. Fingerprints from a different version are ignored, and so is anything
+// after a line that can't be read, like one cut short when the earlier run was interrupted.
+func openCheckpoint(name, version string) (*checkpoint, error) {
+	c := &checkpoint{name: name, version: version, done: map[string]imageInfo{}}
+	f, err := os.Open(name)
+	if err == nil {
+		dec := json.NewDecoder(bufio.NewReader(f))
+		for dec.More() {
+			var im imageInfo
+			if dec.Decode(&im) != nil {
+				break
+			}
+			if im.Version == version {
+				c.done[im.Path] = im
+			}
+		}
+		_ = f.Close()
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	// Start the file over, so that a partial line doesn't get in the way.
+	c.f, err = os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	c.w = bufio.NewWriter(c.f)
+	c.enc = json.NewEncoder(c.w)
+	for _, im := range c.done {
+		if err := c.enc.Encode(im); err != nil {
+			_ = c.f.Close()
+			return nil, err
+		}
+	}
+	return c, c.w.Flush()
+}
+
+// lookup returns the saved fingerprint of a file, if it hasn't changed since it was saved.
+func (c *checkpoint) lookup(path string, info fs.FileInfo) (imageInfo, bool) {
+	im, ok := c.done[path]
+	if !ok || im.Size != info.Size() || !im.ModTime.Equal(info.ModTime()) {
+		return imageInfo{}, false
+	}
+	return im, true
+}
+
+// record saves the fingerprint of a file. Each one is flushed straight away, since fingerprinting
+// takes much longer than writing it out.
+func (c *checkpoint) record(im imageInfo) error {
+	im.Version = c.version
+	if err := c.enc.Encode(im); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// finish closes and removes the checkpoint once the scan it was for is complete.
+func (c *checkpoint) finish() error {
+	if err := c.f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(c.name)
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+const (
+	// grayChroma is how far apart, out of 255, the channels of a pixel can be for it to still
+	// count as gray, allowing for the noise that compression adds.
+	grayChroma = 16
+	// colorFraction is the share of pixels that must have color for an image to count as color,
+	// so that a few stray pixels don't.
+	colorFraction = 0.01
+	// colorSampleSize is the width and height of the sample of pixels that colorMode looks at.
+	colorSampleSize = 64
+)
+
+// colorMode returns "gray" if an image has next to no color in it, like a desaturated copy of a
+// photo, and "color" otherwise. Fingerprints only see brightness, so they can't tell these apart.
+func colorMode(im image.Image) string {
+	if im.ColorModel() == color.GrayModel || im.ColorModel() == color.Gray16Model {
+		return "gray"
+	}
+	// The sample is RGBA, or paletted if im is.
+	sample := resample(im, colorSampleSize, colorSampleSize)
+	defer release(sample)
+	colored := 0
+	for y := 0; y < colorSampleSize; y++ {
+		for x := 0; x < colorSampleSize; x++ {
+			r, g, b, _ := sample.At(x, y).RGBA()
+			if (max(r, g, b)-min(r, g, b))>>8 > grayChroma {
+				colored++
+			}
+		}
+	}
+	if float64(colored) > colorFraction*colorSampleSize*colorSampleSize {
+		return "color"
+	}
+	return "gray"
+}
+
+// colorsAgree reports whether a and b are both in color or both gray. Images whose color mode
+// wasn't found, like imported fingerprints, agree with anything.
+func colorsAgree(a, b *imageInfo) bool {
+	return a.Color == "" || b.Color == "" || a.Color == b.Color
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"testing"
+)
+
+// palettedCopy draws im with the colors of p.
+func palettedCopy(im image.Image, p color.Palette) *image.Paletted {
+	out := image.NewPaletted(im.Bounds(), p)
+	draw.Draw(out, out.Bounds(), im, im.Bounds().Min, draw.Src)
+	return out
+}
+
+func TestColorModePaletted(t *testing.T) {
+	var grays color.Palette
+	for i := 0; i < 256; i += 17 {
+		grays = append(grays, color.Gray{Y: uint8(i)})
+	}
+	colored := image.NewRGBA(image.Rect(0, 0, 100, 80))
+	for y := 0; y < 80; y++ {
+		for x := 0; x < 100; x++ {
+			colored.Set(x, y, color.RGBA{R: uint8(x * 2), G: 40, B: uint8(255 - y*3), A: 0xff})
+		}
+	}
+	for _, tc := range []struct {
+		name string
+		im   image.Image
+		want string
+	}{
+		{"rgba", colored, "color"},
+		{"paletted color", palettedCopy(colored, palette.Plan9), "color"},
+		{"paletted gray", palettedCopy(colored, grays), "gray"},
+		{"gray", palettedCopy(testImage(90, 70, 3), grays), "gray"},
+	} {
+		if got := colorMode(tc.im); got != tc.want {
+			t.Errorf("%s: colorMode = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
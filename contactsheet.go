@@ -0,0 +1,102 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// contactSheetGap is the space around each thumbnail.
+const contactSheetGap = 8
+
+// thumbSize is the box each thumbnail is scaled to fit, as given to -thumb-size.
+type thumbSize struct {
+	w, h int
+}
+
+// parseThumbSize parses a size like "200x150".
+func parseThumbSize(s string) (thumbSize, error) {
+	w, h, ok := strings.Cut(strings.ToLower(s), "x")
+	width, werr := strconv.Atoi(w)
+	height, herr := strconv.Atoi(h)
+	if !ok || werr != nil || herr != nil || width < 1 || height < 1 {
+		return thumbSize{}, fmt.Errorf("-thumb-size must be a width and height like 200x150, got %q", s)
+	}
+	return thumbSize{w: width, h: height}, nil
+}
+
+// contactSheetWriter saves a contact sheet of each group to dir as group-<id>.png before
+// passing the group on.
+type contactSheetWriter struct {
+	groupWriter
+	dir   string
+	thumb thumbSize
+}
+
+func (c *contactSheetWriter) writeGroup(g *group) error {
+	name := filepath.Join(c.dir, fmt.Sprintf("group-%d.png", g.ID))
+	if err := writeContactSheet(name, g, c.thumb); err != nil {
+		return fmt.Errorf("writing contact sheet %s: %w", name, err)
+	}
+	return c.groupWriter.writeGroup(g)
+}
+
+// writeContactSheet draws thumbnails of the members of g in a grid on a white background and
+// saves it as a PNG. Members that can't be decoded, like URLs, are left as gray boxes.
+func writeContactSheet(name string, g *group, box thumbSize) error {
+	cols := int(math.Ceil(math.Sqrt(float64(len(g.Members)))))
+	rows := (len(g.Members) + cols - 1) / cols
+	cellW, cellH := box.w+contactSheetGap, box.h+contactSheetGap
+	sheet := image.NewRGBA(image.Rect(0, 0, cols*cellW+contactSheetGap, rows*cellH+contactSheetGap))
+	draw.Draw(sheet, sheet.Bounds(), image.White, image.Point{}, draw.Src)
+	for i, member := range g.Members {
+		x := contactSheetGap + i%cols*cellW
+		y := contactSheetGap + i/cols*cellH
+		thumb := thumbnail(member.file, box)
+		if thumb == nil {
+			r := image.Rect(x, y, x+box.w, y+box.h)
+			draw.Draw(sheet, r, image.NewUniform(color.Gray{Y: 0xc0}), image.Point{}, draw.Src)
+			continue
+		}
+		size := thumb.Bounds().Size()
+		at := image.Pt(x+(box.w-size.X)/2, y+(box.h-size.Y)/2)
+		draw.Draw(sheet, image.Rectangle{Min: at, Max: at.Add(size)}, thumb, image.Point{}, draw.Src)
+	}
+	return savePNG(name, sheet)
+}
+
+// thumbnail decodes the image at path and scales it to fit in box, keeping its aspect ratio.
+// It returns nil if the image can't be decoded.
+func thumbnail(path string, box thumbSize) image.Image {
+	if isURL(path) {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	im, _, err := image.Decode(f)
+	if err != nil {
+		return nil
+	}
+	size := im.Bounds().Size()
+	if size.X == 0 || size.Y == 0 {
+		return nil
+	}
+	// Scale by whichever side is the tighter fit.
+	w, h := box.w, box.h
+	if size.X*box.h > size.Y*box.w {
+		h = max(1, box.w*size.Y/size.X)
+	} else {
+		w = max(1, box.h*size.X/size.Y)
+	}
+	return resample(im, w, h)
+}
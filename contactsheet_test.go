@@ -0,0 +1,102 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestContactSheetWithRewrittenPaths(t *testing.T) {
+	// The printed paths are relative to testdata, but the thumbnails must still be read from
+	// where the files are.
+	dir := t.TempDir()
+	var stdout, stderr bytes.Buffer
+	args := []string{"-contact-sheet", dir, "-thumb-size", "40x30", "-base", "testdata", "-posix-paths", "testdata"}
+	if code := run(args, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	f, err := os.Open(filepath.Join(dir, "group-1.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sheet, _, err := image.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Three thumbnails are laid out two to a row; look at the middle of each.
+	placeholder := color.GrayModel.Convert(color.Gray{Y: 0xc0})
+	cell := image.Pt(40+contactSheetGap, 30+contactSheetGap)
+	for i := 0; i < 3; i++ {
+		at := image.Pt(contactSheetGap+i%2*cell.X+20, contactSheetGap+i/2*cell.Y+15)
+		if c := color.GrayModel.Convert(sheet.At(at.X, at.Y)); c == placeholder {
+			t.Errorf("thumbnail %d is the gray placeholder", i+1)
+		}
+	}
+}
+
+func TestThumbSize(t *testing.T) {
+	for _, bad := range []string{"200", "200x", "x150", "0x150", "200x-1", "wide"} {
+		if _, err := parseThumbSize(bad); err == nil {
+			t.Errorf("parseThumbSize(%q) succeeded", bad)
+		}
+	}
+	box, err := parseThumbSize("80X60")
+	if err != nil || box != (thumbSize{w: 80, h: 60}) {
+		t.Fatalf("parseThumbSize(\"80X60\") = %v, %v", box, err)
+	}
+
+	// Each thumbnail fills the box along its tighter side and keeps its aspect ratio.
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		w, h  int
+		thumb image.Point
+	}{
+		{400, 300, image.Pt(80, 60)},
+		{400, 100, image.Pt(80, 20)},
+		{100, 400, image.Pt(15, 60)},
+		{20, 15, image.Pt(80, 60)},
+	} {
+		name := filepath.Join(dir, fmt.Sprintf("%dx%d.png", tc.w, tc.h))
+		writeTestPNG(t, name, testImage(tc.w, tc.h, 1))
+		im := thumbnail(name, box)
+		if im == nil {
+			t.Fatalf("no thumbnail of %s", name)
+		}
+		if got := im.Bounds().Size(); got != tc.thumb {
+			t.Errorf("thumbnail of a %dx%d image is %v, want %v", tc.w, tc.h, got, tc.thumb)
+		}
+	}
+
+	// The sheet of two thumbnails is one row of two boxes of that size, with gaps around them.
+	sheets := t.TempDir()
+	writeTestPNG(t, filepath.Join(dir, "copy.png"), testImage(400, 300, 1))
+	var stdout, stderr bytes.Buffer
+	args := []string{"-contact-sheet", sheets, "-thumb-size", "80x60", filepath.Join(dir, "400x300.png"), filepath.Join(dir, "copy.png")}
+	if code := run(args, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	f, err := os.Open(filepath.Join(sheets, "group-1.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, h := 2*80+3*contactSheetGap, 60+2*contactSheetGap; config.Width != w || config.Height != h {
+		t.Errorf("sheet is %dx%d, want %dx%d", config.Width, config.Height, w, h)
+	}
+
+	stderr.Reset()
+	if code := run([]string{"-contact-sheet", sheets, "-thumb-size", "80by60", "testdata"}, &stdout, &stderr); code != 2 || !strings.Contains(stderr.String(), "-thumb-size") {
+		t.Errorf("-thumb-size 80by60: exit status %d, stderr %q; want 2 and an error about -thumb-size", code, stderr.String())
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// cropFractions are the fractions of the edges trimmed off by cropVariants.
+var cropFractions = []float64{0.025, 0.05}
+
+// cropImage returns the part of im inside r, which is relative to the top-left corner of im.
+func cropImage(im image.Image, r image.Rectangle) image.Image {
+	r = r.Add(im.Bounds().Min).Intersect(im.Bounds())
+	if sub, ok := im.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(r)
+	}
+	newim := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(newim, newim.Bounds(), im, r.Min, draw.Src)
+	return newim
+}
+
+// centerSquare returns the largest square centered in an image of the given size.
+func centerSquare(size image.Point) image.Rectangle {
+	side := min(size.X, size.Y)
+	x := (size.X - side) / 2
+	y := (size.Y - side) / 2
+	return image.Rect(x, y, x+side, y+side)
+}
+
+// cropVariants fingerprints the named image after trimming a little off its edges, both evenly
+// and from one side at a time, to find copies that were cropped or shifted slightly.
+func (h *hasher) cropVariants(name string) ([]fingerprint, error) {
+	imf, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer imf.Close()
+	im, _, err := image.Decode(imf)
+	if err != nil {
+		return nil, err
+	}
+	width := im.Bounds().Dx()
+	height := im.Bounds().Dy()
+	var variants []fingerprint
+	for _, frac := range cropFractions {
+		dx := int(frac * float64(width))
+		dy := int(frac * float64(height))
+		rects := []image.Rectangle{
+			image.Rect(dx, dy, width-dx, height-dy),
+			image.Rect(2*dx, 0, width, height),
+			image.Rect(0, 0, width-2*dx, height),
+			image.Rect(0, 2*dy, width, height),
+			image.Rect(0, 0, width, height-2*dy),
+		}
+		for _, r := range rects {
+			fs, err := h.fingerprintDecoded(cropImage(im, r))
+			if err != nil {
+				continue
+			}
+			variants = append(variants, fs[0])
+		}
+	}
+	return variants, nil
+}
+
+// region is part of an image, as fractions of its width and height, as given to -crop-region.
+type region struct {
+	x, y, w, h float64
+}
+
+// parseRegion parses a region like "0,0.05,1,0.9": the left and top edges, then the width and
+// height, each a fraction of the image's.
+func parseRegion(s string) (region, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) != 4 {
+		return region{}, fmt.Errorf("-crop-region must be four fractions x,y,w,h, got %q", s)
+	}
+	var v [4]float64
+	for i, field := range fields {
+		f, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || f < 0 || f > 1 {
+			return region{}, fmt.Errorf("-crop-region must be four fractions from 0 to 1, got %q", s)
+		}
+		v[i] = f
+	}
+	r := region{x: v[0], y: v[1], w: v[2], h: v[3]}
+	// A little slack lets fractions like 0.05 and 0.95 add up to 1 despite rounding.
+	if r.w == 0 || r.h == 0 || r.x+r.w > 1+1e-9 || r.y+r.h > 1+1e-9 {
+		return region{}, fmt.Errorf("-crop-region must have a width and height, and fit inside the image, got %q", s)
+	}
+	return r, nil
+}
+
+// rect returns the region of an image of the given size, at least one pixel across.
+func (r region) rect(size image.Point) image.Rectangle {
+	x0 := min(int(math.Round(r.x*float64(size.X))), size.X-1)
+	y0 := min(int(math.Round(r.y*float64(size.Y))), size.Y-1)
+	x1 := max(x0+1, int(math.Round((r.x+r.w)*float64(size.X))))
+	y1 := max(y0+1, int(math.Round((r.y+r.h)*float64(size.Y))))
+	return image.Rect(x0, y0, x1, y1)
+}
+
+// String formats the region as parseRegion takes it.
+func (r region) String() string {
+	return fmt.Sprintf("%g,%g,%g,%g", r.x, r.y, r.w, r.h)
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCropTolerantMatchesCenterCrop(t *testing.T) {
+	// A copy with 5% cropped off every edge is too far from the original to match, but within
+	// twice the threshold, so -crop-tolerant tries the original's crops and finds it.
+	dir := t.TempDir()
+	im := testImage(200, 160, 1)
+	writeTestPNG(t, filepath.Join(dir, "a.png"), im)
+	writeTestPNG(t, filepath.Join(dir, "cropped.png"), cropImage(im, image.Rect(10, 8, 190, 152)))
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"-crop-tolerant"}, "Possible matches: a.png cropped.png"},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append(tc.args, "-quiet", "-base", dir, dir)
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if got := strings.Join(strings.Fields(stdout.String()), " "); got != tc.want {
+			t.Errorf("%q: got %q, want %q", args, got, tc.want)
+		}
+	}
+}
+
+func TestCenterCropMatchesAspectRatios(t *testing.T) {
+	// A wide and a tall crop of the same scene share their centered square, which is all that
+	// -center-crop hashes.
+	dir := t.TempDir()
+	scene := testImage(320, 320, 1)
+	writeTestPNG(t, filepath.Join(dir, "tall.png"), cropImage(scene, image.Rect(80, 0, 240, 320)))
+	writeTestPNG(t, filepath.Join(dir, "wide.png"), cropImage(scene, image.Rect(0, 80, 320, 240)))
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"-center-crop"}, "Possible matches: tall.png wide.png"},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append(tc.args, "-quiet", "-base", dir, dir)
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if got := strings.Join(strings.Fields(stdout.String()), " "); got != tc.want {
+			t.Errorf("%q: got %q, want %q", args, got, tc.want)
+		}
+	}
+}
+
+func TestCropRegionIgnoresStatusBar(t *testing.T) {
+	// Two screenshots of the same page, one with a dark status bar and one with a light one,
+	// covering the top tenth of the screen.
+	dir := t.TempDir()
+	for name, bar := range map[string]color.Gray{"dark.png": {Y: 0}, "light.png": {Y: 0xff}} {
+		im := testImage(180, 320, 1)
+		draw.Draw(im, image.Rect(0, 0, 180, 32), image.NewUniform(bar), image.Point{}, draw.Src)
+		writeTestPNG(t, filepath.Join(dir, name), im)
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"-crop-region", "0,0.1,1,0.9"}, "Possible matches: dark.png light.png"},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append(tc.args, "-quiet", "-base", dir, dir)
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if got := strings.Join(strings.Fields(stdout.String()), " "); got != tc.want {
+			t.Errorf("%q: got %q, want %q", args, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	// errDecodeTimeout is returned for images that take longer than -decode-timeout to decode.
+	errDecodeTimeout = errors.New("timed out decoding image")
+	// errPartialImage is returned along with an image that could only be partly decoded.
+	errPartialImage = errors.New("image is incomplete")
+	// errUnsupportedFormat wraps errors for files that aren't in any image format we can decode.
+	errUnsupportedFormat = errors.New("unsupported image format")
+	// errNotImage is used instead of errUnsupportedFormat for files that are recognizably
+	// something other than an image, like a text file with an image's extension.
+	errNotImage = errors.New("not an image")
+	// errDecode wraps errors for images in a known format that can't be decoded, usually because they are corrupt.
+	errDecode = errors.New("corrupt image")
+	// errIO wraps errors reading a file.
+	errIO = errors.New("I/O error")
+	// errTooLarge is returned for images that would take more than -max-decode-bytes to decode.
+	errTooLarge = errors.New("image too large")
+)
+
+// decodeError wraps an error from decoding an image in errUnsupportedFormat, errDecode, or
+// errIO, keeping the original error in the chain. Other errors, including errNotImage, are
+// returned unchanged.
+func decodeError(err error) error {
+	var pathErr *fs.PathError
+	switch {
+	case err == nil, errors.Is(err, errPartialImage), errors.Is(err, errDecodeTimeout), errors.Is(err, errNotImage), errors.Is(err, errTooLarge):
+		return err
+	case errors.Is(err, image.ErrFormat):
+		return fmt.Errorf("%w: %w", errUnsupportedFormat, err)
+	case errors.As(err, &pathErr):
+		return fmt.Errorf("%w: %w", errIO, err)
+	default:
+		return fmt.Errorf("%w: %w", errDecode, err)
+	}
+}
+
+// jpegEOI is the marker that ends a JPEG.
+var jpegEOI = []byte{0xff, 0xd9}
+
+// decode decodes an image, giving up with errDecodeTimeout if it takes longer than h.decodeTimeout.
+// Decoding can't be interrupted, so on timeout it is left to finish in the background; closing
+// the underlying file makes it fail promptly. As it may still be reading r, nothing else may read
+// from what r reads from, like the rest of an archive or a request's body.
+func (h *hasher) decode(r io.Reader) (image.Image, error) {
+	if h.decodeTimeout <= 0 {
+		return h.decodeImage(r)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.decodeTimeout)
+	defer cancel()
+	type result struct {
+		im  image.Image
+		err error
+	}
+	// done is buffered so that the goroutine can always send its result and exit.
+	done := make(chan result, 1)
+	go func() {
+		im, err := h.decodeImage(r)
+		done <- result{im, err}
+	}()
+	select {
+	case res := <-done:
+		return res.im, res.err
+	case <-ctx.Done():
+		return nil, errDecodeTimeout
+	}
+}
+
+// decodeImage decodes an image. Unless h.strictDecode is set, a truncated JPEG is padded out so
+// that the part of it that is there can still be used, and it is returned with errPartialImage.
+// The missing part decodes as flat gray, so a partial image can still match other images
+// poorly; that is the tradeoff against skipping it entirely.
+func (h *hasher) decodeImage(r io.Reader) (image.Image, error) {
+	if h.strictDecode {
+		br := bufio.NewReader(r)
+		head, _ := br.Peek(sniffLen)
+		var src io.Reader = br
+		if h.maxDecodeBytes > 0 {
+			// The header is read again by Decode.
+			var header bytes.Buffer
+			if err := h.checkDecodeSize(io.TeeReader(br, &header)); err != nil {
+				return nil, err
+			}
+			src = io.MultiReader(&header, br)
+		}
+		im, _, err := image.Decode(src)
+		return im, notImageError(head, err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if h.maxDecodeBytes > 0 {
+		if err := h.checkDecodeSize(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	}
+	im, _, err := image.Decode(bytes.NewReader(data))
+	if err == nil {
+		return im, nil
+	}
+	if errors.Is(err, image.ErrFormat) {
+		return nil, notImageError(data[:min(len(data), sniffLen)], err)
+	}
+	config, format, cerr := image.DecodeConfig(bytes.NewReader(data))
+	if cerr != nil || format != "jpeg" {
+		return nil, err
+	}
+	// Zeros are enough to finish any unfinished scan, and the decoder skips the rest of them
+	// while looking for the next marker.
+	padding := io.LimitReader(zeroReader{}, 2*int64(config.Width)*int64(config.Height)+1024)
+	im, _, perr := image.Decode(io.MultiReader(bytes.NewReader(data), padding, bytes.NewReader(jpegEOI)))
+	if perr != nil {
+		return nil, err
+	}
+	return im, errPartialImage
+}
+
+// checkDecodeSize reads an image's header and returns errTooLarge if decoding it would take more
+// than h.maxDecodeBytes, at 4 bytes a pixel, so that a huge image can be skipped before it is
+// decoded. Headers that can't be read are left for decoding to report.
+func (h *hasher) checkDecodeSize(r io.Reader) error {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil
+	}
+	if size := 4 * int64(config.Width) * int64(config.Height); size > h.maxDecodeBytes {
+		return fmt.Errorf("%w: %dx%d would take %d bytes to decode, more than -max-decode-bytes", errTooLarge, config.Width, config.Height, size)
+	}
+	return nil
+}
+
+// isImageFile reports whether the named file starts like an image in a format that can be decoded,
+// going by its header rather than its name.
+func isImageFile(name string) bool {
+	f, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, _, err = image.DecodeConfig(bufio.NewReader(f))
+	return err == nil
+}
+
+// sniffLen is how much of the start of a file notImageError looks at.
+const sniffLen = 512
+
+// notImageError replaces an image.ErrFormat error with errNotImage if head, the start of the file,
+// is recognizably something else, like text or a PDF. Files that could be in an image format the
+// sniffer doesn't know are left as they are.
+func notImageError(head []byte, err error) error {
+	if !errors.Is(err, image.ErrFormat) {
+		return err
+	}
+	mime := http.DetectContentType(head)
+	if mime == "application/octet-stream" || strings.HasPrefix(mime, "image/") {
+		return err
+	}
+	return fmt.Errorf("%w: looks like %s", errNotImage, strings.Split(mime, ";")[0])
+}
+
+// zeroReader reads an endless stream of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
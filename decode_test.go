@@ -0,0 +1,329 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowMagic starts the files of a test format whose decoder blocks until the channel in
+// slowRelease is closed.
+const slowMagic = "SLOWTEST"
+
+var slowRelease atomic.Pointer[chan struct{}]
+
+func init() {
+	slow := func(r io.Reader) (image.Image, error) {
+		<-*slowRelease.Load()
+		return nil, io.ErrUnexpectedEOF
+	}
+	image.RegisterFormat("slowtest", slowMagic, slow, func(r io.Reader) (image.Config, error) {
+		_, err := slow(r)
+		return image.Config{}, err
+	})
+}
+
+// hugeMagic starts the files of a test format whose header says the image is 50000x50000, and
+// whose decoder counts how many times it is called in hugeDecodes.
+const hugeMagic = "HUGETEST"
+
+var hugeDecodes atomic.Int32
+
+func init() {
+	image.RegisterFormat("hugetest", hugeMagic, func(r io.Reader) (image.Image, error) {
+		hugeDecodes.Add(1)
+		return nil, io.ErrUnexpectedEOF
+	}, func(r io.Reader) (image.Config, error) {
+		return image.Config{ColorModel: color.RGBAModel, Width: 50000, Height: 50000}, nil
+	})
+}
+
+func TestDecodeTimeoutSkipsSlowFile(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPNG(t, filepath.Join(dir, "a.png"), testImage(64, 48, 1))
+	writeTestPNG(t, filepath.Join(dir, "b.png"), testImage(64, 48, 1))
+	slow := filepath.Join(dir, "slow.png")
+	if err := os.WriteFile(slow, []byte(slowMagic+strings.Repeat("\x00", 100)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Let the decoder that was left behind finish once the test is done.
+	release := make(chan struct{})
+	slowRelease.Store(&release)
+	defer close(release)
+
+	var stdout, stderr bytes.Buffer
+	start := time.Now()
+	if code := run([]string{"-decode-timeout", "50ms", "-base", dir, dir}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("run took %v, so the slow file wasn't given up on", elapsed)
+	}
+	if got, want := strings.Join(strings.Fields(stdout.String()), " "), "Possible matches: a.png b.png"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, want := range []string{"Timed out decoding image " + slow, "1 timed out"} {
+		if !strings.Contains(stderr.String(), want) {
+			t.Errorf("stderr %q doesn't contain %q", stderr.String(), want)
+		}
+	}
+}
+
+func TestStrictDecodeTruncatedJPEG(t *testing.T) {
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(160, 120, 1), &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{"full.jpg": buf.Bytes(), "truncated.jpg": buf.Bytes()[:buf.Len()*9/10]} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	truncated := filepath.Join(dir, "truncated.jpg")
+
+	for _, tc := range []struct {
+		args         []string
+		want, stderr string
+	}{
+		// By default, the truncated copy is reported and skipped.
+		{nil, "", "Error decoding image " + truncated},
+		// Otherwise, what's there of it is still close enough to match.
+		{[]string{"-strict-decode=false"}, "Possible matches: full.jpg truncated.jpg", ""},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append(tc.args, "-base", dir, dir)
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if got := strings.Join(strings.Fields(stdout.String()), " "); got != tc.want {
+			t.Errorf("%q: got %q, want %q", args, got, tc.want)
+		}
+		if !strings.Contains(stderr.String(), tc.stderr) {
+			t.Errorf("%q: stderr %q doesn't contain %q", args, stderr.String(), tc.stderr)
+		}
+	}
+}
+
+func TestFingerprintErrorCategories(t *testing.T) {
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(64, 48, 1)); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"tiff.png":    append([]byte("II*\x00"), make([]byte, 100)...),
+		"corrupt.png": buf.Bytes()[:buf.Len()/2],
+		"notes.png":   []byte("just some notes, not an image at all\n"),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]error{
+		"tiff.png":    errUnsupportedFormat,
+		"corrupt.png": errDecode,
+		"notes.png":   errNotImage,
+		"missing.png": errIO,
+	} {
+		_, err := testHasher().fingerprintImage(filepath.Join(dir, name))
+		if !errors.Is(err, want) {
+			t.Errorf("%s: got %v, want %v", name, err, want)
+		}
+		for _, other := range []error{errUnsupportedFormat, errDecode, errNotImage, errIO} {
+			if other != want && errors.Is(err, other) {
+				t.Errorf("%s: %v is also %v", name, err, other)
+			}
+		}
+	}
+
+	// The CLI counts the files it skipped by category.
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{dir}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	for _, want := range []string{"1 not an image", "1 unsupported format", "1 corrupt"} {
+		if !strings.Contains(stderr.String(), want) {
+			t.Errorf("stderr %q doesn't contain %q", stderr.String(), want)
+		}
+	}
+}
+
+func TestCheckpointResumesInterruptedScan(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"1.png", "2.png", "4.png"} {
+		writeTestPNG(t, filepath.Join(dir, name), testImage(64, 48, 1))
+	}
+	if err := os.WriteFile(filepath.Join(dir, "3.png"), []byte(slowMagic+strings.Repeat("\x00", 100)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	slowRelease.Store(&release)
+	saved := filepath.Join(t.TempDir(), "checkpoint.jsonl")
+	summaryFile := filepath.Join(t.TempDir(), "summary.json")
+	readSummary := func() runSummary {
+		t.Helper()
+		data, err := os.ReadFile(summaryFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s runSummary
+		if err := json.Unmarshal(data, &s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	// One file at a time, in order, the scan is interrupted while 3.png is still decoding, after
+	// 1.png and 2.png are saved to the checkpoint and before 4.png is started.
+	var stdout, stderr bytes.Buffer
+	args := []string{"-jobs", "1", "-checkpoint", saved, "-summary-json", summaryFile}
+	first := append(args, "-max-duration", "200ms", "-decode-timeout", "1s", dir)
+	if code := run(first, &stdout, &stderr); code != 0 {
+		t.Fatalf("%q: exit status %d; stderr %q", first, code, stderr.String())
+	}
+	if s := readSummary(); !s.Partial || s.Scanned != 2 {
+		t.Fatalf("interrupted run scanned %d files, partial %v; want 2, and partial", s.Scanned, s.Partial)
+	}
+
+	// The second run only has to fingerprint 3.png, which now fails straight away, and 4.png.
+	close(release)
+	stdout.Reset()
+	resumed := append(args, "-verbose", dir)
+	if code := run(resumed, &stdout, &stderr); code != 0 {
+		t.Fatalf("%q: exit status %d; stderr %q", resumed, code, stderr.String())
+	}
+	if s := readSummary(); s.Partial || s.Reused != 2 || s.Scanned != 1 || s.Failed != 1 {
+		t.Errorf("resumed run reused %d, scanned %d, and failed %d files; want 2, 1, and 1", s.Reused, s.Scanned, s.Failed)
+	}
+	if !strings.Contains(stdout.String(), "Resuming with 2 fingerprints") {
+		t.Errorf("output doesn't say it's resuming:\n%s", stdout.String())
+	}
+	if _, err := os.Stat(saved); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the checkpoint is still there after the scan finished: %v", err)
+	}
+}
+
+func TestRenamedTextFilesSkippedAsNotImages(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPNG(t, filepath.Join(dir, "a.png"), testImage(64, 48, 1))
+	writeTestPNG(t, filepath.Join(dir, "b.png"), testImage(64, 48, 1))
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(64, 48, 2)); err != nil {
+		t.Fatal(err)
+	}
+	// Two text files that would match each other if they were given empty fingerprints.
+	for name, data := range map[string][]byte{
+		"notes.png":   []byte("just some notes, not an image at all\n"),
+		"todo.png":    []byte("- buy milk\n- fix the scanner\n"),
+		"corrupt.png": buf.Bytes()[:buf.Len()/2],
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-base", dir, dir}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	if got, want := strings.Join(strings.Fields(stdout.String()), " "), "Possible matches: a.png b.png"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, want := range []string{"2 not an image", "1 corrupt"} {
+		if !strings.Contains(stderr.String(), want) {
+			t.Errorf("stderr %q doesn't contain %q", stderr.String(), want)
+		}
+	}
+}
+
+func TestMaxDecodeBytesSkipsBeforeDecoding(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPNG(t, filepath.Join(dir, "a.png"), testImage(64, 48, 1))
+	writeTestPNG(t, filepath.Join(dir, "b.png"), testImage(64, 48, 1))
+	huge := filepath.Join(dir, "huge.png")
+	if err := os.WriteFile(huge, []byte(hugeMagic+strings.Repeat("\x00", 100)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 64x48 images take 12288 bytes to decode, and the huge one 10 gigabytes.
+	for _, strict := range []string{"-strict-decode=true", "-strict-decode=false"} {
+		hugeDecodes.Store(0)
+		var stdout, stderr bytes.Buffer
+		args := []string{strict, "-max-decode-bytes", "100000", "-base", dir, dir}
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if got, want := strings.Join(strings.Fields(stdout.String()), " "), "Possible matches: a.png b.png"; got != want {
+			t.Errorf("%q: got %q, want %q", args, got, want)
+		}
+		for _, want := range []string{huge, "50000x50000", "1 too large"} {
+			if !strings.Contains(stderr.String(), want) {
+				t.Errorf("%q: stderr %q doesn't contain %q", args, stderr.String(), want)
+			}
+		}
+		if n := hugeDecodes.Load(); n != 0 {
+			t.Errorf("%q: the huge image was decoded %d times", args, n)
+		}
+	}
+}
+
+func TestMaxDurationStopsDuringSlowDecode(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"1.png", "2.png", "4.png"} {
+		writeTestPNG(t, filepath.Join(dir, name), testImage(64, 48, 1))
+	}
+	if err := os.WriteFile(filepath.Join(dir, "3.png"), []byte(slowMagic+strings.Repeat("\x00", 100)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	slowRelease.Store(&release)
+	defer close(release)
+	summaryFile := filepath.Join(t.TempDir(), "summary.json")
+
+	// One file at a time, the deadline passes while 3.png is decoding, long before
+	// -decode-timeout would give up on it. The run stops there, with nothing left to match in.
+	var stdout, stderr bytes.Buffer
+	args := []string{"-jobs", "1", "-max-duration", "200ms", "-decode-timeout", "10s", "-summary-json", summaryFile, "-format", "json", dir}
+	start := time.Now()
+	if code := run(args, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("run took %v, so it waited for the slow decode", elapsed)
+	}
+	if got := stdout.String(); got != "[]\n" {
+		t.Errorf("got %q, want no groups", got)
+	}
+	if want := "these results are partial"; !strings.Contains(stderr.String(), want) {
+		t.Errorf("stderr %q doesn't contain %q", stderr.String(), want)
+	}
+	if strings.Contains(stderr.String(), "3.png") {
+		t.Errorf("stderr %q reports 3.png, which wasn't finished", stderr.String())
+	}
+	data, err := os.ReadFile(summaryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s runSummary
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Partial || s.Scanned != 2 || s.Failed != 0 {
+		t.Errorf("scanned %d files and failed %d, partial %v; want 2, 0, and partial", s.Scanned, s.Failed, s.Partial)
+	}
+}
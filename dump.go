@@ -0,0 +1,77 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dumpIntermediates decodes the named image again and saves the image after each step of the
+// pipeline that runs, from resampled to the monochrome first fingerprint, to a directory of its
+// own under dir, as 1-resampled.png, 2-grayscale.png, and so on. With -multiscale, the steps are
+// those at -intermediate-size.
+func (h *hasher) dumpIntermediates(dir, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	im, err := h.decode(f)
+	if err != nil && !errors.Is(err, errPartialImage) {
+		return err
+	}
+	// Paths are flattened into one directory name so that files with the same name in
+	// different directories don't overwrite each other.
+	out := filepath.Join(dir, strings.ReplaceAll(strings.TrimLeft(filepath.ToSlash(name), "/"), "/", "_"))
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		return err
+	}
+	n := 0
+	var dumpErr error
+	fs, err := h.fingerprintStages(im, func(stage string, im image.Image) {
+		n++
+		if dumpErr == nil {
+			dumpErr = savePNG(filepath.Join(out, fmt.Sprintf("%d-%s.png", n, stage)), im)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if dumpErr != nil {
+		return dumpErr
+	}
+	return savePNG(filepath.Join(out, fmt.Sprintf("%d-monochrome.png", n+1)), fs[0].image())
+}
+
+// image draws the fingerprint as a 16x16 image, with set bits black and unset bits white, as
+// medianHash sets the bits that are darker than the median.
+func (a fingerprint) image() image.Image {
+	im := image.NewGray(image.Rect(0, 0, hashSize, hashSize))
+	for y := 0; y < hashSize; y++ {
+		for x := 0; x < hashSize; x++ {
+			if !a.bit(x, y) {
+				im.SetGray(x, y, color.Gray{Y: 0xff})
+			}
+		}
+	}
+	return im
+}
+
+// savePNG saves im to the named file as a PNG.
+func savePNG(name string, im image.Image) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, im); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
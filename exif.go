@@ -0,0 +1,167 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// exifInfo is what -exif-confirm uses from a photo's EXIF data.
+type exifInfo struct {
+	Model string    `json:"model,omitempty"`
+	Taken time.Time `json:"taken"`
+}
+
+var errNoEXIF = errors.New("exif: not found")
+
+const (
+	exifTagModel            = 0x0110
+	exifTagExifIFD          = 0x8769
+	exifTagDateTimeOriginal = 0x9003
+)
+
+// readEXIFFile reads the camera model and time taken from a JPEG's EXIF data.
+func readEXIFFile(name string) (*exifInfo, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tiff, err := jpegEXIF(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	return parseEXIF(tiff)
+}
+
+// jpegEXIF returns the TIFF data in a JPEG's EXIF segment. It stops looking at the start of the
+// image data, so it only reads the headers.
+func jpegEXIF(r io.Reader) ([]byte, error) {
+	var marker [4]byte
+	if _, err := io.ReadFull(r, marker[:2]); err != nil || marker[0] != 0xff || marker[1] != 0xd8 {
+		return nil, errNoEXIF
+	}
+	for {
+		if _, err := io.ReadFull(r, marker[:]); err != nil || marker[0] != 0xff {
+			return nil, errNoEXIF
+		}
+		// Start of scan: the headers are over.
+		if marker[1] == 0xda {
+			return nil, errNoEXIF
+		}
+		n := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if n < 0 {
+			return nil, errNoEXIF
+		}
+		segment := make([]byte, n)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, errNoEXIF
+		}
+		if marker[1] == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+	}
+}
+
+// parseEXIF reads the camera model from the first IFD of EXIF TIFF data, and the time taken
+// from its EXIF IFD.
+func parseEXIF(tiff []byte) (*exifInfo, error) {
+	if len(tiff) < 8 {
+		return nil, errNoEXIF
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errNoEXIF
+	}
+	info := &exifInfo{}
+	ifd0 := exifIFD(tiff, order, order.Uint32(tiff[4:]))
+	info.Model = ifd0.ascii(exifTagModel)
+	if offset, ok := ifd0.long(exifTagExifIFD); ok {
+		taken := exifIFD(tiff, order, offset).ascii(exifTagDateTimeOriginal)
+		// Times have no time zone; they are compared with each other, so UTC will do.
+		info.Taken, _ = time.Parse("2006:01:02 15:04:05", taken)
+	}
+	return info, nil
+}
+
+// exifEntries is an IFD: its entries by tag, each the 12 bytes of the entry.
+type exifEntries struct {
+	tiff    []byte
+	order   binary.ByteOrder
+	entries map[uint16][]byte
+}
+
+// exifIFD reads the IFD at offset. Anything out of bounds is left out.
+func exifIFD(tiff []byte, order binary.ByteOrder, offset uint32) exifEntries {
+	ifd := exifEntries{tiff: tiff, order: order, entries: map[uint16][]byte{}}
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return ifd
+	}
+	n := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < n; i++ {
+		start := int(offset) + 2 + 12*i
+		if start+12 > len(tiff) {
+			break
+		}
+		entry := tiff[start : start+12]
+		ifd.entries[order.Uint16(entry)] = entry
+	}
+	return ifd
+}
+
+// ascii returns the value of an ASCII entry, or "" if there isn't one.
+func (ifd exifEntries) ascii(tag uint16) string {
+	entry, ok := ifd.entries[tag]
+	if !ok || ifd.order.Uint16(entry[2:]) != 2 {
+		return ""
+	}
+	n := ifd.order.Uint32(entry[4:])
+	value := entry[8:12]
+	if n > 4 {
+		offset := ifd.order.Uint32(entry[8:])
+		if uint64(offset)+uint64(n) > uint64(len(ifd.tiff)) {
+			return ""
+		}
+		value = ifd.tiff[offset : offset+n]
+	} else {
+		value = value[:n]
+	}
+	return strings.TrimSpace(strings.TrimRight(string(value), "\x00"))
+}
+
+// long returns the value of a LONG entry.
+func (ifd exifEntries) long(tag uint16) (uint32, bool) {
+	entry, ok := ifd.entries[tag]
+	if !ok || ifd.order.Uint16(entry[2:]) != 4 {
+		return 0, false
+	}
+	return ifd.order.Uint32(entry[8:]), true
+}
+
+// exifAgree reports whether a and b could be from the same burst or shoot: taken with the same
+// camera model, or within window of each other. Images without EXIF data agree with anything,
+// since many copies have had it stripped.
+func exifAgree(a, b *exifInfo, window time.Duration) bool {
+	if a == nil || b == nil {
+		return true
+	}
+	if a.Model != "" && a.Model == b.Model {
+		return true
+	}
+	if a.Taken.IsZero() || b.Taken.IsZero() {
+		return a.Model == "" || b.Model == ""
+	}
+	d := a.Taken.Sub(b.Taken)
+	return d <= window && d >= -window
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withEXIF encodes im as a JPEG with an EXIF segment giving the camera model and the time taken,
+// in EXIF's "2006:01:02 15:04:05" format.
+func withEXIF(t *testing.T, im image.Image, model, taken string) []byte {
+	t.Helper()
+	var tiff bytes.Buffer
+	be := binary.BigEndian
+	entry := func(tag, typ uint16, count, value uint32) {
+		_ = binary.Write(&tiff, be, tag)
+		_ = binary.Write(&tiff, be, typ)
+		_ = binary.Write(&tiff, be, count)
+		_ = binary.Write(&tiff, be, value)
+	}
+	model += "\x00"
+	taken += "\x00"
+	// The first IFD, with two entries, starts at 8 and is 30 bytes long; the model follows it,
+	// then the EXIF IFD, with one entry and 18 bytes long, and then the time.
+	modelAt := uint32(8 + 30)
+	exifAt := modelAt + uint32(len(model))
+	takenAt := exifAt + 18
+	tiff.WriteString("MM\x00\x2a")
+	_ = binary.Write(&tiff, be, uint32(8))
+	_ = binary.Write(&tiff, be, uint16(2))
+	entry(exifTagModel, 2, uint32(len(model)), modelAt)
+	entry(exifTagExifIFD, 4, 1, exifAt)
+	_ = binary.Write(&tiff, be, uint32(0))
+	tiff.WriteString(model)
+	_ = binary.Write(&tiff, be, uint16(1))
+	entry(exifTagDateTimeOriginal, 2, uint32(len(taken)), takenAt)
+	_ = binary.Write(&tiff, be, uint32(0))
+	tiff.WriteString(taken)
+
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, im, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	segment := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	var out bytes.Buffer
+	out.Write(encoded.Bytes()[:2])
+	out.Write([]byte{0xff, 0xe1})
+	_ = binary.Write(&out, be, uint16(len(segment)+2))
+	out.Write(segment)
+	out.Write(encoded.Bytes()[2:])
+	return out.Bytes()
+}
+
+func TestEXIFConfirmSplitsCameras(t *testing.T) {
+	dir := t.TempDir()
+	im := testImage(160, 120, 1)
+	for name, data := range map[string][]byte{
+		"a.jpg": withEXIF(t, im, "Canon EOS R5", "2023:05:01 10:00:00"),
+		"b.jpg": withEXIF(t, im, "NIKON Z 6", "2023:06:11 17:30:00"),
+		"c.jpg": withEXIF(t, im, "Canon EOS R5", "2023:05:02 09:00:00"),
+		"d.jpg": withEXIF(t, im, "NIKON Z 6", "2023:05:01 10:00:04"),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exif := map[string]*exifInfo{}
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg", "d.jpg"} {
+		info, err := readEXIFFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		exif[name] = info
+	}
+	if a := exif["a.jpg"]; a.Model != "Canon EOS R5" || a.Taken.Format("2006-01-02 15:04:05") != "2023-05-01 10:00:00" {
+		t.Errorf("a.jpg has EXIF %+v", a)
+	}
+	// d is from another camera than a, but taken within seconds of it.
+	if !exifAgree(exif["a.jpg"], exif["d.jpg"], 10*time.Second) || exifAgree(exif["a.jpg"], exif["b.jpg"], 10*time.Second) {
+		t.Error("a.jpg should agree with d.jpg, by time, and not with b.jpg")
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "Possible matches: a.jpg b.jpg c.jpg d.jpg"},
+		// Every pair in a group has to agree, and d doesn't with c, so it goes with b.
+		{[]string{"-exif-confirm"}, "Possible matches: a.jpg c.jpg Possible matches: b.jpg d.jpg"},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append(tc.args, "-base", dir, dir)
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if got := strings.Join(strings.Fields(stdout.String()), " "); got != tc.want {
+			t.Errorf("%q: got %q, want %q", args, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// explainPair prints why two images do or don't match: their fingerprints, the distance between
+// them and the threshold, and their bits side by side with the bits that differ, as grids of #
+// for set bits and . for unset ones. With -invariant, a's bits are shown in the transform that is
+// closest to b. With -hash-mask, the masked bits are - in the grid of differing bits, and aren't
+// counted.
+func (m *matcher) explainPair(w io.Writer, h *hasher, pathA, pathB string) error {
+	var images [2]imageInfo
+	for i, path := range []string{pathA, pathB} {
+		im, err := h.fingerprintImage(path)
+		if err != nil && !errors.Is(err, errPartialImage) {
+			return fmt.Errorf("decoding image %s: %w", path, err)
+		}
+		im.Path = path
+		images[i] = im
+	}
+	a, b := &images[0], &images[1]
+
+	var out strings.Builder
+	for i, im := range images {
+		text, _ := im.Fingerprint.MarshalText()
+		fmt.Fprintf(&out, "%c: %s (%dx%d)\n   %s\n", 'A'+i, im.Path, im.Width, im.Height, text)
+	}
+	d, t := m.compare(a, b)
+	_, ok := m.similar(a, b)
+	verdict := "no match"
+	if ok {
+		verdict = "match"
+	}
+	fmt.Fprintf(&out, "Distance %s, threshold %s: %s\n", m.unit.format(float64(d)), m.unit.format(float64(m.thresholdFor(a, b))), verdict)
+	for i := 0; i < len(a.Extra) && i < len(b.Extra); i++ {
+		fmt.Fprintf(&out, "Distance by %s %s\n", h.algorithmNames[i+1], m.unit.format(float64(m.distance(a.Extra[i], b.Extra[i]))))
+	}
+
+	fa := a.Fingerprint.transform(t)
+	var xor, mask fingerprint
+	if m.mask != nil {
+		mask = *m.mask
+	}
+	for i := range xor {
+		xor[i] = (fa[i] ^ b.Fingerprint[i]) &^ mask[i]
+	}
+	if t != identity {
+		fmt.Fprintf(&out, "Closest with A %s\n", t)
+	}
+	title := fmt.Sprintf("A xor B: %d bits", xor.diffbits(fingerprint{}))
+	if m.mask != nil {
+		title += fmt.Sprintf(", %d masked", mask.diffbits(fingerprint{}))
+	}
+	fmt.Fprintf(&out, "\n%-*s  %-*s  %s\n", hashSize, "A", hashSize, "B", title)
+	for y := 0; y < hashSize; y++ {
+		for i, f := range []fingerprint{fa, b.Fingerprint, xor} {
+			if i > 0 {
+				out.WriteString("  ")
+			}
+			for x := 0; x < hashSize; x++ {
+				switch {
+				case i == 2 && mask.bit(x, y):
+					out.WriteByte('-')
+				case f.bit(x, y):
+					out.WriteByte('#')
+				default:
+					out.WriteByte('.')
+				}
+			}
+		}
+		out.WriteByte('\n')
+	}
+	_, err := io.WriteString(w, out.String())
+	return err
+}
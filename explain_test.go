@@ -0,0 +1,115 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// explainGrid returns the rows of the grid of differing bits that -explain prints.
+func explainGrid(t *testing.T, out string) []string {
+	t.Helper()
+	lines := strings.Split(strings.TrimRight(out, "\n"), "\n")
+	for i, line := range lines {
+		if strings.Contains(line, "A xor B") {
+			var rows []string
+			for _, row := range lines[i+1 : i+1+hashSize] {
+				rows = append(rows, row[2*hashSize+4:])
+			}
+			return rows
+		}
+	}
+	t.Fatalf("no grid in %q", out)
+	return nil
+}
+
+func TestExplainDistanceMatchesGrid(t *testing.T) {
+	a, b := "testdata/a/waves.png", "testdata/b/ripples.png"
+	h := testHasher()
+	fa, err := h.fingerprintImage(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb, err := h.fingerprintImage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The mask covers the first two rows.
+	var mask fingerprint
+	for i := 0; i < 2*hashSize/8; i++ {
+		mask[i] = 0xff
+	}
+	maskText, _ := mask.MarshalText()
+
+	for _, tc := range []struct {
+		args         []string
+		want, masked int
+	}{
+		{nil, fa.Fingerprint.diffbits(fb.Fingerprint), 0},
+		{[]string{"-hash-mask", string(maskText)}, maskedHamming(mask)(fa.Fingerprint, fb.Fingerprint), 2 * hashSize},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append(append([]string{"-explain"}, tc.args...), a, b)
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		out := stdout.String()
+		if want := fmt.Sprintf("Distance %d, threshold", tc.want); !strings.Contains(out, want) {
+			t.Errorf("%q: output doesn't contain %q:\n%s", args, want, out)
+		}
+		grid := strings.Join(explainGrid(t, out), "")
+		if set, masked := strings.Count(grid, "#"), strings.Count(grid, "-"); set != tc.want || masked != tc.masked {
+			t.Errorf("%q: grid has %d bits set and %d masked, want %d and %d:\n%s", args, set, masked, tc.want, tc.masked, out)
+		}
+	}
+}
+
+func TestExplainDumpsIntermediates(t *testing.T) {
+	dir := t.TempDir()
+	var stdout, stderr bytes.Buffer
+	args := []string{"-explain", "-dump-intermediates", dir, "testdata/a/waves.png", "testdata/b/ripples.png"}
+	if code := run(args, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	for _, name := range []string{"testdata_a_waves.png", "testdata_b_ripples.png"} {
+		if _, err := os.Stat(filepath.Join(dir, name, "6-monochrome.png")); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestDumpIntermediatesWritesSixStages(t *testing.T) {
+	images, dir := t.TempDir(), t.TempDir()
+	writeTestPNG(t, filepath.Join(images, "a.png"), testImage(100, 80, 1))
+	writeTestPNG(t, filepath.Join(images, "b.png"), testImage(100, 80, 2))
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-dump-intermediates", dir, images}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	want := "1-resampled.png 2-grayscale.png 3-blurred.png 4-normalized.png 5-equalized.png 6-monochrome.png"
+	// One directory for each input.
+	inputs, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) != 2 {
+		t.Fatalf("got %d directories, want one for each of the 2 inputs", len(inputs))
+	}
+	for _, input := range inputs {
+		entries, err := os.ReadDir(filepath.Join(dir, input.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Name())
+		}
+		if strings.Join(got, " ") != want {
+			t.Errorf("%s: wrote %q, want %q", input.Name(), got, want)
+		}
+	}
+}
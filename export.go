@@ -0,0 +1,184 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MarshalText encodes the fingerprint as hex.
+func (a fingerprint) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(a[:])), nil
+}
+
+// UnmarshalText decodes a hex or base64 fingerprint; see parseFingerprint.
+func (a *fingerprint) UnmarshalText(text []byte) error {
+	f, err := parseFingerprint(string(text))
+	if err != nil {
+		return err
+	}
+	*a = f
+	return nil
+}
+
+// parseFingerprint decodes a fingerprint written as 64 hex digits or 44 characters of base64,
+// telling them apart by length. Anything else is an error rather than a partial fingerprint.
+func parseFingerprint(s string) (fingerprint, error) {
+	var f fingerprint
+	switch len(s) {
+	case hex.EncodedLen(len(f)):
+		for i, r := range s {
+			if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+				return f, fmt.Errorf("fingerprint %q has %q at position %d, which isn't a hex digit", s, r, i+1)
+			}
+		}
+		_, err := hex.Decode(f[:], []byte(s))
+		return f, err
+	case base64.StdEncoding.EncodedLen(len(f)):
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return f, fmt.Errorf("fingerprint %q isn't valid base64: %w", s, err)
+		}
+		if len(b) != len(f) {
+			return f, fmt.Errorf("fingerprint %q has %d bytes, expected %d", s, len(b), len(f))
+		}
+		copy(f[:], b)
+		return f, nil
+	default:
+		return f, fmt.Errorf("fingerprint %q has %d characters, expected %d hex digits or %d characters of base64",
+			s, len(s), hex.EncodedLen(len(f)), base64.StdEncoding.EncodedLen(len(f)))
+	}
+}
+
+// base64Fingerprint is a fingerprint that is encoded as base64 instead of hex.
+type base64Fingerprint fingerprint
+
+// MarshalText encodes the fingerprint as base64.
+func (a base64Fingerprint) MarshalText() ([]byte, error) {
+	return []byte(base64.StdEncoding.EncodeToString(a[:])), nil
+}
+
+// base64Image is an imageInfo whose fingerprints are encoded as base64.
+type base64Image struct {
+	imageInfo
+	Fingerprint base64Fingerprint   `json:"fingerprint"`
+	Extra       []base64Fingerprint `json:"extra,omitempty"`
+}
+
+// newBase64Image converts an imageInfo to be encoded with base64 fingerprints.
+func newBase64Image(im imageInfo) base64Image {
+	b := base64Image{imageInfo: im, Fingerprint: base64Fingerprint(im.Fingerprint)}
+	for _, f := range im.Extra {
+		b.Extra = append(b.Extra, base64Fingerprint(f))
+	}
+	return b
+}
+
+// exportFingerprints writes one JSON object per image to the named file, tagged with
+// the version of the hasher that computed them. The fingerprints are encoded as hex,
+// or as base64 if encoding is "base64".
+func exportFingerprints(name string, images []imageInfo, version string, encoding string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, im := range images {
+		im.Version = version
+		var v any = im
+		if encoding == "base64" {
+			v = newBase64Image(im)
+		}
+		if err := enc.Encode(v); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// importFingerprints reads images written by exportFingerprints. Fingerprints with a version other
+// than the given one aren't comparable, so they are left out and only counted as stale.
+func importFingerprints(name string, version string) (images []imageInfo, stale int, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var im imageInfo
+		if err := dec.Decode(&im); err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", name, err)
+		}
+		if im.Version != version {
+			stale++
+			continue
+		}
+		images = append(images, im)
+	}
+	return images, stale, nil
+}
+
+// readFingerprintList reads a file of hex or base64 fingerprints, one per line. Anything after the fingerprint
+// on a line, blank lines, and lines starting with # are ignored.
+func readFingerprintList(name string) ([]fingerprint, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var fingerprints []fingerprint
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		var fp fingerprint
+		if err := fp.UnmarshalText([]byte(fields[0])); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+		fingerprints = append(fingerprints, fp)
+	}
+	return fingerprints, scanner.Err()
+}
+
+// exportDataset writes the images to the named file as tab-separated values for use as a labeled
+// dataset, after a header line: the name of the directory each image is in as its label, its path
+// in the style of paths, and its fingerprint, encoded as for exportFingerprints.
+func exportDataset(name string, images []imageInfo, paths pathStyle, encoding string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	_, _ = w.WriteString("label\tpath\tfingerprint\n")
+	for _, im := range images {
+		text, _ := im.Fingerprint.MarshalText()
+		if encoding == "base64" {
+			text, _ = base64Fingerprint(im.Fingerprint).MarshalText()
+		}
+		label := filepath.Base(filepath.Dir(im.Path))
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\n", label, paths.format(im.Path), text); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
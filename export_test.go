@@ -0,0 +1,392 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseFingerprintErrors(t *testing.T) {
+	hex := strings.Repeat("0123456789abcdef", 4)
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{"empty", "", "has 0 characters"},
+		{"too short", hex[:63], "has 63 characters"},
+		{"too long", hex + "0", "has 65 characters"},
+		{"bad hex", hex[:10] + "g" + hex[11:], `has 'g' at position 11`},
+		{"space in hex", hex[:63] + " ", `has ' ' at position 64`},
+		{"bad base64", strings.Repeat("!", 44), "isn't valid base64"},
+		{"base64 of the wrong length", strings.Repeat("A", 40) + "A===", "isn't valid base64"},
+	} {
+		if _, err := parseFingerprint(tc.in); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: parseFingerprint(%q) = %v, want an error containing %q", tc.name, tc.in, err, tc.want)
+		}
+	}
+}
+
+func TestReadFingerprintListErrors(t *testing.T) {
+	hex := strings.Repeat("0123456789abcdef", 4)
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{"bad hex", "# placeholders\n" + hex + "\n" + strings.Repeat("z", 64) + "\n", "list:3:"},
+		{"wrong length", hex[:32] + "\n", "list:1:"},
+		{"missing tab", hex + "placeholder.png\n", "list:1:"},
+	} {
+		name := filepath.Join(t.TempDir(), "list")
+		if err := os.WriteFile(name, []byte(tc.in), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readFingerprintList(name); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: readFingerprintList = %v, want an error containing %q", tc.name, err, tc.want)
+		}
+	}
+
+	name := filepath.Join(t.TempDir(), "list")
+	if err := os.WriteFile(name, []byte(hex+"\tplaceholder.png\n\n# comment\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := readFingerprintList(name)
+	if err != nil || len(fs) != 1 {
+		t.Errorf("readFingerprintList = %v, %v, want one fingerprint", fs, err)
+	}
+}
+
+func TestImportGroupsLikeDirectRun(t *testing.T) {
+	// Fingerprints exported from one directory and imported alongside a scan of another group
+	// the images as scanning both does. Imported images come after scanned ones, so only the
+	// groups' members are compared, not their order.
+	exported := filepath.Join(t.TempDir(), "b.jsonl")
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-export-fingerprints", exported, "testdata/b"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exporting: exit status %d; stderr %q", code, stderr.String())
+	}
+	f, err := os.Open(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(f); scanner.Scan(); lines++ {
+		var im imageInfo
+		if err := json.Unmarshal(scanner.Bytes(), &im); err != nil {
+			t.Fatalf("line %d: %v", lines+1, err)
+		}
+		if !strings.HasPrefix(im.Path, "testdata/b/") || im.Fingerprint == zeroFingerprint || im.Version != testHasher().version() {
+			t.Errorf("line %d: %+v", lines+1, im)
+		}
+	}
+	if lines != 3 {
+		t.Errorf("exported %d images, want the 3 in testdata/b", lines)
+	}
+
+	groupPaths := func(args []string) string {
+		t.Helper()
+		var stdout, stderr bytes.Buffer
+		if code := run(append([]string{"-format", "json"}, args...), &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		var groups []group
+		if err := json.Unmarshal(stdout.Bytes(), &groups); err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, g := range groups {
+			var members []string
+			for _, m := range g.Members {
+				members = append(members, m.Path)
+			}
+			slices.Sort(members)
+			paths = append(paths, strings.Join(members, " "))
+		}
+		slices.Sort(paths)
+		return strings.Join(paths, "\n")
+	}
+	direct := groupPaths([]string{"testdata/b", "testdata/a"})
+	if direct == "" {
+		t.Fatal("the direct run found no groups")
+	}
+	if imported := groupPaths([]string{"-import-fingerprints", exported, "testdata/a"}); imported != direct {
+		t.Errorf("with imported fingerprints, groups are\n%s\nwant\n%s", imported, direct)
+	}
+}
+
+func TestReplayExportedRun(t *testing.T) {
+	// A run replayed from its exported fingerprints, with no paths, prints what it printed,
+	// in the same order. (JSON isn't compared, since it gives the argument each file was found
+	// under, and a replay has none.)
+	exported := filepath.Join(t.TempDir(), "run.jsonl")
+	for _, format := range []string{"text", "delete-list", "keep-list"} {
+		var recorded, replayed, stderr bytes.Buffer
+		args := []string{"-format", format, "-show-resolution", "-export-fingerprints", exported, "testdata/b", "testdata/a"}
+		if code := run(args, &recorded, &stderr); code != 0 {
+			t.Fatalf("recording %q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if recorded.Len() == 0 {
+			t.Fatalf("recording %q printed nothing", args)
+		}
+		args = []string{"-format", format, "-show-resolution", "-import-fingerprints", exported}
+		if code := run(args, &replayed, &stderr); code != 0 {
+			t.Fatalf("replaying %q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if replayed.String() != recorded.String() {
+			t.Errorf("-format %s replayed\n%s\nwant what was recorded\n%s", format, replayed.String(), recorded.String())
+		}
+	}
+}
+
+func TestStaleVersionsIgnored(t *testing.T) {
+	// A different blur radius stands in for an upgraded pipeline.
+	v1 := testHasher()
+	v2 := testHasher()
+	v2.blurRadius = 2
+	if v1.version() == v2.version() {
+		t.Fatalf("both hashers have version %q", v1.version())
+	}
+	im, err := v1.fingerprintImage("testdata/a/waves.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	im.Path = "testdata/a/waves.png"
+	dir := t.TempDir()
+
+	exported := filepath.Join(dir, "export.jsonl")
+	if err := exportFingerprints(exported, []imageInfo{im}, v1.version(), "hex"); err != nil {
+		t.Fatal(err)
+	}
+	if images, stale, err := importFingerprints(exported, v2.version()); err != nil || len(images) != 0 || stale != 1 {
+		t.Errorf("importing v1 fingerprints as v2: %d images, %d stale, %v; want only 1 stale", len(images), stale, err)
+	}
+
+	saved := filepath.Join(dir, "checkpoint.jsonl")
+	for _, h := range []*hasher{v1, v2} {
+		cp, err := openCheckpoint(saved, h.version())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h == v1 {
+			if err := cp.record(im); err != nil {
+				t.Fatal(err)
+			}
+		} else if len(cp.done) != 0 {
+			t.Errorf("resuming a v1 checkpoint as v2 reused %d fingerprints", len(cp.done))
+		}
+		_ = cp.f.Close()
+	}
+
+	// An index is fingerprinted again, and rewritten for the new version.
+	index := filepath.Join(dir, "index.jsonl")
+	summaryFile := filepath.Join(dir, "summary.json")
+	for i, tc := range []struct {
+		args            []string
+		scanned, reused int
+		stale           bool
+	}{
+		{nil, 2, 0, false},
+		{[]string{"-blur-radius", "2"}, 2, 0, true},
+		{[]string{"-blur-radius", "2"}, 0, 2, false},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append(tc.args, "-since-index", index, "-summary-json", summaryFile, "testdata/a")
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		data, err := os.ReadFile(summaryFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var summary runSummary
+		if err := json.Unmarshal(data, &summary); err != nil {
+			t.Fatal(err)
+		}
+		if summary.Scanned != tc.scanned || summary.Reused != tc.reused {
+			t.Errorf("run %d: scanned %d and reused %d, want %d and %d", i+1, summary.Scanned, summary.Reused, tc.scanned, tc.reused)
+		}
+		if got := strings.Contains(stderr.String(), "indexed with different settings"); got != tc.stale {
+			t.Errorf("run %d: stderr %q, want a warning about stale fingerprints: %v", i+1, stderr.String(), tc.stale)
+		}
+	}
+}
+
+func TestExportEncodingsRoundTrip(t *testing.T) {
+	h := testHasher()
+	var err error
+	if h.algorithmNames, h.hashes, err = parseAlgorithms("ahash+dhash"); err != nil {
+		t.Fatal(err)
+	}
+	var images []imageInfo
+	for _, name := range testdataImages {
+		im, err := h.fingerprintImage(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		im.Path = name
+		images = append(images, im)
+	}
+	for encoding, length := range map[string]int{"hex": 64, "base64": 44} {
+		name := filepath.Join(t.TempDir(), encoding+".jsonl")
+		if err := exportFingerprints(name, images, h.version(), encoding); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var line struct {
+			Fingerprint string
+			Extra       []string
+		}
+		if err := json.Unmarshal(bytes.SplitN(data, []byte("\n"), 2)[0], &line); err != nil {
+			t.Fatal(err)
+		}
+		if len(line.Fingerprint) != length || len(line.Extra) != 1 || len(line.Extra[0]) != length {
+			t.Errorf("%s: exported fingerprints %q and %q, want %d characters each", encoding, line.Fingerprint, line.Extra, length)
+		}
+		if f, err := parseFingerprint(line.Fingerprint); err != nil || f != images[0].Fingerprint {
+			t.Errorf("%s: parseFingerprint(%q) = %v, %v, want %v", encoding, line.Fingerprint, f, err, images[0].Fingerprint)
+		}
+
+		imported, stale, err := importFingerprints(name, h.version())
+		if err != nil || stale != 0 || len(imported) != len(images) {
+			t.Fatalf("%s: imported %d images, %d stale, %v; want %d", encoding, len(imported), stale, err, len(images))
+		}
+		for i, im := range imported {
+			want := images[i]
+			if im.Path != want.Path || im.Fingerprint != want.Fingerprint || fmt.Sprint(im.Extra) != fmt.Sprint(want.Extra) {
+				t.Errorf("%s: imported %s %v %v, want %s %v %v", encoding, im.Path, im.Fingerprint, im.Extra, want.Path, want.Fingerprint, want.Extra)
+			}
+		}
+	}
+}
+
+func FuzzParseFingerprint(f *testing.F) {
+	// Seed with real fingerprints, as -export-fingerprints writes them in both encodings.
+	var images []imageInfo
+	for _, name := range testdataImages {
+		im, err := testHasher().fingerprintImage(filepath.Join("testdata", name))
+		if err != nil {
+			f.Fatal(err)
+		}
+		images = append(images, im)
+	}
+	for _, encoding := range []string{"hex", "base64"} {
+		name := filepath.Join(f.TempDir(), encoding+".jsonl")
+		if err := exportFingerprints(name, images, testHasher().version(), encoding); err != nil {
+			f.Fatal(err)
+		}
+		file, err := os.Open(name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		lines := bufio.NewScanner(file)
+		for lines.Scan() {
+			var line struct{ Fingerprint string }
+			if err := json.Unmarshal(lines.Bytes(), &line); err != nil {
+				f.Fatal(err)
+			}
+			f.Add(line.Fingerprint)
+		}
+		_ = file.Close()
+	}
+	f.Add("")
+	f.Add(strings.Repeat("g", 64))
+
+	f.Fuzz(func(t *testing.T, s string) {
+		fp, err := parseFingerprint(s)
+		if err != nil {
+			return
+		}
+		text, _ := fp.MarshalText()
+		again, err := parseFingerprint(string(text))
+		if err != nil || again != fp {
+			t.Errorf("%q parsed as %v, which doesn't survive a round trip through %q: %v, %v", s, fp, text, again, err)
+		}
+	})
+}
+
+func TestQueryImportedIndex(t *testing.T) {
+	// The collection is exported once, and then a new copy of one of its images is looked up in
+	// the index without scanning the collection again.
+	collection := t.TempDir()
+	original := filepath.Join(collection, "original.png")
+	writeTestPNG(t, original, testImage(100, 80, 1))
+	writeTestPNG(t, filepath.Join(collection, "other.png"), testImage(100, 80, 2))
+	index := filepath.Join(t.TempDir(), "index.jsonl")
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-export-fingerprints", index, collection}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exporting: exit status %d; stderr %q", code, stderr.String())
+	}
+	query := filepath.Join(t.TempDir(), "new.png")
+	writeTestPNG(t, query, nearCopy(testImage(100, 80, 1)))
+
+	stdout.Reset()
+	args := []string{"-query", query, "-import-fingerprints", index}
+	if code := run(args, &stdout, &stderr); code != 0 {
+		t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+	}
+	fields := strings.Fields(stdout.String())
+	if len(fields) != 2 || fields[1] != original {
+		t.Errorf("%q printed %q, want only the distance to %s", args, stdout.String(), original)
+	}
+}
+
+func TestDatasetLabelsAreParentDirectories(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"cats/1.png":          "cats",
+		"cats/2.png":          "cats",
+		"dogs/4.png":          "dogs",
+		"dogs/puppies/3.png":  "puppies",
+		"dogs/puppies/3a.png": "puppies",
+	}
+	for name := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		// They are all the same image, but nothing is matched, so no groups are printed.
+		writeTestPNG(t, path, testImage(64, 48, 1))
+	}
+	dataset := filepath.Join(t.TempDir(), "dataset.tsv")
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-dataset", dataset, "-base", dir, "-posix-paths", dir}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	if stdout.Len() > 0 {
+		t.Errorf("unexpected output %q", stdout.String())
+	}
+	data, err := os.ReadFile(dataset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if lines[0] != "label\tpath\tfingerprint" {
+		t.Errorf("header %q", lines[0])
+	}
+	got := map[string]string{}
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			t.Fatalf("line %q doesn't have 3 fields", line)
+		}
+		im, err := testHasher().fingerprintImage(filepath.Join(dir, filepath.FromSlash(fields[1])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if text, _ := im.Fingerprint.MarshalText(); fields[2] != string(text) {
+			t.Errorf("%s: fingerprint %s, want %s", fields[1], fields[2], text)
+		}
+		got[fields[1]] = fields[0]
+	}
+	if fmt.Sprint(got) != fmt.Sprint(files) {
+		t.Errorf("labels %v, want %v", got, files)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// isURL reports whether a positional argument is an http or https URL rather than a path.
+func isURL(arg string) bool {
+	return strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://")
+}
+
+// urlArg is a URL given as a positional argument.
+type urlArg struct {
+	url string
+	// origin is the argument's position, counting from 1.
+	origin int
+}
+
+// fetchImages downloads and fingerprints the images at urls, at most jobs at a time.
+// Images that can't be fetched or decoded are reported to report and left out.
+func (h *hasher) fetchImages(client *http.Client, urls []urlArg, jobs int, report *errorReporter) []imageInfo {
+	results := make([]*imageInfo, len(urls))
+	errs := make([]error, len(urls))
+	sem := make(chan struct{}, max(1, jobs))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func(i int, u urlArg) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i], errs[i] = h.fetchImage(client, u)
+		}(i, u)
+	}
+	wg.Wait()
+
+	var images []imageInfo
+	for i, im := range results {
+		if errors.Is(errs[i], errPartialImage) {
+			report.partial(urls[i].url)
+		} else if errs[i] != nil {
+			report.skip("fetching image", urls[i].url, errs[i])
+			continue
+		}
+		images = append(images, *im)
+	}
+	return images
+}
+
+// fetchImage downloads and fingerprints one image.
+func (h *hasher) fetchImage(client *http.Client, u urlArg) (*imageInfo, error) {
+	resp, err := client.Get(u.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	im, err := h.fingerprintReader(bytes.NewReader(data))
+	if err != nil && !errors.Is(err, errPartialImage) {
+		return nil, err
+	}
+	im.Path = u.url
+	im.Size = int64(len(data))
+	im.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	im.Origin = u.origin
+	return &im, err
+}
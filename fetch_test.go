@@ -0,0 +1,53 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchURLsMatch(t *testing.T) {
+	var same, other bytes.Buffer
+	if err := png.Encode(&same, testImage(100, 80, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(&other, testImage(100, 80, 2)); err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a.png", "/b.png":
+			_, _ = w.Write(same.Bytes())
+		case "/c.png":
+			_, _ = w.Write(other.Bytes())
+		case "/slow.png":
+			<-release
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	var stdout, stderr bytes.Buffer
+	args := []string{"-timeout", "200ms"}
+	for _, name := range []string{"a.png", "b.png", "c.png", "missing.png", "slow.png"} {
+		args = append(args, ts.URL+"/"+name)
+	}
+	if code := run(args, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	if got, want := stdout.String(), "Possible matches:\n"+ts.URL+"/a.png\n"+ts.URL+"/b.png\n\n"; got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	for _, want := range []string{"Error fetching image " + ts.URL + "/missing.png; ignoring. 404", "Error fetching image " + ts.URL + "/slow.png"} {
+		if !strings.Contains(stderr.String(), want) {
+			t.Errorf("stderr %q doesn't contain %q", stderr.String(), want)
+		}
+	}
+}
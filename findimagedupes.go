@@ -2,17 +2,28 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"image"
 	"image/color"
+	"io"
 	"io/fs"
 	"math"
 	"math/bits"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
 	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/template"
+	"time"
 
 	_ "image/gif"
 	_ "image/jpeg"
@@ -21,14 +32,41 @@ import (
 
 type fingerprint [32]byte
 
-var (
-	thresholdFlag  = flag.Float64("threshold", 10.0, "percentage match for threshold")
-	verboseFlag    = flag.Bool("verbose", false, "verbose")
-	extensionsFlag = flag.String("extensions", "jpg,jpeg,gif,png", "file extensions to consider, comma-separated")
-)
+// hashSize is the width and height of the image reduced to a fingerprint.
+const hashSize = 16
+
+// defaultExtensions are the extensions of the formats that can be decoded.
+var defaultExtensions = append([]string{"jpg", "jpeg", "gif", "png", "ico"}, pdfExtensions...)
 
 var zeroFingerprint = fingerprint([32]byte{})
 
+// errSolidImage is returned for images that are skipped for being a solid color.
+var errSolidImage = errors.New("image is a solid color")
+
+// imageInfo is a fingerprinted file along with some metadata about it.
+type imageInfo struct {
+	Path        string      `json:"path"`
+	Fingerprint fingerprint `json:"fingerprint"`
+	Size        int64       `json:"size"`
+	ModTime     time.Time   `json:"modTime"`
+	Width       int         `json:"width"`
+	Height      int         `json:"height"`
+	// Extra holds the fingerprints of the other hashes when -algorithm combines several.
+	Extra []fingerprint `json:"extra,omitempty"`
+	// Color is "gray" or "color", found for -require-color-match; see colorMode.
+	Color string `json:"color,omitempty"`
+	// EXIF is the photo's camera model and time taken, read for -exif-confirm.
+	EXIF *exifInfo `json:"exif,omitempty"`
+	// Version is the hasher's version when the fingerprint is exported.
+	Version string `json:"version,omitempty"`
+	// Origin is which positional argument the file was found under, counting from 1.
+	// It is 0 for imported fingerprints.
+	Origin int `json:"-"`
+	// decodeTime and hashTime are how long the image took to decode and to run through the
+	// pipeline, for -timings. They are 0 if it wasn't decoded in this run.
+	decodeTime, hashTime time.Duration
+}
+
 // diffbits counts the number of bits that the two fingerprints differ by
 func (a fingerprint) diffbits(b fingerprint) int {
 	x := 0
@@ -38,15 +76,32 @@ func (a fingerprint) diffbits(b fingerprint) int {
 	return x
 }
 
+// sampleCoord maps coordinate x of a resampled axis of length n back onto the original axis of length size.
+// Rounding can land one past the end on small images, so it is clamped to stay inside.
+// x*size is computed in 64 bits, since it can overflow an int on 32-bit platforms for huge images.
+func sampleCoord(x, size, n int) int {
+	return min(int(math.Round(float64(int64(x)*int64(size))/float64(n))), size-1)
+}
+
 // resample resizes the image using nearest-neighbor so that additional colors are not introduced.
+// Paletted images, like most GIFs, stay paletted, with the same palette.
 func resample(im image.Image, cols, rows int) image.Image {
+	origin := im.Bounds().Min
 	w := im.Bounds().Size().X
 	h := im.Bounds().Size().Y
-	newim := image.NewRGBA(image.Rect(0, 0, cols, rows))
+	if p, ok := im.(*image.Paletted); ok {
+		newim := image.NewPaletted(image.Rect(0, 0, cols, rows), p.Palette)
+		for x := 0; x < cols; x++ {
+			for y := 0; y < rows; y++ {
+				newim.SetColorIndex(x, y, p.ColorIndexAt(origin.X+sampleCoord(x, w, cols), origin.Y+sampleCoord(y, h, rows)))
+			}
+		}
+		return newim
+	}
+	newim := newRGBA(image.Rect(0, 0, cols, rows))
 	for x := 0; x < cols; x++ {
 		for y := 0; y < rows; y++ {
-			c := im.At(int(math.Round(float64(x*w)/float64(cols))),
-				int(math.Round(float64(y*h)/float64(rows))))
+			c := im.At(origin.X+sampleCoord(x, w, cols), origin.Y+sampleCoord(y, h, rows))
 			newim.Set(x, y, c)
 		}
 	}
@@ -61,11 +116,10 @@ func resampleGray(im image.Image, cols, rows int) image.Image {
 	gray := im.(*image.Gray)
 	w := im.Bounds().Size().X
 	h := im.Bounds().Size().Y
-	newim := image.NewGray(image.Rect(0, 0, cols, rows))
+	newim := newGray(image.Rect(0, 0, cols, rows))
 	for x := 0; x < cols; x++ {
 		for y := 0; y < rows; y++ {
-			c := gray.GrayAt(int(math.Round(float64(x*w)/float64(cols))),
-				int(math.Round(float64(y*h)/float64(rows))))
+			c := gray.GrayAt(sampleCoord(x, w, cols), sampleCoord(y, h, rows))
 			newim.SetGray(x, y, c)
 		}
 	}
@@ -76,50 +130,94 @@ func resampleGray(im image.Image, cols, rows int) image.Image {
 func grayscale(im image.Image) image.Image {
 	w := im.Bounds().Size().X
 	h := im.Bounds().Size().Y
-	newim := image.NewGray(im.Bounds())
+	newim := newGray(im.Bounds())
+	if p, ok := im.(*image.Paletted); ok {
+		// Each color of the palette only needs converting once. Indexes past the end of the
+		// palette are black.
+		var grays [256]color.Gray
+		for i, c := range p.Palette[:min(len(p.Palette), len(grays))] {
+			grays[i] = grayOf(c)
+		}
+		for x := 0; x < w; x++ {
+			for y := 0; y < h; y++ {
+				newim.SetGray(x, y, grays[p.ColorIndexAt(x, y)])
+			}
+		}
+		return newim
+	}
 	for x := 0; x < w; x++ {
 		for y := 0; y < h; y++ {
-			c := im.At(x, y)
-			r, g, b, _ := c.RGBA()
-			gray := 0.2126*float64(r) + 0.7152*float64(g) + 0.0722*float64(b)
-			newim.SetGray(x, y, color.Gray{Y: uint8(math.Round(gray / 65535.0 * 255.0))})
+			newim.SetGray(x, y, grayOf(im.At(x, y)))
 		}
 	}
 	return newim
 }
 
-// blur blurs each pixel with its 49 nearest neighbors using a simplified algorhtm
-// that is mostly equivalent to gaussian blur with a high sigma.
-func blur(im image.Image) image.Image {
+// grayOf converts a color to gray by its luminance.
+func grayOf(c color.Color) color.Gray {
+	r, g, b, _ := c.RGBA()
+	gray := 0.2126*float64(r) + 0.7152*float64(g) + 0.0722*float64(b)
+	return color.Gray{Y: uint8(math.Round(gray / 65535.0 * 255.0))}
+}
+
+// blur blurs each pixel with the (2*radius+1)^2 pixels around it using a simplified algorhtm
+// that is mostly equivalent to gaussian blur with a high sigma. Pixels past the edges are left out
+// of the average. The sums come from a summed-area table, so the radius doesn't affect the speed.
+func blur(im image.Image, radius int) image.Image {
 	if im.ColorModel() != color.GrayModel {
-		panic("normalize only implemented for image.Gray")
+		panic("blur only implemented for image.Gray")
 	}
 	gray := im.(*image.Gray)
-	const radius = 3
 
 	w := im.Bounds().Size().X
 	h := im.Bounds().Size().Y
-	newim := image.NewGray(im.Bounds())
+	// sat[(y+1)*(w+1)+x+1] is the sum of the pixels above and to the left of (x, y), inclusive.
+	buf := newInts((w + 1) * (h + 1))
+	defer releaseInts(buf)
+	sat := *buf
+	for y := 0; y < h; y++ {
+		row := 0
+		for x := 0; x < w; x++ {
+			row += int(gray.GrayAt(x, y).Y)
+			sat[(y+1)*(w+1)+x+1] = sat[y*(w+1)+x+1] + row
+		}
+	}
+	newim := newGray(im.Bounds())
 	for x := 0; x < w; x++ {
+		x0, x1 := max(0, x-radius), min(w, x+radius+1)
 		for y := 0; y < h; y++ {
-			s := 0
-			cy := 0
-			for ai := -radius; ai <= radius; ai++ {
-				a := x + ai
-				if a < 0 || a >= w {
-					continue
-				}
-				for bi := -radius; bi <= radius; bi++ {
-					bb := y + bi
-					if bb < 0 || bb >= h {
-						continue
-					}
-					s++
-					y := gray.GrayAt(a, bb).Y
-					cy += int(y)
+			y0, y1 := max(0, y-radius), min(h, y+radius+1)
+			cy := sat[y1*(w+1)+x1] - sat[y0*(w+1)+x1] - sat[y1*(w+1)+x0] + sat[y0*(w+1)+x0]
+			s := (x1 - x0) * (y1 - y0)
+			newim.SetGray(x, y, color.Gray{Y: uint8(cy / s)})
+		}
+	}
+	return newim
+}
+
+// medianFilter replaces each pixel with the median of the 3x3 pixels around it, which removes
+// specks like JPEG block noise while keeping edges sharp. Pixels past the edges repeat the
+// nearest ones.
+func medianFilter(im image.Image) image.Image {
+	if im.ColorModel() != color.GrayModel {
+		panic("medianFilter only implemented for image.Gray")
+	}
+	gray := im.(*image.Gray)
+	w := im.Bounds().Size().X
+	h := im.Bounds().Size().Y
+	newim := newGray(im.Bounds())
+	var window [9]uint8
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			n := 0
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					window[n] = gray.GrayAt(min(max(x+dx, 0), w-1), min(max(y+dy, 0), h-1)).Y
+					n++
 				}
 			}
-			newim.SetGray(x, y, color.Gray{Y: uint8(cy / s)})
+			slices.Sort(window[:])
+			newim.SetGray(x, y, color.Gray{Y: window[4]})
 		}
 	}
 	return newim
@@ -133,7 +231,7 @@ func normalize(im image.Image) image.Image {
 	gray := im.(*image.Gray)
 	w := im.Bounds().Size().X
 	h := im.Bounds().Size().Y
-	newim := image.NewGray(im.Bounds())
+	newim := newGray(im.Bounds())
 	minVal := uint8(255)
 	maxVal := uint8(0)
 	for x := 0; x < w; x++ {
@@ -176,7 +274,7 @@ func equalize(im image.Image) image.Image {
 	gray := im.(*image.Gray)
 	w := im.Bounds().Size().X
 	h := im.Bounds().Size().Y
-	newim := image.NewGray(im.Bounds())
+	newim := newGray(im.Bounds())
 	cdf := make([]int, 256)
 	for x := 0; x < w; x++ {
 		for y := 0; y < h; y++ {
@@ -214,60 +312,440 @@ func equalize(im image.Image) image.Image {
 	return newim
 }
 
-// threshold does a basic 50/50 threshold to convert grayscale to monochrome.
-func threshold(im image.Image) image.Image {
+// posterize reduces the image to the given number of evenly spaced gray levels, so that small
+// differences in brightness, like noise in a scan, don't change which side of the median a pixel is on.
+func posterize(im image.Image, levels int) image.Image {
 	if im.ColorModel() != color.GrayModel {
-		panic("threshold only implemented for image.Gray")
+		panic("posterize only implemented for image.Gray")
 	}
 	gray := im.(*image.Gray)
 	w := im.Bounds().Size().X
 	h := im.Bounds().Size().Y
-	newim := image.NewGray(im.Bounds())
+	newim := newGray(im.Bounds())
 	for x := 0; x < w; x++ {
 		for y := 0; y < h; y++ {
-			c := gray.GrayAt(x, y).Y
-			if c < 128 {
-				newim.SetGray(x, y, color.Gray{Y: 0})
-			} else {
-				newim.SetGray(x, y, color.Gray{Y: 255})
+			level := int(gray.GrayAt(x, y).Y) * levels / 256
+			newim.SetGray(x, y, color.Gray{Y: uint8(level * 255 / (levels - 1))})
+		}
+	}
+	return newim
+}
+
+// clahe is a contrast-limited, adaptive version of equalize. The image is split into tiles×tiles
+// regions that are equalized separately, with each histogram bin clipped to clip times the average
+// bin height so that noise in flat regions isn't amplified. Each pixel is mapped by interpolating
+// between the four nearest tiles so there are no seams between them.
+func clahe(im image.Image, clip float64, tiles int) image.Image {
+	if im.ColorModel() != color.GrayModel {
+		panic("clahe only implemented for image.Gray")
+	}
+	gray := im.(*image.Gray)
+	w := im.Bounds().Size().X
+	h := im.Bounds().Size().Y
+	tiles = max(1, min(tiles, w, h))
 
+	maps := make([][256]uint8, tiles*tiles)
+	for ty := 0; ty < tiles; ty++ {
+		for tx := 0; tx < tiles; tx++ {
+			x0, x1 := tx*w/tiles, (tx+1)*w/tiles
+			y0, y1 := ty*h/tiles, (ty+1)*h/tiles
+			hist := [256]int{}
+			for x := x0; x < x1; x++ {
+				for y := y0; y < y1; y++ {
+					hist[gray.GrayAt(x, y).Y]++
+				}
+			}
+			n := (x1 - x0) * (y1 - y0)
+			limit := max(1, int(clip*float64(n)/256.0))
+			excess := 0
+			for i := range hist {
+				if hist[i] > limit {
+					excess += hist[i] - limit
+					hist[i] = limit
+				}
+			}
+			for i := range hist {
+				hist[i] += excess / 256
+				if i < excess%256 {
+					hist[i]++
+				}
+			}
+			cdf := 0
+			for i := range hist {
+				cdf += hist[i]
+				maps[ty*tiles+tx][i] = uint8(math.Round(float64(cdf) / float64(n) * 255.0))
 			}
 		}
 	}
+
+	// tileCoord finds the two tiles whose centers surround p, and how far p is from the first.
+	tileCoord := func(p, size int) (int, int, float64) {
+		g := (float64(p)+0.5)/(float64(size)/float64(tiles)) - 0.5
+		i0 := max(0, min(int(math.Floor(g)), tiles-1))
+		i1 := min(i0+1, tiles-1)
+		return i0, i1, math.Max(0.0, math.Min(1.0, g-float64(i0)))
+	}
+	newim := newGray(im.Bounds())
+	for x := 0; x < w; x++ {
+		tx0, tx1, ax := tileCoord(x, w)
+		for y := 0; y < h; y++ {
+			ty0, ty1, ay := tileCoord(y, h)
+			c := gray.GrayAt(x, y).Y
+			top := (1-ax)*float64(maps[ty0*tiles+tx0][c]) + ax*float64(maps[ty0*tiles+tx1][c])
+			bottom := (1-ax)*float64(maps[ty1*tiles+tx0][c]) + ax*float64(maps[ty1*tiles+tx1][c])
+			newim.SetGray(x, y, color.Gray{Y: uint8(math.Round((1-ay)*top + ay*bottom))})
+		}
+	}
 	return newim
 }
 
-// fingerprintImage computes a 256-bit monochrome reduction of an image
-func fingerprintImage(name string) (fingerprint, error) {
+// solidVariance is the largest variance of gray levels that is considered a solid color.
+const solidVariance = 16.0
+
+// isSolid reports whether a grayscale image is nearly uniform, like a blank placeholder.
+func isSolid(im image.Image) bool {
+	if im.ColorModel() != color.GrayModel {
+		panic("isSolid only implemented for image.Gray")
+	}
+	gray := im.(*image.Gray)
+	w := im.Bounds().Size().X
+	h := im.Bounds().Size().Y
+	sum := 0.0
+	sumSq := 0.0
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			c := float64(gray.GrayAt(x, y).Y)
+			sum += c
+			sumSq += c * c
+		}
+	}
+	n := float64(w * h)
+	mean := sum / n
+	return sumSq/n-mean*mean < solidVariance
+}
+
+// median returns the median value of the pixels of a grayscale image.
+func median(im image.Image) float64 {
+	if im.ColorModel() != color.GrayModel {
+		panic("median only implemented for image.Gray")
+	}
+	gray := im.(*image.Gray)
+	w := im.Bounds().Size().X
+	h := im.Bounds().Size().Y
+	values := make([]uint8, 0, w*h)
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			values = append(values, gray.GrayAt(x, y).Y)
+		}
+	}
+	slices.Sort(values)
+	n := len(values)
+	if n%2 == 1 {
+		return float64(values[n/2])
+	}
+	return (float64(values[n/2-1]) + float64(values[n/2])) / 2.0
+}
+
+// hasher holds the settings of the fingerprinting pipeline.
+type hasher struct {
+	// intermediateSize is the width and height images are first resampled to, to be blurred and
+	// equalized before being reduced to hashSize.
+	intermediateSize int
+	blurRadius       int
+	// readWholeFile reads each file into memory before decoding it, instead of streaming it.
+	readWholeFile bool
+	// skipSolid rejects images that are nearly a single color with errSolidImage.
+	skipSolid bool
+	// posterize, if from 2 to 255, reduces the equalized image to that many gray levels.
+	posterize int
+	// detectColor finds whether each image is in color, for imageInfo.Color.
+	detectColor bool
+	// denoise runs medianFilter on the intermediate image before blurring it.
+	denoise bool
+	// multiscale also reduces each image at half of intermediateSize, and hashes that size instead
+	// if its medianMargin is larger by multiscaleMargin.
+	multiscale bool
+	// claheClip, if positive, replaces equalize with clahe using claheTiles tiles per side.
+	claheClip  float64
+	claheTiles int
+	// ioRetries is how many times to retry reading a file after a transient error.
+	ioRetries int
+	// cropRegion, if set, hashes only that part of the image, before centerCrop.
+	cropRegion *region
+	// centerCrop hashes only the largest square in the center of the image.
+	centerCrop bool
+	// decodeTimeout, if positive, limits how long decoding a single image may take.
+	decodeTimeout time.Duration
+	// maxDecodeBytes, if positive, skips images that would take more memory than this to decode.
+	maxDecodeBytes int64
+	// preprocessors are run on each image after it is decoded. Their names are part of version.
+	preprocessors     []preprocessor
+	preprocessorNames []string
+	// strictDecode rejects truncated images instead of hashing the part that can be decoded.
+	strictDecode bool
+	// hashes are the algorithms each image is fingerprinted with, named by algorithms; the
+	// default is just medianHash. Their names are part of version.
+	hashes         []hashFunc
+	algorithmNames []string
+}
+
+// retryDelay is how long to wait before retrying after a transient error. It doubles with each retry.
+const retryDelay = 100 * time.Millisecond
+
+// isTransient reports whether an error reading a file might go away if tried again,
+// as happens with network filesystems.
+func isTransient(err error) bool {
+	var timeout interface{ Timeout() bool }
+	if errors.As(err, &timeout) && timeout.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.ETIMEDOUT)
+}
+
+// fingerprintVersion must be increased whenever a change to the pipeline changes fingerprints.
+const fingerprintVersion = 2
+
+// version identifies the pipeline and the settings that affect its fingerprints. Fingerprints
+// with different versions can't be compared.
+func (h *hasher) version() string {
+	v := fmt.Sprintf("%d;size=%d;blur=%d", fingerprintVersion, h.intermediateSize, h.blurRadius)
+	if h.claheClip > 0 {
+		v += fmt.Sprintf(";clahe=%g/%d", h.claheClip, h.claheTiles)
+	}
+	if h.cropRegion != nil {
+		v += ";crop-region=" + h.cropRegion.String()
+	}
+	if h.centerCrop {
+		v += ";center-crop"
+	}
+	if h.denoise {
+		v += ";denoise"
+	}
+	if h.multiscale {
+		v += fmt.Sprintf(";multiscale=%g", multiscaleMargin)
+	}
+	if h.posterize > 0 {
+		v += fmt.Sprintf(";posterize=%d", h.posterize)
+	}
+	if len(h.algorithmNames) > 0 {
+		v += ";algorithm=" + strings.Join(h.algorithmNames, "+")
+	}
+	for _, name := range h.preprocessorNames {
+		v += ";" + name
+	}
+	return v
+}
+
+// fingerprintImage computes 256-bit monochrome reductions of an image file, one for each of h.hashes,
+// and returns them with its dimensions, leaving the rest of the imageInfo for the caller to fill in.
+// Transient errors are retried up to h.ioRetries times.
+func (h *hasher) fingerprintImage(name string) (imageInfo, error) {
+	return h.retry(func() (imageInfo, error) { return h.fingerprintFile(name) })
+}
+
+// retry calls fingerprint until it succeeds, fails with an error that isn't transient, or
+// has been retried h.ioRetries times, waiting longer before each retry.
+func (h *hasher) retry(fingerprint func() (imageInfo, error)) (imageInfo, error) {
+	delay := retryDelay
+	for attempt := 0; ; attempt++ {
+		im, err := fingerprint()
+		if err == nil || attempt >= h.ioRetries || !isTransient(err) {
+			return im, err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// fingerprintFile makes one attempt at fingerprintImage.
+func (h *hasher) fingerprintFile(name string) (imageInfo, error) {
+	if h.readWholeFile {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return imageInfo{}, fmt.Errorf("%w: %w", errIO, err)
+		}
+		return h.fingerprintReader(bytes.NewReader(data))
+	}
 	imf, err := os.Open(name)
 	if err != nil {
-		return zeroFingerprint, err
+		return imageInfo{}, fmt.Errorf("%w: %w", errIO, err)
 	}
 	defer imf.Close()
-	im, _, err := image.Decode(imf)
+	return h.fingerprintReader(imf)
+}
+
+// fingerprintReader is fingerprintImage for an encoded image.
+// Errors decoding it are errNotImage or wrap errUnsupportedFormat, errDecode, or errIO.
+func (h *hasher) fingerprintReader(r io.Reader) (imageInfo, error) {
+	start := time.Now()
+	im, err := h.decode(r)
+	err = decodeError(err)
+	if err != nil && !errors.Is(err, errPartialImage) {
+		return imageInfo{}, err
+	}
+	decoded := time.Now()
+	fs, ferr := h.fingerprintDecoded(im)
+	if ferr != nil {
+		return imageInfo{}, ferr
+	}
+	info := imageInfo{
+		Fingerprint: fs[0],
+		Extra:       fs[1:],
+		Width:       im.Bounds().Dx(),
+		Height:      im.Bounds().Dy(),
+		decodeTime:  decoded.Sub(start),
+		hashTime:    time.Since(decoded),
+	}
+	if h.detectColor {
+		info.Color = colorMode(im)
+	}
+	return info, err
+}
+
+// fingerprintDecoded computes 256-bit monochrome reductions of an image, one for each of h.hashes.
+// It is the whole pipeline after decoding, so an image built in memory gets the same fingerprints
+// as the file it would be saved to.
+func (h *hasher) fingerprintDecoded(im image.Image) ([]fingerprint, error) {
+	return h.fingerprintStages(im, nil)
+}
+
+// fingerprintStages is fingerprintDecoded, calling dump, if it is set, with the name of each step
+// of reducing the image and the image after it, for -dump-intermediates.
+func (h *hasher) fingerprintStages(im image.Image, dump func(stage string, im image.Image)) ([]fingerprint, error) {
+	for _, p := range h.preprocessors {
+		im = p(im)
+	}
+	if h.cropRegion != nil {
+		im = cropImage(im, h.cropRegion.rect(im.Bounds().Size()))
+	}
+	if h.centerCrop {
+		im = cropImage(im, centerSquare(im.Bounds().Size()))
+	}
+	reduced, err := h.reduce(im, h.intermediateSize, h.blurRadius, dump)
 	if err != nil {
-		return zeroFingerprint, err
+		return nil, err
+	}
+	// Half the size, with the blur scaled to match, sees the same image; whichever is further
+	// from its median hash's cutoff is less likely to flip bits in a copy. It has to be clearly
+	// further, or a copy could be hashed at the other size.
+	if small := max(hashSize, h.intermediateSize/2); h.multiscale && small < h.intermediateSize {
+		alt, err := h.reduce(im, small, h.blurRadius*small/h.intermediateSize, nil)
+		if err != nil {
+			return nil, err
+		}
+		if medianMargin(alt) > multiscaleMargin*medianMargin(reduced) {
+			reduced, alt = alt, reduced
+		}
+		release(alt)
+	}
+	defer release(reduced)
+	if len(h.hashes) == 0 {
+		return []fingerprint{medianHash(reduced)}, nil
 	}
-	im = resample(im, 160, 160)
-	im = grayscale(im)
-	im = blur(im)
-	im = normalize(im)
-	im = equalize(im)
-	im = resampleGray(im, 16, 16)
-	im = threshold(im)
+	fs := make([]fingerprint, len(h.hashes))
+	for i, hash := range h.hashes {
+		fs[i] = hash(reduced)
+	}
+	return fs, nil
+}
 
-	gray := im.(*image.Gray)
-	data := [32]byte{}
-	for y := 0; y < 16; y++ {
-		for i := 0; i < 2; i++ {
-			for j := 0; j < 8; j++ {
-				if gray.GrayAt(i*8+j, y).Y < 128 {
-					data[y*2+i] |= 1 << (7 - j)
+// reduce resamples an image to size×size and turns it into the equalized grayscale image that
+// the hashes are computed from, blurred by blurRadius. dump, if set, is called after each step.
+func (h *hasher) reduce(im image.Image, size, blurRadius int, dump func(stage string, im image.Image)) (image.Image, error) {
+	step := func(stage string) {
+		if dump != nil {
+			dump(stage, im)
+		}
+	}
+	// apply runs one step on the image made by the step before, which isn't needed after it.
+	apply := func(stage string, f func(image.Image) image.Image) {
+		next := f(im)
+		release(im)
+		im = next
+		step(stage)
+	}
+	im = resample(im, size, size)
+	step("resampled")
+	apply("grayscale", grayscale)
+	if h.skipSolid && isSolid(im) {
+		release(im)
+		return nil, errSolidImage
+	}
+	if h.denoise {
+		apply("denoised", medianFilter)
+	}
+	if blurRadius > 0 {
+		apply("blurred", func(im image.Image) image.Image { return blur(im, blurRadius) })
+	}
+	apply("normalized", normalize)
+	if h.claheClip > 0 {
+		apply("equalized", func(im image.Image) image.Image { return clahe(im, h.claheClip, h.claheTiles) })
+	} else {
+		apply("equalized", equalize)
+	}
+	if h.posterize > 0 {
+		apply("posterized", func(im image.Image) image.Image { return posterize(im, h.posterize) })
+	}
+	return im, nil
+}
+
+// hasExtension reports whether the last extension of path is one of extensions.
+// Only the final extension is considered, so "photo.jpg.bak" has the extension "bak".
+func hasExtension(path string, extensions []string, caseSensitive bool) bool {
+	ext := strings.TrimPrefix(filepath.Ext(path), ".")
+	if !caseSensitive {
+		ext = strings.ToLower(ext)
+	}
+	return slices.Contains(extensions, ext)
+}
+
+// isHidden reports whether a file or directory name is hidden, by the Unix convention of starting with a dot.
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".") && name != "." && name != ".."
+}
+
+// splitGroup splits a group of images, given by their indexes, into groups in which every pair
+// is near. Each image joins the first group it is near all of, in order. Images that end up
+// on their own are left out.
+func splitGroup(indexes []int, near func(i, j int) bool) [][]int {
+	var groups [][]int
+	for _, i := range indexes {
+		joined := false
+		for g := range groups {
+			fits := true
+			for _, j := range groups[g] {
+				if !near(j, i) {
+					fits = false
+					break
 				}
 			}
+			if fits {
+				groups[g] = append(groups[g], i)
+				joined = true
+				break
+			}
+		}
+		if !joined {
+			groups = append(groups, []int{i})
 		}
 	}
-	return data, nil
+	return slices.DeleteFunc(groups, func(g []int) bool { return len(g) < 2 })
+}
+
+// matchPairs returns each pair of directly matching images in m once, ordered by their indexes,
+// for when matches shouldn't be grouped transitively.
+func matchPairs(m map[int][]int, n int) [][]int {
+	var pairs [][]int
+	for i := 0; i < n; i++ {
+		js := slices.Clone(m[i])
+		slices.Sort(js)
+		for _, j := range js {
+			if j > i {
+				pairs = append(pairs, []int{i, j})
+			}
+		}
+	}
+	return pairs
 }
 
 // findEquiv finds things in m that are equivalent to x. It is not very efficient.
@@ -296,84 +774,1041 @@ func findEquiv(m map[int][]int, x int) []int {
 	return keys
 }
 
-func main() {
-	flag.Parse()
-	args := flag.Args()
+// distanceFunc measures how different two fingerprints are; smaller is more similar.
+type distanceFunc func(a, b fingerprint) int
 
-	if len(args) == 0 {
-		return
+// hamming is the default distance: the number of bits that differ.
+func hamming(a, b fingerprint) int {
+	return a.diffbits(b)
+}
+
+// maskedHamming is like hamming, but never counts the bits that are set in mask.
+func maskedHamming(mask fingerprint) distanceFunc {
+	return func(a, b fingerprint) int {
+		x := 0
+		for i := range a {
+			x += bits.OnesCount8((a[i] ^ b[i]) &^ mask[i])
+		}
+		return x
 	}
+}
 
-	verbose := *verboseFlag
+// matcher decides which images are similar enough to be reported together.
+type matcher struct {
+	distance      distanceFunc
+	thresholdBits int
+	// mask, if set, holds the -hash-mask bits that distance doesn't count.
+	mask *fingerprint
+	// unit is how distances are printed.
+	unit distanceUnit
+	// adaptive scales the threshold down for small images; see thresholdFor.
+	adaptive bool
+	// exifConfirm only matches photos whose EXIF data agrees; see exifAgree.
+	exifConfirm bool
+	exifWindow  time.Duration
+	// requireColorMatch doesn't match color images with gray ones; see colorsAgree.
+	requireColorMatch bool
+	// quadrants also requires each quarter of the first fingerprints to differ by less than half
+	// the threshold; see quadrantsAgree.
+	quadrants bool
+	// invariant also considers b rotated and mirrored, using whichever is closest.
+	// It only applies to the first fingerprint of each image.
+	invariant bool
+	// groupByPrefix only compares files whose names share a prefix; see filePrefix.
+	groupByPrefix bool
+	// sameExt only compares files with the same extension, ignoring case.
+	sameExt bool
+	// byResolution only compares images whose resolutionLevels are at most one apart.
+	byResolution bool
+	// recrop, if set, rehashes pairs within twice the threshold at a few crops to
+	// catch slightly cropped copies. The crops of each file are kept in crops.
+	recrop *hasher
+	crops  map[string][]fingerprint
+	// known, if set, holds the paths of images that an earlier run already compared with each
+	// other; findMatches doesn't compare them again.
+	known map[string]bool
+	// stats, if set, counts the distance of every pair findMatches compares, for -stats.
+	stats *distanceStats
+}
 
-	extensions := strings.Split(*extensionsFlag, ",")
-	for i := 0; i < len(extensions); i++ {
-		extensions[i] = strings.ToLower(strings.TrimSpace(extensions[i]))
+// compare returns the distance between a and b, and the transform of a that b is closest to.
+func (m *matcher) compare(a, b *imageInfo) (int, transform) {
+	best, bestT := m.distance(a.Fingerprint, b.Fingerprint), identity
+	if m.invariant {
+		for t := rotate90; t <= mirrorRotate270; t++ {
+			if d := m.distance(a.Fingerprint.transform(t), b.Fingerprint); d < best {
+				best, bestT = d, t
+			}
+		}
 	}
-	if verbose {
-		fmt.Printf("Scanning for exentions: %s\n", strings.Join(extensions, " "))
+	return best, bestT
+}
+
+// adaptiveFullSide is the side of the smallest square image that gets the full threshold with -adaptive-threshold.
+const adaptiveFullSide = 512
+
+// thresholdFor returns the threshold for comparing a and b. If m.adaptive is set, it scales with
+// the square root of the smaller image's area, so that an icon has to match almost exactly while
+// photos of adaptiveFullSide or more pixels square get the full threshold. Images of unknown size,
+// like -ignore-fingerprints, get the full threshold.
+func (m *matcher) thresholdFor(a, b *imageInfo) int {
+	area := min(a.Width*a.Height, b.Width*b.Height)
+	if !m.adaptive || area == 0 {
+		return m.thresholdBits
 	}
+	scale := min(1, math.Sqrt(float64(area))/adaptiveFullSide)
+	return max(1, int(math.Round(float64(m.thresholdBits)*scale)))
+}
 
-	var fingerprints []fingerprint
-	var fingerprintPaths []string
+// similar reports the distance between a and b and whether it is within the threshold.
+// When images have more than one fingerprint, every one of them must be within the threshold.
+func (m *matcher) similar(a, b *imageInfo) (int, bool) {
+	threshold := m.thresholdFor(a, b)
+	d, t := m.compare(a, b)
+	if d >= threshold && m.recrop != nil && d < 2*threshold {
+		for _, f := range m.cropsOf(a) {
+			d = min(d, m.distance(f, b.Fingerprint))
+		}
+		for _, f := range m.cropsOf(b) {
+			d = min(d, m.distance(a.Fingerprint, f))
+		}
+	}
+	if d >= threshold {
+		return d, false
+	}
+	for i := 0; i < len(a.Extra) && i < len(b.Extra); i++ {
+		if m.distance(a.Extra[i], b.Extra[i]) >= threshold {
+			return d, false
+		}
+	}
+	if m.quadrants && !m.quadrantsAgree(a.Fingerprint.transform(t), b.Fingerprint, threshold) {
+		return d, false
+	}
+	if m.exifConfirm && !exifAgree(a.EXIF, b.EXIF, m.exifWindow) {
+		return d, false
+	}
+	if m.requireColorMatch && !colorsAgree(a, b) {
+		return d, false
+	}
+	return d, true
+}
 
-	for _, arg := range args {
-		if verbose {
-			fmt.Printf("Scanning %s\n", arg)
+// quadrantsAgree reports whether each 8x8 quarter of a and b differs by less than half of
+// threshold, so that a pair that differs sharply in one region doesn't match just because the
+// rest of it is close.
+func (m *matcher) quadrantsAgree(a, b fingerprint, threshold int) bool {
+	limit := max(1, (threshold+1)/2)
+	for q := 0; q < 4; q++ {
+		if m.distance(a.quadrant(q), b.quadrant(q)) >= limit {
+			return false
 		}
+	}
+	return true
+}
+
+// cropsOf returns the fingerprints of slight crops of the image, computing them the first time.
+func (m *matcher) cropsOf(im *imageInfo) []fingerprint {
+	if crops, ok := m.crops[im.Path]; ok {
+		return crops
+	}
+	crops, err := m.recrop.cropVariants(im.Path)
+	if err != nil {
+		crops = nil
+	}
+	if m.crops == nil {
+		m.crops = map[string][]fingerprint{}
+	}
+	m.crops[im.Path] = crops
+	return crops
+}
 
-		_ = filepath.Walk(arg, func(path string, info fs.FileInfo, err error) error {
-			if info.IsDir() {
+// findMatches compares every pair of images in the same bucket and returns, for each image,
+// the images similar to it. If ctx is done, it stops and returns the matches found so far.
+func (m *matcher) findMatches(ctx context.Context, images []imageInfo) map[int][]int {
+	matches := map[int][]int{}
+	_ = m.eachMatch(ctx, images, func(i, j int) error {
+		matches[i] = append(matches[i], j)
+		matches[j] = append(matches[j], i)
+		return nil
+	})
+	return matches
+}
+
+// eachMatch compares every pair of images in the same bucket and calls f with each pair that is
+// similar, stopping at the first error. If ctx is done, it stops without an error.
+func (m *matcher) eachMatch(ctx context.Context, images []imageInfo, f func(i, j int) error) error {
+	for _, bucket := range m.buckets(images) {
+		if m.byResolution {
+			// Sorted by level, each image only needs comparing with those after it up to the
+			// next level. Images of unknown size sort first and are compared with all of them.
+			slices.SortStableFunc(bucket, func(i, j int) int {
+				return resolutionLevel(&images[i]) - resolutionLevel(&images[j])
+			})
+		}
+		for bi, i := range bucket {
+			if ctx.Err() != nil {
 				return nil
 			}
-			ext := strings.TrimPrefix(filepath.Ext(strings.ToLower(path)), ".")
-			if slices.Contains(extensions, ext) {
-				f, err := fingerprintImage(path)
-				if err != nil {
-					if err != nil {
-						_, _ = fmt.Fprintf(os.Stderr, "Error decoding image %s; ignoring. %v\n", path, err)
+			level := resolutionLevel(&images[i])
+			for _, j := range bucket[bi+1:] {
+				if m.byResolution && level >= 0 && resolutionLevel(&images[j]) > level+1 {
+					break
+				}
+				if m.known[images[i].Path] && m.known[images[j].Path] {
+					continue
+				}
+				d, ok := m.similar(&images[i], &images[j])
+				if m.stats != nil {
+					m.stats.add(d)
+				}
+				if ok {
+					if err := f(i, j); err != nil {
+						return err
 					}
 				}
-				fingerprints = append(fingerprints, f)
-				fingerprintPaths = append(fingerprintPaths, path)
 			}
-			return nil
-		})
+		}
+	}
+	return nil
+}
+
+// resolutionLevel is the number of bits in the longer side of an image, so that each level is
+// twice the size of the one before, or -1 if its size isn't known.
+func resolutionLevel(im *imageInfo) int {
+	side := max(im.Width, im.Height)
+	if side <= 0 {
+		return -1
+	}
+	return bits.Len(uint(side))
+}
+
+// bucketKey returns which bucket an image is in; only images in the same bucket can match.
+func (m *matcher) bucketKey(im *imageInfo) string {
+	key := ""
+	if m.groupByPrefix {
+		key = filePrefix(im.Path)
+	}
+	if m.sameExt {
+		key += "\x00" + strings.ToLower(filepath.Ext(im.Path))
+	}
+	return key
+}
+
+// buckets splits the indexes of images into buckets by bucketKey, in the order they are first seen.
+func (m *matcher) buckets(images []imageInfo) [][]int {
+	index := map[string]int{}
+	var buckets [][]int
+	for i := range images {
+		key := m.bucketKey(&images[i])
+		b, ok := index[key]
+		if !ok {
+			b = len(buckets)
+			index[key] = b
+			buckets = append(buckets, nil)
+		}
+		buckets[b] = append(buckets[b], i)
+	}
+	return buckets
+}
+
+// filePrefix returns the path of a file without its extension and any number at the end of its name,
+// so that numbered files like "clip-0001.jpg" and "clip-0002.jpg" share the prefix "clip".
+func filePrefix(path string) string {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	name = strings.TrimRight(name, "0123456789")
+	name = strings.TrimRight(name, "_-. ")
+	return filepath.Join(filepath.Dir(path), name)
+}
+
+// withoutIgnored returns the images that aren't within the threshold of any of the ignored fingerprints.
+func (m *matcher) withoutIgnored(images []imageInfo, ignore []fingerprint) []imageInfo {
+	var kept []imageInfo
+	for i := range images {
+		ignored := false
+		for _, f := range ignore {
+			if _, ok := m.similar(&images[i], &imageInfo{Fingerprint: f}); ok {
+				ignored = true
+				break
+			}
+		}
+		if !ignored {
+			kept = append(kept, images[i])
+		}
+	}
+	return kept
+}
+
+// neighbor is another image and its distance from the image being examined.
+type neighbor struct {
+	index    int
+	distance int
+}
+
+// nearest finds the n images closest to images[i], excluding i itself.
+// Ties are broken by index so the output is stable.
+func (m *matcher) nearest(images []imageInfo, i, n int) []neighbor {
+	var neighbors []neighbor
+	key := m.bucketKey(&images[i])
+	for j := 0; j < len(images); j++ {
+		if j == i || m.bucketKey(&images[j]) != key {
+			continue
+		}
+		d, _ := m.compare(&images[i], &images[j])
+		neighbors = append(neighbors, neighbor{index: j, distance: d})
+	}
+	slices.SortFunc(neighbors, func(a, b neighbor) int {
+		if a.distance != b.distance {
+			return a.distance - b.distance
+		}
+		return a.index - b.index
+	})
+	if len(neighbors) > n {
+		neighbors = neighbors[:n]
+	}
+	return neighbors
+}
+
+// matchesOf finds the images similar to q, closest first, leaving out q's own path.
+func (m *matcher) matchesOf(images []imageInfo, q *imageInfo) []neighbor {
+	var matches []neighbor
+	for j := range images {
+		if images[j].Path == q.Path {
+			continue
+		}
+		if d, ok := m.similar(q, &images[j]); ok {
+			matches = append(matches, neighbor{index: j, distance: d})
+		}
+	}
+	slices.SortStableFunc(matches, func(a, b neighbor) int {
+		return a.distance - b.distance
+	})
+	return matches
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs the program with the given command-line arguments, not including the program name,
+// and returns its exit status.
+func run(args []string, stdout, stderr io.Writer) int {
+	return runWithStdin(args, os.Stdin, stdout, stderr)
+}
+
+// runWithStdin is run with -tui reading its answers from stdin instead of os.Stdin, for tests.
+// Nothing else reads stdin.
+func runWithStdin(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("findimagedupes", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var (
+		thresholdFlag          = flags.Float64("threshold", 10.0, "percentage of bits that may differ between matching images; 0 only matches identical fingerprints")
+		adaptiveThresholdFlag  = flags.Bool("adaptive-threshold", false, "lower the threshold for small images, down to an exact match for icons, reaching -threshold at 512x512")
+		verboseFlag            = flags.Bool("verbose", false, "verbose")
+		quietFlag              = flags.Bool("quiet", false, "don't tell stderr when no duplicate groups are found")
+		extensionsFlag         = flags.String("extensions", strings.Join(defaultExtensions, ","), "file extensions to consider, comma-separated")
+		nearestFlag            = flags.Int("nearest", 0, "instead of grouping, print the N most similar images for each image")
+		queryFlag              = flags.String("query", "", "instead of grouping, print the images that match this one, such as from -import-fingerprints, closest first")
+		caseSensitiveExtFlag   = flags.Bool("case-sensitive-ext", false, "match file extensions exactly instead of ignoring case")
+		sniffExtensionlessFlag = flags.Bool("sniff-extensionless", false, "also fingerprint files with no extension whose contents are an image")
+		archivesFlag           = flags.Bool("archives", false, "also look for images inside tar archives (.tar, .tar.gz, and .tgz), reported as archive.tar!name.jpg")
+		includeHiddenFlag      = flags.Bool("include-hidden", false, "also scan files and directories whose names start with a dot")
+		intermediateSizeFlag   = flags.Int("intermediate-size", 160, "size images are resampled to before blurring; changing it changes fingerprints")
+		blurRadiusFlag         = flags.Int("blur-radius", 3, "radius of the box blur applied before hashing; 0 disables blur")
+		exportFlag             = flags.String("export-fingerprints", "", "write the computed fingerprints to this file as JSON lines")
+		datasetFlag            = flags.String("dataset", "", "write the label (parent directory name), path, and fingerprint of each image to this file as tab-separated values, and don't match")
+		printEncodingFlag      = flags.String("print-encoding", "hex", "how to encode fingerprints written by -export-fingerprints and -dataset: hex or base64")
+		errorsFlag             = flags.String("errors", "text", "how to report files that can't be read to stderr: text, or json for one JSON object per file")
+		sinceIndexFlag         = flags.String("since-index", "", "only fingerprint files that aren't in this -export-fingerprints index, report only groups with one of them in, and add them to the index")
+		checkpointFlag         = flags.String("checkpoint", "", "save fingerprints to this file as they are computed, and reuse them if an interrupted scan is run again")
+		importFlag             = flags.String("import-fingerprints", "", "read previously exported fingerprints from this file and match them too")
+		readWholeFileFlag      = flags.Bool("read-whole-file", false, "read each file into memory before decoding; faster for many small images")
+		skipSolidFlag          = flags.Bool("skip-solid", false, "skip images that are nearly a single solid color")
+		posterizeFlag          = flags.Int("posterize", 256, "reduce images to this many gray levels, from 2 to 256, after equalizing them; fewer can make noisy scans match more reliably")
+		denoiseFlag            = flags.Bool("denoise", false, "median-filter each image before hashing it, so noise from recompressing JPEGs doesn't push pairs apart (slower)")
+		multiscaleFlag         = flags.Bool("multiscale", false, "also reduce each image at half of -intermediate-size, and hash whichever size is further from the cutoff between set and unset bits, so fewer bits flip between copies (slower)")
+		claheClipFlag          = flags.Float64("clahe-clip", 0, "if positive, use contrast-limited adaptive equalization with this clip limit (e.g. 2)")
+		claheTilesFlag         = flags.Int("clahe-tiles", 8, "number of tiles per side for -clahe-clip")
+		flattenAlphaFlag       = flags.Bool("flatten-alpha", false, "draw transparent images over white before hashing them")
+		trimBordersFlag        = flags.Bool("trim-borders", false, "crop off borders of a solid color, such as letterboxing, before hashing")
+		cropRegionFlag         = flags.String("crop-region", "", "hash only this part of each image, given as x,y,w,h fractions of its size, such as 0,0.05,1,0.95 to leave out a phone's status bar")
+		centerCropFlag         = flags.Bool("center-crop", false, "hash only the largest square in the center of each image, to match different aspect ratios")
+		groupByPrefixFlag      = flags.Bool("group-by-prefix", false, "only compare files whose names are the same apart from a trailing number, like video keyframes")
+		sameExtOnlyFlag        = flags.Bool("same-ext-only", false, "only compare files with the same extension, ignoring case, so a JPEG never matches a PNG")
+		bucketByResolutionFlag = flags.Bool("bucket-by-resolution", false, "only compare images whose longer sides are in the same or a neighboring power of two, such as 1024-2047 and 2048-4095 pixels; faster, but misses thumbnails of much larger images")
+		cropTolerantFlag       = flags.Bool("crop-tolerant", false, "rehash pairs that almost match at a few small crops, to match slightly cropped copies (slow)")
+		maxDurationFlag        = flags.Duration("max-duration", 0, "stop scanning and matching after this long, e.g. 1h, and print the groups found so far, marked partial in JSON and -summary-json")
+		decodeTimeoutFlag      = flags.Duration("decode-timeout", 0, "skip images that take longer than this to decode, e.g. 10s; 0 means no limit")
+		maxDecodeBytesFlag     = flags.Int64("max-decode-bytes", 0, "if positive, skip images whose headers say they would take more than this much memory to decode, at 4 bytes a pixel")
+		strictDecodeFlag       = flags.Bool("strict-decode", true, "skip truncated images; with -strict-decode=false, truncated JPEGs are hashed from the part that is there")
+		ioRetriesFlag          = flags.Int("io-retries", 0, "retry reading a file this many times after a transient error, such as on a network share")
+		timeoutFlag            = flags.Duration("timeout", 30*time.Second, "give up fetching an image from a URL after this long")
+		jobsFlag               = flags.Int("jobs", runtime.NumCPU(), "how many directories to read and images to fingerprint at once")
+		workersPerDiskFlag     = flags.String("workers-per-disk", "", "comma-separated -jobs for each argument in turn, such as 8,1 for a directory on an SSD and one on a hard disk; all arguments are scanned at once")
+		urlJobsFlag            = flags.Int("url-jobs", 4, "how many URLs to fetch at once")
+		ignoreFingerprintsFlag = flags.String("ignore-fingerprints", "", "file of hex fingerprints, one per line, of images to leave out, like placeholder images")
+		watchFlag              = flags.String("watch", "", "keep watching this directory, and report new images in it that duplicate ones in it or in the arguments")
+		serveFlag              = flags.String("serve", "", "instead of grouping, answer queries on this address, like :8080: POST an image, or nothing with ?fingerprint=, to /match for the images that match it as JSON")
+		remoteIndexFlag        = flags.String("remote-index", "", "instead of grouping, ask the -serve server at this URL, like http://host:8080, for the images in its index that match each image")
+		tuiFlag                = flags.Bool("tui", false, "step through the groups interactively, choosing which file of each to keep, then delete the rest")
+		dedupeReportFlag       = flags.String("dedupe-report", "", "instead of scanning, compare this earlier -format json or jsonl report with the one given as the argument, and print what changed")
+		explainFlag            = flags.Bool("explain", false, "instead of scanning, take two images as the arguments and print their fingerprints, the distance between them, and which bits differ")
+		verifyFlag             = flags.String("verify", "", "instead of scanning, check each keeper,candidate pair of paths in this CSV file and print PASS or FAIL")
+		dumpIntermediatesFlag  = flags.String("dump-intermediates", "", "save the image after each step of fingerprinting each file, from resampled to the final monochrome fingerprint, as PNGs in a directory per file under this one; with -explain, of the two images")
+		benchmarkFlag          = flags.String("benchmark", "", "fingerprint the images in this directory and report how long it took, without matching")
+		showOriginFlag         = flags.Bool("show-origin", false, "annotate each match with the argument it was found under")
+		maxGroupsFlag          = flags.Int("max-groups", 0, "if positive, only report the N groups that deleting duplicates would free the most bytes from, and say how many were left out")
+		showResolutionFlag     = flags.Bool("show-resolution", false, "annotate each match with its width and height, such as to keep the largest of copies at different sizes")
+		summaryOnlyFlag        = flags.Bool("summary-only", false, "only print the number of groups, files in them, and bytes that deleting duplicates would free")
+		summaryJSONFlag        = flags.String("summary-json", "", "after grouping, also save the numbers of images scanned, reused from -since-index or -checkpoint, imported, skipped, and failed, of groups, files in them, and bytes reclaimable, how long scanning and matching took, and whether -max-duration cut them short, to this file as JSON")
+		templateFlag           = flags.String("template", "", "print each group with this Go text/template instead of -format")
+		formatFlag             = flags.String("format", "text", "output format: text, json, jsonl, delete-list (every file but the one to keep), or keep-list (every file delete-list doesn't list)")
+		groupOutputFlag        = flags.String("group-output", "by-group", "by-group prints each group in turn; by-folder lists the files in each folder with the groups they are in, with -format text only")
+		contactSheetFlag       = flags.String("contact-sheet", "", "also save thumbnails of each group side by side to this directory, as group-N.png")
+		thumbSizeFlag          = flags.String("thumb-size", "200x200", "width and height of the box each -contact-sheet thumbnail is scaled to fit, like 320x240")
+		relativeFlag           = flags.Bool("relative", false, "print paths relative to the current directory")
+		baseFlag               = flags.String("base", "", "print paths relative to this directory")
+		posixPathsFlag         = flags.Bool("posix-paths", false, "print paths with / as the separator, even on Windows, so reports can be compared across platforms")
+		keepFlag               = flags.String("keep", "largest", "which file of a group to keep: largest, smallest, newest, or oldest")
+		keepPreferFlag         = flags.String("keep-prefer", "", "keep files whose path matches this regular expression over others, falling back to -keep")
+		tiebreakFlag           = flags.String("tiebreak", "first-seen", "which file of a group to keep when -keep can't choose: first-seen, or path for the one whose path sorts first")
+		algorithmFlag          = flags.String("algorithm", "ahash", "hash to fingerprint with: ahash, dhash, edgehash, or several joined by +, like ahash+dhash, to require all of them to match")
+		hashMaskFlag           = flags.String("hash-mask", "", "fingerprint-sized hex mask of bits to leave out of the distance, such as noisy corners")
+		maxGroupDiameterFlag   = flags.Float64("max-group-diameter", 0, "if positive, split groups so that no two files in a group differ by this percentage or more, like -threshold")
+		exifConfirmFlag        = flags.Bool("exif-confirm", false, "only match photos with EXIF data if they are from the same camera model or taken within -exif-window of each other")
+		exifWindowFlag         = flags.Duration("exif-window", 10*time.Second, "how far apart in time -exif-confirm lets photos from different cameras be")
+		requireColorMatchFlag  = flags.Bool("require-color-match", false, "don't match color images with grayscale ones, such as desaturated copies")
+		noTransitiveFlag       = flags.Bool("no-transitive", false, "report each pair of similar images on its own, instead of grouping images that are only similar through others")
+		quadrantMatchFlag      = flags.Bool("quadrant-match", false, "also require each quarter of a pair to differ by less than half of -threshold, so pairs that differ sharply in one corner don't match")
+		lowMemoryFlag          = flags.Bool("low-memory", false, "keep the matching pairs in a temporary file instead of in memory while grouping, for very large collections")
+		invariantFlag          = flags.Bool("invariant", false, "also match rotated and mirrored copies, and label how each differs")
+		distanceUnitFlag       = flags.String("distance-unit", "bits", "how to print distances between images: bits, or percent of the bits in a fingerprint, like -threshold")
+		timingsFlag            = flags.Int("timings", 0, "print the N images that took longest to decode and hash to stderr, and with -verbose, the times of every image")
+		statsFlag              = flags.Bool("stats", false, "after the groups, print the min, max, mean, and median distance between all the pairs compared, and a histogram of them, to stderr")
+	)
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	args = flags.Args()
+	verbose := *verboseFlag
+
+	if *thresholdFlag < 0 || *thresholdFlag > 100 {
+		_, _ = fmt.Fprintf(stderr, "-threshold must be from 0 to 100, got %g\n", *thresholdFlag)
+		return 2
+	}
+	if *intermediateSizeFlag < hashSize {
+		_, _ = fmt.Fprintf(stderr, "-intermediate-size must be at least %d\n", hashSize)
+		return 2
+	}
+	if *blurRadiusFlag < 0 {
+		_, _ = fmt.Fprintf(stderr, "-blur-radius must not be negative\n")
+		return 2
+	}
+	if *ioRetriesFlag < 0 {
+		_, _ = fmt.Fprintf(stderr, "-io-retries must not be negative\n")
+		return 2
+	}
+	if *printEncodingFlag != "hex" && *printEncodingFlag != "base64" {
+		_, _ = fmt.Fprintf(stderr, "-print-encoding must be hex or base64\n")
+		return 2
+	}
+	if *errorsFlag != "text" && *errorsFlag != "json" {
+		_, _ = fmt.Fprintf(stderr, "-errors must be text or json\n")
+		return 2
+	}
+	unit, err := parseDistanceUnit(*distanceUnitFlag)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "%v\n", err)
+		return 2
+	}
+	if *claheClipFlag < 0 {
+		_, _ = fmt.Fprintf(stderr, "-clahe-clip must not be negative\n")
+		return 2
+	}
+	if *jobsFlag < 1 {
+		_, _ = fmt.Fprintf(stderr, "-jobs must be at least 1\n")
+		return 2
+	}
+	var rootJobs []int
+	if *workersPerDiskFlag != "" {
+		for _, field := range strings.Split(*workersPerDiskFlag, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || n < 1 {
+				_, _ = fmt.Fprintf(stderr, "-workers-per-disk must be a comma-separated list of numbers of at least 1, got %q\n", field)
+				return 2
+			}
+			rootJobs = append(rootJobs, n)
+		}
+	}
+	if *posterizeFlag < 2 || *posterizeFlag > 256 {
+		_, _ = fmt.Fprintf(stderr, "-posterize must be from 2 to 256\n")
+		return 2
+	}
+	if *lowMemoryFlag && *noTransitiveFlag {
+		_, _ = fmt.Fprintf(stderr, "-low-memory can't be used with -no-transitive\n")
+		return 2
+	}
+	if *maxGroupsFlag < 0 {
+		_, _ = fmt.Fprintf(stderr, "-max-groups must not be negative\n")
+		return 2
+	}
+	if *claheTilesFlag < 1 {
+		_, _ = fmt.Fprintf(stderr, "-clahe-tiles must be at least 1\n")
+		return 2
+	}
+	keep, err := newKeepPolicy(*keepFlag, *keepPreferFlag, *tiebreakFlag)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "%v\n", err)
+		return 2
+	}
+	paths := pathStyle{base: *baseFlag, posix: *posixPathsFlag}
+	if paths.base == "" && *relativeFlag {
+		paths.base = "."
+	}
+	var images []imageInfo
+	opts := outputOptions{keep: keep, paths: paths, resolution: *showResolutionFlag, images: func() []imageInfo { return images }}
+	if *showOriginFlag {
+		opts.origins = args
+	}
+	out, err := newGroupWriter(*formatFlag, stdout, opts)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "%v\n", err)
+		return 2
+	}
+	switch *groupOutputFlag {
+	case "by-group":
+	case "by-folder":
+		if *formatFlag != "text" {
+			_, _ = fmt.Fprintf(stderr, "-group-output by-folder can only be used with -format text\n")
+			return 2
+		}
+		out = &folderWriter{w: stdout}
+	default:
+		_, _ = fmt.Fprintf(stderr, "-group-output must be by-group or by-folder\n")
+		return 2
+	}
+	if *templateFlag != "" {
+		tmpl, err := template.New("group").Parse(*templateFlag)
+		if err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error parsing -template: %v\n", err)
+			return 2
+		}
+		out = &templateWriter{w: stdout, tmpl: tmpl}
+	}
+	if *summaryOnlyFlag {
+		out = &summaryWriter{w: stdout, keep: keep}
+	}
+	// Only what is printed gets the rewritten paths; the writers wrapped around it below, like
+	// -contact-sheet, still need to find the files.
+	if paths != (pathStyle{}) {
+		out = &pathWriter{groupWriter: out, paths: paths}
+	}
+	if *tuiFlag {
+		if *formatFlag != "text" || *groupOutputFlag != "by-group" || *templateFlag != "" || *summaryOnlyFlag {
+			_, _ = fmt.Fprintf(stderr, "-tui can't be used with -format, -group-output, -template, or -summary-only\n")
+			return 2
+		}
+		// Paths are left as they are, so that they can be deleted.
+		out = &reviewWriter{in: stdin, w: stdout, stderr: stderr, keep: keep}
+	}
+	if *contactSheetFlag != "" {
+		thumb, err := parseThumbSize(*thumbSizeFlag)
+		if err != nil {
+			_, _ = fmt.Fprintf(stderr, "%v\n", err)
+			return 2
+		}
+		out = &contactSheetWriter{groupWriter: out, dir: *contactSheetFlag, thumb: thumb}
+	}
+	var top *topGroupsWriter
+	if *maxGroupsFlag > 0 {
+		top = &topGroupsWriter{groupWriter: out, keep: keep, n: *maxGroupsFlag}
+		out = top
+	}
+	h := &hasher{
+		intermediateSize: *intermediateSizeFlag,
+		blurRadius:       *blurRadiusFlag,
+		readWholeFile:    *readWholeFileFlag,
+		skipSolid:        *skipSolidFlag,
+		denoise:          *denoiseFlag,
+		multiscale:       *multiscaleFlag,
+		claheClip:        *claheClipFlag,
+		claheTiles:       *claheTilesFlag,
+		decodeTimeout:    *decodeTimeoutFlag,
+		maxDecodeBytes:   *maxDecodeBytesFlag,
+		strictDecode:     *strictDecodeFlag,
+		centerCrop:       *centerCropFlag,
+		ioRetries:        *ioRetriesFlag,
+	}
+	if *algorithmFlag != "ahash" {
+		h.algorithmNames, h.hashes, err = parseAlgorithms(*algorithmFlag)
+		if err != nil {
+			_, _ = fmt.Fprintf(stderr, "%v\n", err)
+			return 2
+		}
+		if *invariantFlag && len(h.hashes) > 1 {
+			_, _ = fmt.Fprintf(stderr, "-invariant can't be used with more than one -algorithm\n")
+			return 2
+		}
+	}
+
+	caseSensitive := *caseSensitiveExtFlag
+	extensions := strings.Split(*extensionsFlag, ",")
+	for i := 0; i < len(extensions); i++ {
+		// Allow ".jpg" as well as "jpg".
+		extensions[i] = strings.TrimPrefix(strings.TrimSpace(extensions[i]), ".")
+		if !caseSensitive {
+			extensions[i] = strings.ToLower(extensions[i])
+		}
+	}
+
+	// 256 levels is what equalize produces already.
+	if *posterizeFlag < 256 {
+		h.posterize = *posterizeFlag
+	}
+	if *cropRegionFlag != "" {
+		r, err := parseRegion(*cropRegionFlag)
+		if err != nil {
+			_, _ = fmt.Fprintf(stderr, "%v\n", err)
+			return 2
+		}
+		h.cropRegion = &r
+	}
+	if *flattenAlphaFlag {
+		h.withPreprocessor("flatten-alpha", flattenAlpha)
+	}
+	if *trimBordersFlag {
+		h.withPreprocessor("trim-borders", trimBorders)
+	}
+
+	m := &matcher{
+		distance:      hamming,
+		unit:          unit,
+		thresholdBits: percentToBits(*thresholdFlag),
+		invariant:     *invariantFlag,
+		quadrants:     *quadrantMatchFlag,
+		groupByPrefix: *groupByPrefixFlag,
+		sameExt:       *sameExtOnlyFlag,
+		byResolution:  *bucketByResolutionFlag,
+		adaptive:      *adaptiveThresholdFlag,
+		exifConfirm:   *exifConfirmFlag,
+		exifWindow:    *exifWindowFlag,
+	}
+	if *requireColorMatchFlag {
+		m.requireColorMatch = true
+		h.detectColor = true
+	}
+	if *cropTolerantFlag {
+		m.recrop = h
+	}
+	if *statsFlag {
+		m.stats = &distanceStats{}
+	}
+	if *hashMaskFlag != "" {
+		var mask fingerprint
+		if err := mask.UnmarshalText([]byte(*hashMaskFlag)); err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error parsing -hash-mask: %v\n", err)
+			return 2
+		}
+		m.distance = maskedHamming(mask)
+		m.mask = &mask
+	}
+
+	// Every flag has been checked by now, so that bad values are reported even when there is
+	// nothing to do.
+	if *queryFlag != "" && len(args) == 0 && *importFlag == "" {
+		_, _ = fmt.Fprintf(stderr, "-query needs -import-fingerprints or paths to search\n")
+		return 2
+	}
+	if *serveFlag != "" && len(args) == 0 && *importFlag == "" {
+		_, _ = fmt.Fprintf(stderr, "-serve needs -import-fingerprints or paths to search\n")
+		return 2
+	}
+	if len(args) == 0 && *importFlag == "" && *benchmarkFlag == "" && *watchFlag == "" && *verifyFlag == "" {
+		return 0
+	}
+
+	if *dedupeReportFlag != "" {
+		if len(args) != 1 {
+			_, _ = fmt.Fprintf(stderr, "-dedupe-report takes the new report as its only argument\n")
+			return 2
+		}
+		older, err := readReport(*dedupeReportFlag)
+		if err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error reading report: %v\n", err)
+			return 1
+		}
+		newer, err := readReport(args[0])
+		if err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error reading report: %v\n", err)
+			return 1
+		}
+		diff := diffReports(older, newer)
+		if err := diff.write(stdout); err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error writing output: %v\n", err)
+			return 1
+		}
+		return 0
 	}
 	if verbose {
-		fmt.Printf("Cross-matching %d files\n", len(fingerprints))
+		_, _ = fmt.Fprintf(stdout, "Scanning for exentions: %s\n", strings.Join(extensions, " "))
 	}
-	matches := map[int][]int{}
-	thresholdBits := int(math.Round(256 * (*thresholdFlag / 100.0)))
-	for i := 0; i < len(fingerprints); i++ {
-		a := fingerprints[i]
-		for j := i + 1; j < len(fingerprints); j++ {
-			b := fingerprints[j]
-			if a.diffbits(b) < thresholdBits {
-				if _, ok := matches[i]; ok {
-					matches[i] = append(matches[i], j)
-				} else {
-					matches[i] = []int{j}
-				}
-				if _, ok := matches[j]; ok {
-					matches[j] = append(matches[j], i)
-				} else {
-					matches[j] = []int{i}
+	if *contactSheetFlag != "" {
+		if err := os.MkdirAll(*contactSheetFlag, 0o755); err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error creating -contact-sheet directory: %v\n", err)
+			return 1
+		}
+	}
+	if *explainFlag {
+		if len(args) != 2 {
+			_, _ = fmt.Fprintf(stderr, "-explain takes two images as its arguments\n")
+			return 2
+		}
+		if err := m.explainPair(stdout, h, args[0], args[1]); err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error explaining: %v\n", err)
+			return 1
+		}
+		if *dumpIntermediatesFlag != "" {
+			for _, name := range args {
+				if err := h.dumpIntermediates(*dumpIntermediatesFlag, name); err != nil {
+					_, _ = fmt.Fprintf(stderr, "Error saving intermediates of %s: %v\n", name, err)
+					return 1
 				}
 			}
+			_, _ = fmt.Fprintf(stdout, "\nSaved the steps of fingerprinting both images in %s\n", *dumpIntermediatesFlag)
+		}
+		return 0
+	}
+	if *verifyFlag != "" {
+		failed, err := m.verifyPairs(stdout, stderr, h, *verifyFlag)
+		if err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error verifying %s: %v\n", *verifyFlag, err)
+			return 1
+		}
+		if failed > 0 {
+			return 1
 		}
+		return 0
 	}
-	for i := 0; i < len(fingerprints); i++ {
-		if _, ok := matches[i]; !ok {
+	if *benchmarkFlag != "" {
+		if err := benchmark(stdout, h, *benchmarkFlag, extensions, caseSensitive, *includeHiddenFlag); err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error benchmarking: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	ctx := context.Background()
+	if *maxDurationFlag > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *maxDurationFlag)
+		defer cancel()
+	}
+	var urls []urlArg
+	inputs := newInputSet()
+	errs := &errorReporter{w: stderr, json: *errorsFlag == "json"}
+	var cp *checkpoint
+	if *checkpointFlag != "" {
+		cp, err = openCheckpoint(*checkpointFlag, h.version())
+		if err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error opening checkpoint: %v\n", err)
+			return 1
+		}
+		if verbose && len(cp.done) > 0 {
+			_, _ = fmt.Fprintf(stdout, "Resuming with %d fingerprints from %s\n", len(cp.done), *checkpointFlag)
+		}
+	}
+	// index is the fingerprints from -since-index, and indexed those of them that haven't been
+	// found again yet, by path.
+	var index []imageInfo
+	indexed := map[string]imageInfo{}
+	if *sinceIndexFlag != "" {
+		var stale int
+		index, stale, err = importFingerprints(*sinceIndexFlag, h.version())
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			_, _ = fmt.Fprintf(stderr, "Error reading index: %v\n", err)
+			return 1
+		}
+		if stale > 0 {
+			_, _ = fmt.Fprintf(stderr, "Fingerprinting %d files in %s again, since they were indexed with different settings or an older version.\n", stale, *sinceIndexFlag)
+		}
+		m.known = map[string]bool{}
+		for _, im := range index {
+			indexed[im.Path] = im
+			m.known[im.Path] = true
+		}
+	}
+	var roots []scanRoot
+	for argIndex, arg := range args {
+		if isURL(arg) {
+			urls = append(urls, urlArg{url: arg, origin: argIndex + 1})
 			continue
 		}
-		equiv := findEquiv(matches, i)
-		var names []string
-		for _, j := range equiv {
-			names = append(names, fingerprintPaths[j])
-			delete(matches, j)
+		root := scanRoot{path: arg, origin: argIndex + 1, jobs: *jobsFlag}
+		if argIndex < len(rootJobs) {
+			root.jobs = rootJobs[argIndex]
+		}
+		roots = append(roots, root)
+	}
+	sc := &scanner{
+		h:                  h,
+		extensions:         extensions,
+		caseSensitive:      caseSensitive,
+		includeHidden:      *includeHiddenFlag,
+		archives:           *archivesFlag,
+		sniffExtensionless: *sniffExtensionlessFlag,
+		exifConfirm:        *exifConfirmFlag,
+		dumpDir:            *dumpIntermediatesFlag,
+		inputs:             inputs,
+		errs:               errs,
+		cp:                 cp,
+		indexed:            indexed,
+		verbose:            verbose,
+		stdout:             stdout,
+	}
+	var summary runSummary
+	scanStart := time.Now()
+	images, err = sc.scan(ctx, roots)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "Error writing checkpoint: %v\n", err)
+		return 1
+	}
+	// The index only lists files from the filesystem, not URLs or imported fingerprints, which
+	// the next run would otherwise take for files it had already scanned.
+	toIndex := slices.Clip(images)
+	// An unfinished scan keeps its checkpoint to carry on from.
+	if cp != nil && ctx.Err() == nil {
+		if err := cp.finish(); err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error removing checkpoint: %v\n", err)
+		}
+	}
+	if len(urls) > 0 && ctx.Err() == nil {
+		if verbose {
+			_, _ = fmt.Fprintf(stdout, "Fetching %d URLs\n", len(urls))
+		}
+		fetched := h.fetchImages(&http.Client{Timeout: *timeoutFlag}, urls, *urlJobsFlag, errs)
+		images = append(images, fetched...)
+		summary.Scanned += len(fetched)
+	}
+	errs.summarize()
+	summary.Scanned += sc.fingerprinted
+	summary.Reused = sc.reused
+	summary.ScanSeconds = time.Since(scanStart).Seconds()
+	summary.Skipped = errs.skipped.notImage + errs.skipped.unsupported + errs.skipped.tooLarge
+	summary.Failed = errs.skipped.total() - summary.Skipped
+	if *timingsFlag > 0 {
+		_ = writeTimings(stderr, images, *timingsFlag, verbose)
+	}
+	if *importFlag != "" {
+		imported, stale, err := importFingerprints(*importFlag, h.version())
+		if err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error importing fingerprints: %v\n", err)
+			return 1
+		}
+		if stale > 0 {
+			_, _ = fmt.Fprintf(stderr, "Ignoring %d fingerprints in %s that were computed with different settings or an older version.\n", stale, *importFlag)
+		}
+		if verbose {
+			_, _ = fmt.Fprintf(stdout, "Imported %d fingerprints from %s\n", len(imported), *importFlag)
+		}
+		images = append(images, imported...)
+		summary.Imported = len(imported)
+	}
+	// Indexed files that weren't found again are still matched against, and kept in the index.
+	for _, im := range index {
+		if _, ok := indexed[im.Path]; ok {
+			images = append(images, im)
+			toIndex = append(toIndex, im)
+			summary.Reused++
+		}
+	}
+	seen := len(images)
+	images = dedupePaths(images)
+	if verbose && inputs.collapsed+seen-len(images) > 0 {
+		_, _ = fmt.Fprintf(stdout, "Ignoring %d files that were seen more than once\n", inputs.collapsed+seen-len(images))
+	}
+	if *exportFlag != "" {
+		if err := exportFingerprints(*exportFlag, images, h.version(), *printEncodingFlag); err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error exporting fingerprints: %v\n", err)
+			return 1
+		}
+	}
+	if *datasetFlag != "" {
+		if err := exportDataset(*datasetFlag, images, paths, *printEncodingFlag); err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error writing dataset: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	if *sinceIndexFlag != "" {
+		if err := exportFingerprints(*sinceIndexFlag, dedupePaths(toIndex), h.version(), *printEncodingFlag); err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error updating index: %v\n", err)
+			return 1
+		}
+	}
+	if *ignoreFingerprintsFlag != "" {
+		ignore, err := readFingerprintList(*ignoreFingerprintsFlag)
+		if err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error reading fingerprints to ignore: %v\n", err)
+			return 1
+		}
+		kept := m.withoutIgnored(images, ignore)
+		if verbose {
+			_, _ = fmt.Fprintf(stdout, "Ignoring %d files that match -ignore-fingerprints\n", len(images)-len(kept))
+		}
+		images = kept
+	}
+	if *watchFlag != "" {
+		// Watching stops on an interrupt, or once -max-duration is up.
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := h.watch(ctx, stdout, stderr, m, *watchFlag, images, extensions, caseSensitive, *includeHiddenFlag, verbose); err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error watching %s: %v\n", *watchFlag, err)
+			return 1
+		}
+		return 0
+	}
+	if *remoteIndexFlag != "" {
+		remote := &remoteIndex{client: &http.Client{Timeout: *timeoutFlag}, base: *remoteIndexFlag, version: h.version()}
+		if err := remote.writeMatches(stdout, images, paths); err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	if *serveFlag != "" {
+		srv := &server{h: h, m: m, images: images, paths: paths}
+		if err := srv.serve(*serveFlag, stdout, verbose); err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error serving on %s: %v\n", *serveFlag, err)
+			return 1
+		}
+		return 0
+	}
+	if *queryFlag != "" {
+		q, err := h.fingerprintImage(*queryFlag)
+		if err != nil && !errors.Is(err, errPartialImage) {
+			_, _ = fmt.Fprintf(stderr, "Error decoding image %s: %v\n", *queryFlag, err)
+			return 1
+		}
+		q.Path = *queryFlag
+		if *exifConfirmFlag {
+			q.EXIF, _ = readEXIFFile(*queryFlag)
+		}
+		matches := m.matchesOf(images, &q)
+		for _, n := range matches {
+			_, _ = fmt.Fprintf(stdout, "%s\t%s\n", m.unit.format(float64(n.distance)), paths.format(images[n.index].Path))
+		}
+		if len(matches) == 0 && !*quietFlag {
+			_, _ = fmt.Fprintf(stderr, "No matches for %s (%d images searched)\n", *queryFlag, len(images))
+		}
+		return 0
+	}
+	if *nearestFlag > 0 {
+		for i := 0; i < len(images); i++ {
+			_, _ = fmt.Fprintf(stdout, "Nearest to %s:\n", paths.format(images[i].Path))
+			for _, n := range m.nearest(images, i, *nearestFlag) {
+				_, _ = fmt.Fprintf(stdout, "%s\t%s\n", m.unit.format(float64(n.distance)), paths.format(images[n.index].Path))
+			}
+			_, _ = fmt.Fprintf(stdout, "\n")
+		}
+		return 0
+	}
+	if verbose {
+		_, _ = fmt.Fprintf(stdout, "Cross-matching %d files\n", len(images))
+	}
+	matchStart := time.Now()
+	var components [][]int
+	if *lowMemoryFlag {
+		components, err = m.matchComponentsLowMemory(ctx, images)
+		if err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error matching: %v\n", err)
+			return 1
+		}
+	} else {
+		matches := m.findMatches(ctx, images)
+		if *noTransitiveFlag {
+			components = matchPairs(matches, len(images))
+		} else {
+			for i := 0; i < len(images); i++ {
+				if _, ok := matches[i]; !ok {
+					continue
+				}
+				equiv := findEquiv(matches, i)
+				for _, j := range equiv {
+					delete(matches, j)
+				}
+				components = append(components, equiv)
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		_, _ = fmt.Fprintf(stderr, "Stopped after -max-duration %v; these results are partial.\n", *maxDurationFlag)
+		summary.Partial = true
+	}
+	var splits []func(i, j int) bool
+	if *maxGroupDiameterFlag > 0 {
+		maxBits := percentToBits(*maxGroupDiameterFlag)
+		splits = append(splits, func(i, j int) bool {
+			d, _ := m.compare(&images[i], &images[j])
+			return d < maxBits
+		})
+	}
+	if m.exifConfirm {
+		// Pairs are checked as they are matched, but a group can still chain together photos that don't agree.
+		splits = append(splits, func(i, j int) bool {
+			return exifAgree(images[i].EXIF, images[j].EXIF, m.exifWindow)
+		})
+	}
+	if m.requireColorMatch {
+		// Imported fingerprints agree with both, so they can chain the two together.
+		splits = append(splits, func(i, j int) bool {
+			return colorsAgree(&images[i], &images[j])
+		})
+	}
+	for _, near := range splits {
+		var split [][]int
+		for _, indexes := range components {
+			slices.Sort(indexes)
+			split = append(split, splitGroup(indexes, near)...)
+		}
+		components = split
+	}
+	groupID := 0
+	for _, indexes := range components {
+		groupID++
+		g := m.newGroup(groupID, images, indexes)
+		g.Partial = summary.Partial
+		summary.add(g, keep)
+		if smallest, largest, ok := g.identicalSizeMismatch(); verbose && ok {
+			_, _ = fmt.Fprintf(stderr, "Warning: group %d has identical fingerprints for files of %d and %d bytes; "+
+				"this can happen with solid color or damaged images, so check it by hand.\n", g.ID, smallest, largest)
+		}
+		if err := out.writeGroup(g); err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error writing output: %v\n", err)
+			return 1
+		}
+	}
+	if err := out.close(); err != nil {
+		_, _ = fmt.Fprintf(stderr, "Error writing output: %v\n", err)
+		return 1
+	}
+	if top != nil && top.omitted > 0 {
+		_, _ = fmt.Fprintf(stderr, "%d more groups not shown; raise -max-groups to see them\n", top.omitted)
+	}
+	// An empty output could also mean nothing ran, so say so.
+	if groupID == 0 && !*quietFlag {
+		_, _ = fmt.Fprintf(stderr, "No duplicate groups found (%d images scanned)\n", len(images))
+	}
+	if m.stats != nil {
+		_ = m.stats.write(stderr, m.unit)
+	}
+	if *summaryJSONFlag != "" {
+		summary.MatchSeconds = time.Since(matchStart).Seconds()
+		if err := summary.save(*summaryJSONFlag); err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error writing -summary-json: %v\n", err)
+			return 1
 		}
-		fmt.Printf("Possible matches:\n%s\n", strings.Join(names, "\n"))
-		fmt.Printf("\n")
 	}
+	return 0
 }
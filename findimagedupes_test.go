@@ -0,0 +1,1718 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// checkGolden compares got with the golden file testdata/name, or with -update, rewrites it.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	golden := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(golden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from %s:\n%s\nwant:\n%s", name, golden, got, want)
+	}
+}
+
+// testImage draws a w×h image of waves whose direction and frequency depend on seed, so that
+// images with different seeds have fingerprints far apart.
+func testImage(w, h, seed int) *image.RGBA {
+	im := image.NewRGBA(image.Rect(0, 0, w, h))
+	angle := float64(seed) * 2.4
+	fx, fy := math.Cos(angle)*float64(2+seed%3), math.Sin(angle)*float64(2+seed%3)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			u, v := float64(x)/float64(w), float64(y)/float64(h)
+			g := uint8(127.5 + 127.5*math.Sin(2*math.Pi*(fx*u+fy*v)+float64(seed)))
+			im.Set(x, y, color.RGBA{R: g, G: g, B: uint8(x * 255 / w), A: 0xff})
+		}
+	}
+	return im
+}
+
+// nearCopy is a copy of im with a white square in its top left corner, which fingerprints close
+// to im but not the same.
+func nearCopy(im *image.RGBA) *image.RGBA {
+	near := image.NewRGBA(im.Bounds())
+	copy(near.Pix, im.Pix)
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 20; x++ {
+			near.Set(x, y, color.White)
+		}
+	}
+	return near
+}
+
+// writeTestPNG saves im as a PNG to name, failing the test if it can't.
+func writeTestPNG(t testing.TB, name string, im image.Image) {
+	t.Helper()
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, im); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testHasher is a hasher with the default settings of run.
+func testHasher() *hasher {
+	return &hasher{intermediateSize: 160, blurRadius: 3, strictDecode: true}
+}
+
+func TestThresholdOutOfRange(t *testing.T) {
+	for _, threshold := range []string{"150", "100.5", "-5"} {
+		var stdout, stderr bytes.Buffer
+		// With no paths there is nothing to do, but the threshold must still be checked.
+		if code := run([]string{"-threshold", threshold}, &stdout, &stderr); code != 2 {
+			t.Errorf("-threshold %s: exit status %d, want 2", threshold, code)
+		}
+		if !strings.Contains(stderr.String(), "-threshold must be from 0 to 100") {
+			t.Errorf("-threshold %s: stderr %q doesn't explain the range", threshold, stderr.String())
+		}
+		if stdout.Len() > 0 {
+			t.Errorf("-threshold %s: unexpected output %q", threshold, stdout.String())
+		}
+	}
+}
+
+func TestThresholdInRange(t *testing.T) {
+	for _, threshold := range []string{"0", "10", "100"} {
+		var stdout, stderr bytes.Buffer
+		if code := run([]string{"-threshold", threshold}, &stdout, &stderr); code != 0 {
+			t.Errorf("-threshold %s: exit status %d, want 0; stderr %q", threshold, code, stderr.String())
+		}
+	}
+}
+
+func TestThresholdZeroMatchesOnlyIdentical(t *testing.T) {
+	dir := t.TempDir()
+	im := testImage(120, 90, 1)
+	writeTestPNG(t, filepath.Join(dir, "a.png"), im)
+	writeTestPNG(t, filepath.Join(dir, "b.png"), im)
+	writeTestPNG(t, filepath.Join(dir, "c.png"), nearCopy(im))
+
+	for _, tc := range []struct {
+		threshold string
+		want      string
+	}{
+		{"0", "Possible matches: a.png b.png"},
+		{"10", "Possible matches: a.png b.png c.png"},
+	} {
+		var stdout, stderr bytes.Buffer
+		if code := run([]string{"-threshold", tc.threshold, "-base", dir, dir}, &stdout, &stderr); code != 0 {
+			t.Fatalf("-threshold %s: exit status %d; stderr %q", tc.threshold, code, stderr.String())
+		}
+		if got := strings.Join(strings.Fields(stdout.String()), " "); got != tc.want {
+			t.Errorf("-threshold %s: got %q, want %q", tc.threshold, got, tc.want)
+		}
+	}
+}
+
+func TestHasExtension(t *testing.T) {
+	// Only the last extension counts, so backups like .jpg.bak aren't taken for images.
+	for _, tc := range []struct {
+		path          string
+		extensions    []string
+		caseSensitive bool
+		want          bool
+	}{
+		{"a/photo.jpg", defaultExtensions, false, true},
+		{"a/photo.JPG", defaultExtensions, false, true},
+		{"a/photo.Jpeg", defaultExtensions, false, true},
+		{"a/photo.jpg.bak", defaultExtensions, false, false},
+		{"a/photo.bak.jpg", defaultExtensions, false, true},
+		{"a/photo.jpg.bak", []string{"jpg.bak"}, false, false},
+		{"a/photo.jpg.bak", []string{"bak"}, false, true},
+		{"a/jpg", defaultExtensions, false, false},
+		{"a/photo.jpg", []string{"jpg"}, true, true},
+		{"a/photo.JPG", []string{"jpg"}, true, false},
+		{"a/photo.JPG", []string{"JPG"}, true, true},
+		{"a/photo.Jpeg", []string{"jpeg", "JPEG"}, true, false},
+	} {
+		if got := hasExtension(tc.path, tc.extensions, tc.caseSensitive); got != tc.want {
+			t.Errorf("hasExtension(%q, %q, %v) = %v, want %v", tc.path, tc.extensions, tc.caseSensitive, got, tc.want)
+		}
+	}
+
+	// run takes -extensions with or without dots, and lowercases them unless -case-sensitive-ext.
+	dir := t.TempDir()
+	for _, name := range []string{"a.JPG", "b.Jpeg", "c.jpg", "d.jpg.bak", "e.PNG"} {
+		writeTestPNG(t, filepath.Join(dir, name), testImage(64, 48, 1))
+	}
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "Possible matches: a.JPG b.Jpeg c.jpg e.PNG"},
+		{[]string{"-extensions", ".JPG,.jpeg"}, "Possible matches: a.JPG b.Jpeg c.jpg"},
+		{[]string{"-extensions", ".JPG, .PNG"}, "Possible matches: a.JPG c.jpg e.PNG"},
+		{[]string{"-case-sensitive-ext", "-extensions", ".JPG,jpg"}, "Possible matches: a.JPG c.jpg"},
+		{[]string{"-case-sensitive-ext", "-extensions", "Jpeg,bak"}, "Possible matches: b.Jpeg d.jpg.bak"},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append(tc.args, "-base", dir, dir)
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if got := strings.Join(strings.Fields(stdout.String()), " "); got != tc.want {
+			t.Errorf("%q: got %q, want %q", args, got, tc.want)
+		}
+	}
+}
+
+func TestReadWholeFileMatchesStreaming(t *testing.T) {
+	dir := t.TempDir()
+	for seed := 0; seed < 4; seed++ {
+		name := filepath.Join(dir, fmt.Sprintf("%d.png", seed))
+		writeTestPNG(t, name, testImage(40+seed*13, 30+seed*7, seed))
+
+		streamed, err := testHasher().fingerprintImage(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := testHasher()
+		h.readWholeFile = true
+		read, err := h.fingerprintImage(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read.Fingerprint != streamed.Fingerprint || read.Width != streamed.Width || read.Height != streamed.Height {
+			t.Errorf("%s: -read-whole-file gave %v (%dx%d), streaming gave %v (%dx%d)", name,
+				read.Fingerprint, read.Width, read.Height, streamed.Fingerprint, streamed.Width, streamed.Height)
+		}
+	}
+}
+
+// BenchmarkFingerprintSmallFiles compares streaming with -read-whole-file over a directory of
+// small PNGs, where opening and reading each file is a large part of the work.
+func BenchmarkFingerprintSmallFiles(b *testing.B) {
+	dir := b.TempDir()
+	var names []string
+	for i := 0; i < 200; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("%d.png", i))
+		writeTestPNG(b, name, testImage(32, 32, i))
+		names = append(names, name)
+	}
+	for _, readWholeFile := range []bool{false, true} {
+		b.Run(fmt.Sprintf("read-whole-file=%v", readWholeFile), func(b *testing.B) {
+			h := testHasher()
+			h.readWholeFile = readWholeFile
+			for i := 0; i < b.N; i++ {
+				if _, err := h.fingerprintImage(names[i%len(names)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestConflictingFlags(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-group-output", "by-folder", "-format", "json"}, "-group-output by-folder can only be used with -format text"},
+		{[]string{"-group-output", "by-folder", "-format", "delete-list"}, "-group-output by-folder can only be used with -format text"},
+		{[]string{"-tui", "-format", "json"}, "-tui can't be used with -format"},
+		{[]string{"-tui", "-summary-only"}, "-tui can't be used with"},
+		{[]string{"-low-memory", "-no-transitive"}, "-low-memory can't be used with -no-transitive"},
+	} {
+		var stdout, stderr bytes.Buffer
+		if code := run(append(tc.args, t.TempDir()), &stdout, &stderr); code != 2 {
+			t.Errorf("%q: exit status %d, want 2", tc.args, code)
+		}
+		if !strings.Contains(stderr.String(), tc.want) {
+			t.Errorf("%q: stderr %q, want %q", tc.args, stderr.String(), tc.want)
+		}
+	}
+}
+
+func TestTUIReadsStdinAndKeepsWrappers(t *testing.T) {
+	dir := t.TempDir()
+	sheets := t.TempDir()
+	writeTestPNG(t, filepath.Join(dir, "a.png"), testImage(64, 48, 1))
+	writeTestPNG(t, filepath.Join(dir, "b.png"), testImage(64, 48, 1))
+	writeTestPNG(t, filepath.Join(dir, "c.png"), testImage(64, 48, 4))
+
+	var stdout, stderr bytes.Buffer
+	stdin := strings.NewReader("1\ny\n")
+	args := []string{"-tui", "-max-groups", "1", "-contact-sheet", sheets, dir}
+	if code := runWithStdin(args, stdin, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "Deleted 1 files.") {
+		t.Errorf("stdout %q doesn't report deleting the duplicate", stdout.String())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.png")); !os.IsNotExist(err) {
+		t.Errorf("b.png wasn't deleted: %v", err)
+	}
+	for _, name := range []string{"a.png", "c.png"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if sheets, _ := filepath.Glob(filepath.Join(sheets, "group-*.png")); len(sheets) != 1 {
+		t.Errorf("got contact sheets %q, want one", sheets)
+	}
+}
+
+// boxBlur is the blur from before summed-area tables: it adds up every pixel in the box.
+func boxBlur(gray *image.Gray, radius int) *image.Gray {
+	w, h := gray.Bounds().Dx(), gray.Bounds().Dy()
+	out := image.NewGray(gray.Bounds())
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			s, sum := 0, 0
+			for a := x - radius; a <= x+radius; a++ {
+				for b := y - radius; b <= y+radius; b++ {
+					if a < 0 || a >= w || b < 0 || b >= h {
+						continue
+					}
+					s++
+					sum += int(gray.GrayAt(a, b).Y)
+				}
+			}
+			out.SetGray(x, y, color.Gray{Y: uint8(sum / s)})
+		}
+	}
+	return out
+}
+
+func TestBlurMatchesBoxBlur(t *testing.T) {
+	gray := grayscale(testImage(37, 29, 2)).(*image.Gray)
+	for _, radius := range []int{0, 1, 3, 7, 40} {
+		got := blur(gray, radius).(*image.Gray)
+		want := boxBlur(gray, radius)
+		if !bytes.Equal(got.Pix, want.Pix) {
+			t.Errorf("radius %d: blur differs from the box blur", radius)
+		}
+	}
+}
+
+func TestBlurRadiusSmooths(t *testing.T) {
+	// roughness sums the differences between neighboring pixels, which blurring evens out.
+	roughness := func(im *image.Gray) int {
+		sum := 0
+		for y := 0; y < im.Rect.Dy(); y++ {
+			for x := 1; x < im.Rect.Dx(); x++ {
+				d := int(im.GrayAt(x, y).Y) - int(im.GrayAt(x-1, y).Y)
+				sum += max(d, -d)
+			}
+		}
+		return sum
+	}
+	gray := grayscale(testImage(160, 160, 4)).(*image.Gray)
+	if got := blur(gray, 0).(*image.Gray); !bytes.Equal(got.Pix, gray.Pix) {
+		t.Error("radius 0 changed the image")
+	}
+	last := roughness(gray)
+	for _, radius := range []int{1, 3, 7} {
+		r := roughness(blur(gray, radius).(*image.Gray))
+		if r >= last {
+			t.Errorf("radius %d: roughness %d, want less than %d at the smaller radius", radius, r, last)
+		}
+		last = r
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-blur-radius", "-1", "testdata"}, &stdout, &stderr); code != 2 || !strings.Contains(stderr.String(), "-blur-radius must not be negative") {
+		t.Errorf("-blur-radius -1: exit status %d, stderr %q; want 2 and an explanation", code, stderr.String())
+	}
+}
+
+// testdataImages are the images in testdata: waves.png with a JPEG copy and a smaller GIF copy,
+// which match, and two images unlike any other.
+var testdataImages = []string{
+	"a/waves.png",
+	"a/waves.jpg",
+	"b/waves_small.gif",
+	"b/ripples.png",
+	"b/stripes.jpg",
+}
+
+// sampledImage is a huge image that doesn't store any pixels, but remembers which columns were read.
+type sampledImage struct {
+	bounds image.Rectangle
+	xs     []int
+}
+
+func (s *sampledImage) ColorModel() color.Model { return color.GrayModel }
+func (s *sampledImage) Bounds() image.Rectangle { return s.bounds }
+func (s *sampledImage) At(x, y int) color.Color {
+	s.xs = append(s.xs, x)
+	return color.Gray{}
+}
+
+func TestResampleHugeImage(t *testing.T) {
+	// The widest image whose coordinates fit in an int on 32-bit platforms, where multiplying
+	// them by the number of columns overflows unless it's done in 64 bits.
+	const width = math.MaxInt32
+	im := &sampledImage{bounds: image.Rect(0, 0, width, 1)}
+	resample(im, hashSize, 1)
+	if len(im.xs) != hashSize {
+		t.Fatalf("resample read %d pixels, want %d", len(im.xs), hashSize)
+	}
+	for i, x := range im.xs {
+		if want := int(math.Round(float64(i) * width / hashSize)); x != want {
+			t.Errorf("column %d sampled x = %d, want %d", i, x, want)
+		}
+	}
+}
+
+func TestDiffbits(t *testing.T) {
+	var a, b fingerprint
+	if d := a.diffbits(b); d != 0 {
+		t.Errorf("identical fingerprints differ by %d bits", d)
+	}
+	b[0] = 0x81
+	b[31] = 0xff
+	if d := a.diffbits(b); d != 10 {
+		t.Errorf("diffbits = %d, want 10", d)
+	}
+	for i := range b {
+		b[i] = 0xff
+	}
+	if d := a.diffbits(b); d != fingerprintBits {
+		t.Errorf("opposite fingerprints differ by %d bits, want %d", d, fingerprintBits)
+	}
+}
+
+func TestHashMaskExcludesBits(t *testing.T) {
+	// b differs from a in the first two rows, which are masked, and in one bit that isn't.
+	var a, mask fingerprint
+	b := a
+	for i := 0; i < 2*hashSize/8; i++ {
+		mask[i] = 0xff
+		b[i] = 0x5a
+	}
+	b[20] = 0x01
+	if got := maskedHamming(mask)(a, b); got != 1 {
+		t.Errorf("masked distance %d, want 1", got)
+	}
+	if got := hamming(a, b); got != 17 {
+		t.Errorf("unmasked distance %d, want 17", got)
+	}
+
+	// With a threshold of 5%, 12 bits, the pair only matches with the mask.
+	exported := filepath.Join(t.TempDir(), "pair.jsonl")
+	if err := exportFingerprints(exported, []imageInfo{{Path: "a.png", Fingerprint: a}, {Path: "b.png", Fingerprint: b}}, testHasher().version(), "hex"); err != nil {
+		t.Fatal(err)
+	}
+	maskText, _ := mask.MarshalText()
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"-hash-mask", string(maskText)}, "Possible matches:\na.png\nb.png\n\n"},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append(tc.args, "-threshold", "5", "-import-fingerprints", exported)
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if got := stdout.String(); got != tc.want {
+			t.Errorf("%q: got %q, want %q", args, got, tc.want)
+		}
+	}
+}
+
+func TestAdaptiveThresholdTighterForSmallImages(t *testing.T) {
+	m := &matcher{distance: hamming, thresholdBits: percentToBits(10), adaptive: true}
+	for _, tc := range []struct {
+		w, h, want int
+	}{
+		{16, 16, 1},
+		{64, 48, 3},
+		{256, 256, 13},
+		{512, 512, m.thresholdBits},
+		{4000, 3000, m.thresholdBits},
+		{0, 0, m.thresholdBits},
+	} {
+		im := &imageInfo{Width: tc.w, Height: tc.h}
+		large := &imageInfo{Width: 4000, Height: 3000}
+		if got := m.thresholdFor(im, large); got != tc.want {
+			t.Errorf("threshold for %dx%d = %d, want %d", tc.w, tc.h, got, tc.want)
+		}
+	}
+
+	// Ten bits apart is a match for photos, but not for icons.
+	var a fingerprint
+	b := a
+	b[0], b[1] = 0xff, 0x03
+	for _, tc := range []struct {
+		size int
+		want bool
+	}{{32, false}, {1000, true}} {
+		x := imageInfo{Fingerprint: a, Width: tc.size, Height: tc.size}
+		y := imageInfo{Fingerprint: b, Width: tc.size, Height: tc.size}
+		if _, ok := m.similar(&x, &y); ok != tc.want {
+			t.Errorf("%dx%[1]d images 10 bits apart: similar = %v, want %v", tc.size, ok, tc.want)
+		}
+	}
+}
+
+func TestCustomDistance(t *testing.T) {
+	// A metric that counts differences in the first 64 bits twice.
+	weighted := func(a, b fingerprint) int {
+		var headA, headB fingerprint
+		copy(headA[:8], a[:8])
+		copy(headB[:8], b[:8])
+		return a.diffbits(b) + headA.diffbits(headB)
+	}
+	// b differs from a by 16 bits in its first 64, c by 16 bits after them, and d by 32 bits
+	// after them, so d only ever matches c.
+	var a fingerprint
+	b, c, d := a, a, a
+	b[0], b[1] = 0xff, 0xff
+	c[10], c[11] = 0xff, 0xff
+	d[10], d[11], d[12], d[13] = 0xff, 0xff, 0xff, 0xff
+	images := []imageInfo{{Fingerprint: a}, {Fingerprint: b}, {Fingerprint: c}, {Fingerprint: d}}
+	for _, tc := range []struct {
+		name     string
+		distance distanceFunc
+		want     string
+	}{
+		{"hamming", hamming, "map[0:[1 2] 1:[0] 2:[0 3] 3:[2]]"},
+		{"weighted", weighted, "map[0:[2] 2:[0 3] 3:[2]]"},
+	} {
+		m := &matcher{distance: tc.distance, thresholdBits: percentToBits(10)}
+		if got := fmt.Sprint(m.findMatches(context.Background(), images)); got != tc.want {
+			t.Errorf("%s: matches %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCompositeNeedsEveryHash(t *testing.T) {
+	// Each image has a first fingerprint and one extra one, as with -algorithm ahash+dhash. b is
+	// near a by the first hash and far by the second, c the other way around, and d near by both.
+	var zero, far fingerprint
+	for i := 10; i < 18; i++ {
+		far[i] = 0xff
+	}
+	near := zero
+	near[0], near[1] = 0xff, 0xff
+	nearer := zero
+	nearer[31] = 0xff
+	images := []imageInfo{
+		{Fingerprint: zero, Extra: []fingerprint{zero}},
+		{Fingerprint: near, Extra: []fingerprint{far}},
+		{Fingerprint: far, Extra: []fingerprint{zero}},
+		{Fingerprint: nearer, Extra: []fingerprint{nearer}},
+	}
+	m := &matcher{distance: hamming, thresholdBits: percentToBits(10)}
+	if got, want := fmt.Sprint(m.findMatches(context.Background(), images)), "map[0:[3] 3:[0]]"; got != want {
+		t.Errorf("matches %s, want %s", got, want)
+	}
+	// By the first hash alone, b matches too.
+	for i := range images {
+		images[i].Extra = nil
+	}
+	if got, want := fmt.Sprint(m.findMatches(context.Background(), images)), "map[0:[1 3] 1:[0 3] 3:[0 1]]"; got != want {
+		t.Errorf("with one hash, matches %s, want %s", got, want)
+	}
+}
+
+func TestFingerprintGolden(t *testing.T) {
+	var b strings.Builder
+	for _, name := range testdataImages {
+		im, err := testHasher().fingerprintImage(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		text, _ := im.Fingerprint.MarshalText()
+		fmt.Fprintf(&b, "%s\t%dx%d\t%s\n", name, im.Width, im.Height, text)
+	}
+	checkGolden(t, "fingerprints.golden", []byte(b.String()))
+}
+
+func TestFingerprintNearDuplicates(t *testing.T) {
+	fs := map[string]fingerprint{}
+	for _, name := range testdataImages {
+		im, err := testHasher().fingerprintImage(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		fs[name] = im.Fingerprint
+	}
+	threshold := percentToBits(10)
+	for _, pair := range [][2]string{{"a/waves.png", "a/waves.jpg"}, {"a/waves.png", "b/waves_small.gif"}} {
+		if d := hamming(fs[pair[0]], fs[pair[1]]); d > threshold {
+			t.Errorf("%s and %s differ by %d bits, more than the default threshold of %d", pair[0], pair[1], d, threshold)
+		}
+	}
+	for _, pair := range [][2]string{{"a/waves.png", "b/ripples.png"}, {"a/waves.png", "b/stripes.jpg"}, {"b/ripples.png", "b/stripes.jpg"}} {
+		if d := hamming(fs[pair[0]], fs[pair[1]]); d <= threshold {
+			t.Errorf("%s and %s differ by only %d bits", pair[0], pair[1], d)
+		}
+	}
+}
+
+func TestRunGolden(t *testing.T) {
+	// An empty golden means there should be no output.
+	for _, tc := range []struct {
+		golden string
+		args   []string
+		code   int
+		stderr string
+	}{
+		{"run-text.golden", []string{"testdata"}, 0, "1 not an image"},
+		{"run-text.golden", []string{"-require-color-match", "testdata"}, 0, "1 not an image"},
+		{"run-delete-list.golden", []string{"-format", "delete-list", "testdata"}, 0, "1 not an image"},
+		{"run-keep-list.golden", []string{"-format", "keep-list", "testdata/a", "testdata/b"}, 0, "1 not an image"},
+		{"run-posix-relative.golden", []string{"-posix-paths", "-base", "testdata", "-show-resolution", "testdata"}, 0, ""},
+		{"", []string{"-threshold", "0", "testdata/b"}, 0, "No duplicate groups found"},
+		{"", []string{"-format", "yaml", "testdata"}, 2, "unknown format"},
+	} {
+		t.Run(strings.Join(tc.args, " "), func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if code := run(tc.args, &stdout, &stderr); code != tc.code {
+				t.Errorf("exit status %d, want %d; stderr %q", code, tc.code, stderr.String())
+			}
+			if !strings.Contains(stderr.String(), tc.stderr) {
+				t.Errorf("stderr %q doesn't contain %q", stderr.String(), tc.stderr)
+			}
+			if tc.golden == "" {
+				if stdout.Len() > 0 {
+					t.Errorf("unexpected output %q", stdout.String())
+				}
+				return
+			}
+			checkGolden(t, tc.golden, stdout.Bytes())
+		})
+	}
+}
+
+func TestNoDuplicatesMessage(t *testing.T) {
+	dir := t.TempDir()
+	for seed := 1; seed <= 3; seed++ {
+		writeTestPNG(t, filepath.Join(dir, fmt.Sprintf("%d.png", seed)), testImage(64, 48, seed))
+	}
+	const message = "No duplicate groups found (3 images scanned)\n"
+	for _, tc := range []struct {
+		args           []string
+		stdout, stderr string
+	}{
+		{nil, "", message},
+		{[]string{"-format", "json"}, "[]\n", message},
+		{[]string{"-quiet"}, "", ""},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append(tc.args, dir)
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if stdout.String() != tc.stdout || stderr.String() != tc.stderr {
+			t.Errorf("%q: got stdout %q and stderr %q, want %q and %q", args, stdout.String(), stderr.String(), tc.stdout, tc.stderr)
+		}
+	}
+}
+
+func TestRunFlagsDontCarryOver(t *testing.T) {
+	// Each run parses its own flags, so one run's -threshold 0 doesn't leave the next without
+	// matches, and nothing is printed anywhere but the writers it is given.
+	var want bytes.Buffer
+	var stderr bytes.Buffer
+	if code := run([]string{"testdata"}, &want, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	for _, tc := range []struct {
+		args   []string
+		code   int
+		stdout bool
+		stderr string
+	}{
+		{[]string{"-threshold", "0", "testdata/b"}, 0, false, "No duplicate groups found"},
+		{[]string{"testdata"}, 0, true, ""},
+		{[]string{"-bogus", "testdata"}, 2, false, "flag provided but not defined: -bogus"},
+		{[]string{"-h"}, 0, false, "Usage of findimagedupes:"},
+		{[]string{"testdata"}, 0, true, ""},
+	} {
+		var stdout, stderr bytes.Buffer
+		if code := run(tc.args, &stdout, &stderr); code != tc.code {
+			t.Errorf("%q: exit status %d, want %d; stderr %q", tc.args, code, tc.code, stderr.String())
+		}
+		if tc.stdout && stdout.String() != want.String() {
+			t.Errorf("%q: got\n%s\nwant\n%s", tc.args, stdout.String(), want.String())
+		} else if !tc.stdout && stdout.Len() > 0 {
+			t.Errorf("%q: unexpected output %q", tc.args, stdout.String())
+		}
+		if !strings.Contains(stderr.String(), tc.stderr) {
+			t.Errorf("%q: stderr %q doesn't contain %q", tc.args, stderr.String(), tc.stderr)
+		}
+	}
+	if flag.Lookup("threshold") != nil {
+		t.Errorf("run defined -threshold on the global flag set")
+	}
+}
+
+func TestKeepPreferSeesRealPaths(t *testing.T) {
+	// -keep-prefer matches where the files are, even when -base prints them otherwise.
+	var stdout, stderr bytes.Buffer
+	args := []string{"-format", "delete-list", "-keep-prefer", "^testdata/b/", "-base", "testdata", "testdata"}
+	if code := run(args, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	if got, want := stdout.String(), "a/waves.jpg\na/waves.png\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestKeepPreferOverLargest(t *testing.T) {
+	// The copies in downloads are larger, but the ones in masters are kept; of the two in
+	// masters, -keep still chooses.
+	dir := t.TempDir()
+	for _, sub := range []string{"masters", "downloads"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestPNG(t, filepath.Join(dir, "downloads", "photo.png"), testImage(400, 300, 1))
+	writeTestPNG(t, filepath.Join(dir, "masters", "photo.png"), testImage(200, 150, 1))
+	writeTestPNG(t, filepath.Join(dir, "downloads", "scan.png"), testImage(400, 300, 2))
+	writeTestPNG(t, filepath.Join(dir, "masters", "scan-small.png"), testImage(100, 75, 2))
+	writeTestPNG(t, filepath.Join(dir, "masters", "scan.png"), testImage(200, 150, 2))
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "downloads/photo.png downloads/scan.png"},
+		{[]string{"-keep-prefer", "/masters/"}, "masters/photo.png masters/scan.png"},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append(tc.args, "-format", "keep-list", "-keep", "largest", "-base", dir, "-posix-paths", dir)
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		got := strings.Fields(stdout.String())
+		slices.Sort(got)
+		if strings.Join(got, " ") != tc.want {
+			t.Errorf("%q: kept %q, want %q", args, got, tc.want)
+		}
+	}
+}
+
+func TestTiebreakPathIgnoresArgumentOrder(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for _, name := range []string{"b.png", "a.png"} {
+		name = filepath.Join(dir, name)
+		writeTestPNG(t, name, testImage(64, 64, 1))
+		if err := os.Chtimes(name, time.Unix(1e9, 0), time.Unix(1e9, 0)); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, name)
+	}
+	for _, args := range [][]string{files, {files[1], files[0]}} {
+		var stdout, stderr bytes.Buffer
+		args = append([]string{"-format", "delete-list", "-tiebreak", "path"}, args...)
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+		}
+		if got, want := stdout.String(), files[0]+"\n"; got != want {
+			t.Errorf("%q: got %q, want %q", args, got, want)
+		}
+	}
+}
+
+func TestTiedKeeperSameAcrossRuns(t *testing.T) {
+	// Four copies with the same size and time tie under every -keep, however many files are
+	// fingerprinted at once.
+	dir := t.TempDir()
+	for _, name := range []string{"d.png", "b.png", "c.png", "a.png"} {
+		name = filepath.Join(dir, name)
+		writeTestPNG(t, name, testImage(64, 64, 1))
+		if err := os.Chtimes(name, time.Unix(1e9, 0), time.Unix(1e9, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, keep := range []string{"largest", "smallest", "newest", "oldest"} {
+		for _, tiebreak := range []string{"first-seen", "path"} {
+			for i := 0; i < 5; i++ {
+				var stdout, stderr bytes.Buffer
+				args := []string{"-format", "keep-list", "-keep", keep, "-tiebreak", tiebreak, "-jobs", "4", "-base", dir, dir}
+				if code := run(args, &stdout, &stderr); code != 0 {
+					t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+				}
+				if got := stdout.String(); got != "a.png\n" {
+					t.Fatalf("%q: run %d kept %q, want a.png", args, i+1, got)
+				}
+			}
+		}
+	}
+}
+
+func TestSinceIndexOnlyIndexesScannedFiles(t *testing.T) {
+	dir := t.TempDir()
+	exported := filepath.Join(dir, "b.jsonl")
+	index := filepath.Join(dir, "index.jsonl")
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-export-fingerprints", exported, "testdata/b"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exporting: exit status %d; stderr %q", code, stderr.String())
+	}
+	args := []string{"-since-index", index, "-import-fingerprints", exported, "testdata/a"}
+	if code := run(args, &stdout, &stderr); code != 0 {
+		t.Fatalf("indexing: exit status %d; stderr %q", code, stderr.String())
+	}
+	indexed, _, err := importFingerprints(index, testHasher().version())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, im := range indexed {
+		got = append(got, im.Path)
+	}
+	if want := []string{"testdata/a/waves.jpg", "testdata/a/waves.png"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("index has %q, want only the scanned files %q", got, want)
+	}
+}
+
+func TestHashersAreIndependent(t *testing.T) {
+	// Two hashers with different settings, used at once, share nothing but the pools of
+	// intermediate images, and each gives what it gives on its own.
+	plain := testHasher()
+	tuned := &hasher{intermediateSize: 96, blurRadius: 0, posterize: 4, denoise: true}
+	tuned.algorithmNames, tuned.hashes, _ = parseAlgorithms("dhash+edgehash")
+	var images []image.Image
+	for seed := 0; seed < 6; seed++ {
+		images = append(images, testImage(80+seed*9, 60+seed*5, seed))
+	}
+	fingerprintAll := func(h *hasher) [][]fingerprint {
+		var all [][]fingerprint
+		for _, im := range images {
+			fs, err := h.fingerprintDecoded(im)
+			if err != nil {
+				t.Error(err)
+			}
+			all = append(all, fs)
+		}
+		return all
+	}
+	wantPlain, wantTuned := fingerprintAll(plain), fingerprintAll(tuned)
+	if fmt.Sprint(wantPlain) == fmt.Sprint(wantTuned) {
+		t.Fatal("the two hashers give the same fingerprints, so the test can't tell them apart")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		h, want := plain, wantPlain
+		if i%2 == 1 {
+			h, want = tuned, wantTuned
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 2; j++ {
+				if got := fingerprintAll(h); fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Errorf("fingerprints with %s changed when used alongside another hasher", h.version())
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// BenchmarkFingerprint measures the pipeline after decoding, where reusing intermediate images
+// saves most of the allocation, and the whole of fingerprintImage, decoding included.
+func BenchmarkFingerprint(b *testing.B) {
+	b.Run("decoded", func(b *testing.B) {
+		h := testHasher()
+		im := testImage(640, 480, 2)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := h.fingerprintDecoded(im); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("file", func(b *testing.B) {
+		h := testHasher()
+		name := filepath.Join("testdata", testdataImages[0])
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := h.fingerprintImage(name); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestSummaryJSONCounts(t *testing.T) {
+	dir := t.TempDir()
+	exported := filepath.Join(dir, "b.jsonl")
+	index := filepath.Join(dir, "index.jsonl")
+	summaryFile := filepath.Join(dir, "summary.json")
+	readSummary := func() runSummary {
+		t.Helper()
+		data, err := os.ReadFile(summaryFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s runSummary
+		if err := json.Unmarshal(data, &s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-export-fingerprints", exported, "testdata/b"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exporting: exit status %d; stderr %q", code, stderr.String())
+	}
+
+	// The first run fingerprints testdata/a and imports testdata/b; the second finds testdata/a
+	// in the index.
+	for _, want := range []runSummary{{Scanned: 2, Imported: 3}, {Reused: 2, Imported: 3}} {
+		args := []string{"-summary-json", summaryFile, "-since-index", index, "-import-fingerprints", exported, "testdata/a"}
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+		}
+		got := readSummary()
+		if got.Scanned != want.Scanned || got.Reused != want.Reused || got.Imported != want.Imported {
+			t.Errorf("scanned, reused, imported = %d, %d, %d, want %d, %d, %d",
+				got.Scanned, got.Reused, got.Imported, want.Scanned, want.Reused, want.Imported)
+		}
+	}
+}
+
+func TestMaxDurationMarksPartial(t *testing.T) {
+	summaryFile := filepath.Join(t.TempDir(), "summary.json")
+	for _, tc := range []struct {
+		args    []string
+		partial bool
+	}{
+		{nil, false},
+		{[]string{"-max-duration", "1ns"}, true},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append(tc.args, "-format", "json", "-summary-json", summaryFile, "testdata")
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		data, err := os.ReadFile(summaryFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var summary runSummary
+		if err := json.Unmarshal(data, &summary); err != nil {
+			t.Fatal(err)
+		}
+		var groups []group
+		if err := json.Unmarshal(stdout.Bytes(), &groups); err != nil {
+			t.Fatal(err)
+		}
+		if summary.Partial != tc.partial {
+			t.Errorf("%q: -summary-json has partial %v, want %v", args, summary.Partial, tc.partial)
+		}
+		for _, g := range groups {
+			if g.Partial != tc.partial {
+				t.Errorf("%q: group %d has partial %v, want %v", args, g.ID, g.Partial, tc.partial)
+			}
+		}
+	}
+
+	// A partial group says so in JSON; a complete one leaves it out.
+	for _, partial := range []bool{false, true} {
+		var buf bytes.Buffer
+		w := &jsonlWriter{enc: json.NewEncoder(&buf)}
+		if err := w.writeGroup(&group{ID: 1, Members: []groupMember{{Path: "a.png"}}, Partial: partial}); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Contains(buf.String(), `"partial":true`); got != partial {
+			t.Errorf("partial %v: JSON %s", partial, buf.String())
+		}
+	}
+}
+
+func TestNearestFindsNearCopy(t *testing.T) {
+	dir := t.TempDir()
+	original := testImage(120, 90, 1)
+	writeTestPNG(t, filepath.Join(dir, "a.png"), original)
+	writeTestPNG(t, filepath.Join(dir, "b.png"), testImage(120, 90, 2))
+	writeTestPNG(t, filepath.Join(dir, "c.png"), testImage(120, 90, 3))
+	writeTestPNG(t, filepath.Join(dir, "d.png"), nearCopy(original))
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-nearest", "2", "-base", dir, dir}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	// Each image's list is its two closest, in order, with their distances.
+	nearest, distances := map[string][]string{}, map[string][]int{}
+	for _, block := range strings.Split(strings.TrimSpace(stdout.String()), "\n\n") {
+		lines := strings.Split(block, "\n")
+		name := strings.TrimSuffix(strings.TrimPrefix(lines[0], "Nearest to "), ":")
+		for _, line := range lines[1:] {
+			var d int
+			var path string
+			if _, err := fmt.Sscanf(line, "%d\t%s", &d, &path); err != nil {
+				t.Fatalf("line %q: %v", line, err)
+			}
+			nearest[name] = append(nearest[name], path)
+			distances[name] = append(distances[name], d)
+		}
+	}
+	if len(nearest) != 4 {
+		t.Fatalf("got neighbors of %d images, want 4:\n%s", len(nearest), stdout.String())
+	}
+	for name, paths := range nearest {
+		if len(paths) != 2 || distances[name][0] > distances[name][1] {
+			t.Errorf("%s: nearest %q at %v, want two, closest first", name, paths, distances[name])
+		}
+	}
+	if nearest["a.png"][0] != "d.png" || nearest["d.png"][0] != "a.png" {
+		t.Errorf("nearest to a.png is %q and to d.png %q, want each other", nearest["a.png"][0], nearest["d.png"][0])
+	}
+}
+
+func TestSkipSolid(t *testing.T) {
+	dir := t.TempDir()
+	im := testImage(120, 90, 1)
+	writeTestPNG(t, filepath.Join(dir, "a.png"), im)
+	writeTestPNG(t, filepath.Join(dir, "b.png"), im)
+	// Two flat gray images, which match each other, and one with a little noise, as from a scan
+	// of a blank page.
+	for i, name := range []string{"gray.png", "gray2.png", "noisy.png"} {
+		solid := image.NewGray(image.Rect(0, 0, 100, 100))
+		for j := range solid.Pix {
+			solid.Pix[j] = uint8(128 + i/2*(j*7%5))
+		}
+		writeTestPNG(t, filepath.Join(dir, name), solid)
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "Possible matches: a.png b.png Possible matches: gray.png gray2.png"},
+		{[]string{"-skip-solid"}, "Possible matches: a.png b.png"},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append(tc.args, "-base", dir, dir)
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if got := strings.Join(strings.Fields(stdout.String()), " "); got != tc.want {
+			t.Errorf("%q: got %q, want %q", args, got, tc.want)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-skip-solid", "-verbose", dir}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	for _, name := range []string{"gray.png", "gray2.png", "noisy.png"} {
+		if want := "Skipping solid color image " + filepath.Join(dir, name); !strings.Contains(stdout.String(), want) {
+			t.Errorf("-verbose output doesn't contain %q:\n%s", want, stdout.String())
+		}
+	}
+}
+
+func TestJSONLinesParseOnTheirOwn(t *testing.T) {
+	dir := t.TempDir()
+	for seed, names := range [][]string{1: {"a1.png", "a2.png"}, 2: {"b1.png", "b2.png", "b3.png"}} {
+		for _, name := range names {
+			writeTestPNG(t, filepath.Join(dir, name), testImage(100, 80, seed))
+		}
+	}
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-format", "jsonl", "-base", dir, dir}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	lines := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want one per group:\n%s", len(lines), stdout.String())
+	}
+	for i, line := range lines {
+		var g group
+		if err := json.Unmarshal([]byte(line), &g); err != nil {
+			t.Fatalf("line %d: %v", i+1, err)
+		}
+		if g.ID != i+1 || len(g.Members) != i+2 {
+			t.Errorf("line %d: group %d of %d members, want group %d of %d", i+1, g.ID, len(g.Members), i+1, i+2)
+		}
+	}
+}
+
+func TestShowOriginAttributesRoots(t *testing.T) {
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first"), filepath.Join(dir, "second")
+	for _, root := range []string{first, second} {
+		if err := os.Mkdir(root, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestPNG(t, filepath.Join(first, "a.png"), testImage(100, 80, 1))
+	writeTestPNG(t, filepath.Join(second, "b.png"), testImage(100, 80, 1))
+	writeTestPNG(t, filepath.Join(second, "c.png"), testImage(100, 80, 1))
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-show-origin", first, second}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	want := fmt.Sprintf("Possible matches:\n%s [from %s]\n%s [from %s]\n%s [from %s]\n\n",
+		filepath.Join(first, "a.png"), first, filepath.Join(second, "b.png"), second, filepath.Join(second, "c.png"), second)
+	if got := stdout.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// JSON records the argument's position instead.
+	stdout.Reset()
+	if code := run([]string{"-format", "json", "-base", dir, first, second}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	var groups []group
+	if err := json.Unmarshal(stdout.Bytes(), &groups); err != nil {
+		t.Fatal(err)
+	}
+	origins := map[string]int{}
+	for _, g := range groups {
+		for _, member := range g.Members {
+			origins[member.Path] = member.Origin
+		}
+	}
+	if want := map[string]int{"first/a.png": 1, "second/b.png": 2, "second/c.png": 2}; fmt.Sprint(origins) != fmt.Sprint(want) {
+		t.Errorf("origins %v, want %v", origins, want)
+	}
+}
+
+func TestSummaryOnlyCounts(t *testing.T) {
+	dir := t.TempDir()
+	for seed, names := range [][]string{1: {"a1.png", "a2.png", "a3.png"}, 2: {"b1.png", "b2.png"}, 3: {"c.png"}} {
+		for _, name := range names {
+			writeTestPNG(t, filepath.Join(dir, name), testImage(100, 80, seed))
+		}
+	}
+	size := func(name string) int64 {
+		t.Helper()
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+	// Copies are the same size, so every copy but one is reclaimable.
+	reclaimable := 2*size("a1.png") + size("b1.png")
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-summary-only", dir}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	want := fmt.Sprintf("2 duplicate groups covering 5 files, %d bytes reclaimable\n", reclaimable)
+	if got := stdout.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTemplateCountsMembers(t *testing.T) {
+	dir := t.TempDir()
+	for seed, names := range [][]string{1: {"a1.png", "a2.png"}, 2: {"b1.png", "b2.png", "b3.png"}} {
+		for _, name := range names {
+			writeTestPNG(t, filepath.Join(dir, name), testImage(100, 80, seed))
+		}
+	}
+	var stdout, stderr bytes.Buffer
+	args := []string{"-template", "{{.ID}}: {{len .Members}} {{(index .Members 0).Width}}x{{(index .Members 0).Height}}", dir}
+	if code := run(args, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	if got, want := stdout.String(), "1: 2 100x80\n2: 3 100x80\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// flakyReader reads r until it runs out, then fails with err instead of io.EOF, like a
+// connection dropped partway through a file.
+type flakyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (f flakyReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		err = f.err
+	}
+	return n, err
+}
+
+func TestIORetriesOutlastTransientErrors(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(100, 80, 1)); err != nil {
+		t.Fatal(err)
+	}
+	want, err := testHasher().fingerprintReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		retries int
+		err     error
+		ok      bool
+	}{
+		{2, syscall.EAGAIN, true},
+		{1, syscall.EAGAIN, false},
+		{2, syscall.EIO, false},
+	} {
+		h := testHasher()
+		h.ioRetries = tc.retries
+		// The first two attempts fail.
+		attempts := 0
+		got, err := h.retry(func() (imageInfo, error) {
+			attempts++
+			if attempts <= 2 {
+				return h.fingerprintReader(flakyReader{bytes.NewReader(buf.Bytes()[:buf.Len()/2]), tc.err})
+			}
+			return h.fingerprintReader(bytes.NewReader(buf.Bytes()))
+		})
+		if tc.ok && (err != nil || got.Fingerprint != want.Fingerprint) {
+			t.Errorf("%d retries of %v: got %v, %v, want the fingerprint", tc.retries, tc.err, got.Fingerprint, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%d retries of %v: succeeded after %d attempts, want an error", tc.retries, tc.err, attempts)
+		}
+	}
+}
+
+func TestRelativePathsInEveryFormat(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{filepath.Join("x", "y", "a.png"), filepath.Join("z", "b.png")} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		writeTestPNG(t, filepath.Join(dir, name), testImage(100, 80, 1))
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// -relative prints paths relative to the working directory, which is x.
+	if err := os.Chdir(filepath.Join(dir, "x")); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chdir(wd) }()
+
+	both := []string{"x/y/a.png", "z/b.png"}
+	for _, tc := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"-base", dir}, both},
+		{[]string{"-base", dir, "-format", "json"}, both},
+		{[]string{"-base", dir, "-format", "jsonl"}, both},
+		{[]string{"-base", dir, "-format", "delete-list", "-keep-prefer", "/z/"}, both[:1]},
+		{[]string{"-base", dir, "-format", "keep-list", "-keep-prefer", "/x/"}, both[:1]},
+		{[]string{"-relative"}, []string{"y/a.png", "../z/b.png"}},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append(tc.args, dir)
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		for _, path := range tc.want {
+			if !strings.Contains(stdout.String(), path) {
+				t.Errorf("%q: output doesn't contain %q:\n%s", args, path, stdout.String())
+			}
+		}
+		if strings.Contains(stdout.String(), dir) {
+			t.Errorf("%q: output has absolute paths:\n%s", args, stdout.String())
+		}
+	}
+}
+
+func TestGroupByPrefixKeepsVideosApart(t *testing.T) {
+	dir := t.TempDir()
+	// The first keyframes of both videos are the same image.
+	for name, seed := range map[string]int{"clip_a-0001.png": 1, "clip_a-0002.png": 1, "clip_b-0001.png": 1, "clip_b-0002.png": 2} {
+		writeTestPNG(t, filepath.Join(dir, name), testImage(100, 80, seed))
+	}
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "Possible matches: clip_a-0001.png clip_a-0002.png clip_b-0001.png"},
+		{[]string{"-group-by-prefix"}, "Possible matches: clip_a-0001.png clip_a-0002.png"},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append(tc.args, "-base", dir, dir)
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if got := strings.Join(strings.Fields(stdout.String()), " "); got != tc.want {
+			t.Errorf("%q: got %q, want %q", args, got, tc.want)
+		}
+	}
+}
+
+func TestFilePrefix(t *testing.T) {
+	for path, want := range map[string]string{
+		"a/clip-0001.jpg":   "a/clip",
+		"a/clip_12.png":     "a/clip",
+		"clip 3.jpeg":       "clip",
+		"b/intro2outro.png": "b/intro2outro",
+		"b/0042.png":        "b",
+	} {
+		if got := filePrefix(path); got != want {
+			t.Errorf("filePrefix(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestWarnIdenticalFingerprintsOfDifferentSizes(t *testing.T) {
+	dir := t.TempDir()
+	solid := func(size int) *image.RGBA {
+		im := image.NewRGBA(image.Rect(0, 0, size, size))
+		draw.Draw(im, im.Bounds(), image.NewUniform(color.Gray{Y: 90}), image.Point{}, draw.Src)
+		return im
+	}
+	writeTestPNG(t, filepath.Join(dir, "small.png"), solid(8))
+	// Left uncompressed, the large one is many times the size of the small one.
+	f, err := os.Create(filepath.Join(dir, "large.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&png.Encoder{CompressionLevel: png.NoCompression}).Encode(f, solid(200)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, verbose := range []bool{false, true} {
+		var stdout, stderr bytes.Buffer
+		args := []string{"-base", dir, dir}
+		if verbose {
+			args = append([]string{"-verbose"}, args...)
+		}
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if !strings.Contains(stdout.String(), "large.png\nsmall.png\n") {
+			t.Fatalf("%q: the solid images don't match:\n%s", args, stdout.String())
+		}
+		if got := strings.Contains(stderr.String(), "Warning: group 1 has identical fingerprints"); got != verbose {
+			t.Errorf("%q: stderr %q, want a warning: %v", args, stderr.String(), verbose)
+		}
+	}
+}
+
+func TestIntermediateSizeChangesFingerprints(t *testing.T) {
+	// Fingerprints made at one intermediate size can't be compared with those made at another,
+	// so the size is part of the version that caches and indexes are checked against.
+	sizes := []int{hashSize, 64, 160, 400}
+	versions := map[string]bool{}
+	fingerprints := make([][]fingerprint, len(sizes))
+	for i, size := range sizes {
+		h := testHasher()
+		h.intermediateSize = size
+		versions[h.version()] = true
+		for _, name := range testdataImages {
+			im, err := h.fingerprintImage(filepath.Join("testdata", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			fingerprints[i] = append(fingerprints[i], im.Fingerprint)
+		}
+	}
+	if len(versions) != len(sizes) {
+		t.Errorf("%d intermediate sizes have only %d versions", len(sizes), len(versions))
+	}
+	for i := range sizes {
+		for j := i + 1; j < len(sizes); j++ {
+			if fmt.Sprint(fingerprints[i]) == fmt.Sprint(fingerprints[j]) {
+				t.Errorf("intermediate sizes %d and %d give the same fingerprints", sizes[i], sizes[j])
+			}
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-intermediate-size", fmt.Sprint(hashSize - 1), "testdata"}, &stdout, &stderr); code != 2 {
+		t.Errorf("-intermediate-size %d: exit status %d, want 2", hashSize-1, code)
+	}
+}
+
+func TestIgnoreFingerprintsDropsAvatars(t *testing.T) {
+	dir := t.TempDir()
+	avatar := testImage(160, 120, 3)
+	writeTestPNG(t, filepath.Join(dir, "avatar1.png"), avatar)
+	writeTestPNG(t, filepath.Join(dir, "avatar2.png"), nearCopy(avatar))
+	writeTestPNG(t, filepath.Join(dir, "photo1.png"), testImage(100, 80, 1))
+	writeTestPNG(t, filepath.Join(dir, "photo2.png"), testImage(100, 80, 1))
+
+	// The denylist has the avatar as it was first saved; its touched-up copy is near enough.
+	im, err := testHasher().fingerprintImage(filepath.Join(dir, "avatar1.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, _ := im.Fingerprint.MarshalText()
+	denylist := filepath.Join(t.TempDir(), "ignore.txt")
+	if err := os.WriteFile(denylist, append(text, " default avatar\n"...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "Possible matches: avatar1.png avatar2.png Possible matches: photo1.png photo2.png"},
+		{[]string{"-ignore-fingerprints", denylist}, "Possible matches: photo1.png photo2.png"},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append(tc.args, "-base", dir, dir)
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if got := strings.Join(strings.Fields(stdout.String()), " "); got != tc.want {
+			t.Errorf("%q: got %q, want %q", args, got, tc.want)
+		}
+	}
+}
+
+func TestHiddenFilesSkippedByDefault(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, ".thumbnails"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.png", ".b.png", filepath.Join(".thumbnails", "a.png")} {
+		writeTestPNG(t, filepath.Join(dir, name), testImage(100, 80, 1))
+	}
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{dir}, ""},
+		{[]string{"-include-hidden", dir}, "Possible matches: .b.png .thumbnails/a.png a.png"},
+		// A hidden directory given by name is scanned all the same.
+		{[]string{dir, filepath.Join(dir, ".thumbnails")}, "Possible matches: a.png .thumbnails/a.png"},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append([]string{"-base", dir}, tc.args...)
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if got := strings.Join(strings.Fields(stdout.String()), " "); got != tc.want {
+			t.Errorf("%q: got %q, want %q", args, got, tc.want)
+		}
+	}
+}
+
+func TestNoTransitiveReportsPairs(t *testing.T) {
+	// a is 16 bits from b, and b 16 bits from c, but a is 32 bits from c, too far to match.
+	var a fingerprint
+	b, c := a, a
+	b[0], b[1] = 0xff, 0xff
+	c[0], c[1], c[2], c[3] = 0xff, 0xff, 0xff, 0xff
+	exported := filepath.Join(t.TempDir(), "chain.jsonl")
+	images := []imageInfo{{Path: "a.png", Fingerprint: a}, {Path: "b.png", Fingerprint: b}, {Path: "c.png", Fingerprint: c}}
+	if err := exportFingerprints(exported, images, testHasher().version(), "hex"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "Possible matches:\na.png\nb.png\nc.png\n\n"},
+		{[]string{"-no-transitive"}, "Possible matches:\na.png\nb.png\n\nPossible matches:\nb.png\nc.png\n\n"},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append(tc.args, "-import-fingerprints", exported)
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if got := stdout.String(); got != tc.want {
+			t.Errorf("%q: got\n%s\nwant\n%s", args, got, tc.want)
+		}
+	}
+}
+
+func TestMaxGroupDiameterSplitsChain(t *testing.T) {
+	// Each of a, b, c, and d is 12 bits from the next, so a is 36 bits from d, over the 26 bits
+	// of -max-group-diameter 10.
+	chain := make([]fingerprint, 4)
+	for i := range chain {
+		for bit := 0; bit < 12*i; bit++ {
+			chain[i][bit/8] |= 1 << (bit % 8)
+		}
+	}
+	var images []imageInfo
+	for i, f := range chain {
+		images = append(images, imageInfo{Path: fmt.Sprintf("%c.png", 'a'+i), Fingerprint: f})
+	}
+	exported := filepath.Join(t.TempDir(), "chain.jsonl")
+	if err := exportFingerprints(exported, images, testHasher().version(), "hex"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "Possible matches:\na.png\nb.png\nc.png\nd.png\n\n"},
+		// d is left on its own, too far from a to join the others.
+		{[]string{"-max-group-diameter", "10"}, "Possible matches:\na.png\nb.png\nc.png\n\n"},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append(tc.args, "-import-fingerprints", exported)
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if got := stdout.String(); got != tc.want {
+			t.Errorf("%q: got\n%s\nwant\n%s", args, got, tc.want)
+		}
+	}
+}
+
+func TestRequireColorMatchSplitsGrayscaleCopy(t *testing.T) {
+	// The fingerprint only sees brightness, so a color photo and a grayscale copy of it match
+	// unless their colors are compared too.
+	dir := t.TempDir()
+	im := testImage(100, 80, 1)
+	gray := image.NewGray(im.Bounds())
+	draw.Draw(gray, gray.Bounds(), im, image.Point{}, draw.Src)
+	writeTestPNG(t, filepath.Join(dir, "color.png"), im)
+	writeTestPNG(t, filepath.Join(dir, "gray.png"), gray)
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "Possible matches: color.png gray.png"},
+		{[]string{"-require-color-match"}, ""},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append(tc.args, "-quiet", "-base", dir, dir)
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if got := strings.Join(strings.Fields(stdout.String()), " "); got != tc.want {
+			t.Errorf("%q: got %q, want %q", args, got, tc.want)
+		}
+	}
+}
+
+func TestKeepListOnePerGroupAndSingletons(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPNG(t, filepath.Join(dir, "large.png"), testImage(200, 160, 1))
+	writeTestPNG(t, filepath.Join(dir, "small.png"), testImage(100, 80, 1))
+	writeTestPNG(t, filepath.Join(dir, "photo.png"), testImage(100, 80, 2))
+	writeTestPNG(t, filepath.Join(dir, "photo-edited.png"), nearCopy(testImage(100, 80, 2)))
+	writeTestPNG(t, filepath.Join(dir, "only.png"), testImage(100, 80, 3))
+	writeTestPNG(t, filepath.Join(dir, "alone.png"), testImage(100, 80, 4))
+
+	var stdout, stderr bytes.Buffer
+	args := []string{"-format", "keep-list", "-keep", "largest", "-keep-prefer", "edited", "-base", dir, dir}
+	if code := run(args, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	got := strings.Fields(stdout.String())
+	slices.Sort(got)
+	// Two groups and two singletons make four files to keep: the largest of one group, the
+	// preferred file of the other, and both singletons.
+	want := []string{"alone.png", "large.png", "only.png", "photo-edited.png"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSameExtOnlyKeepsFormatsApart(t *testing.T) {
+	dir := t.TempDir()
+	im := testImage(160, 120, 1)
+	writeTestPNG(t, filepath.Join(dir, "photo.png"), im)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, im, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	// Extensions are compared ignoring case, so the two JPEGs are still compared.
+	for _, name := range []string{"photo.jpg", "copy.JPG"} {
+		if err := os.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "Possible matches: copy.JPG photo.jpg photo.png"},
+		{[]string{"-same-ext-only"}, "Possible matches: copy.JPG photo.jpg"},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append(tc.args, "-quiet", "-base", dir, dir)
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if got := strings.Join(strings.Fields(stdout.String()), " "); got != tc.want {
+			t.Errorf("%q: got %q, want %q", args, got, tc.want)
+		}
+	}
+}
+
+func TestPosterizeMatchRateOnNoisyScans(t *testing.T) {
+	// Pages of text scanned twice each, with different noise in each scan.
+	page := func(seed int64) *image.Gray {
+		im := image.NewGray(image.Rect(0, 0, 160, 160))
+		rng := rand.New(rand.NewSource(seed))
+		for i := range im.Pix {
+			im.Pix[i] = 230
+		}
+		for line := 0; line < 8; line++ {
+			y, w := 10+line*18, 60+rng.Intn(80)
+			for yy := y; yy < y+8; yy++ {
+				for x := 10; x < 10+w; x++ {
+					im.Pix[yy*160+x] = 40
+				}
+			}
+		}
+		return im
+	}
+	scan := func(im *image.Gray, seed int64) *image.Gray {
+		out := image.NewGray(im.Bounds())
+		rng := rand.New(rand.NewSource(seed))
+		for i, v := range im.Pix {
+			out.Pix[i] = uint8(max(0, min(255, int(v)+rng.Intn(41)-20)))
+		}
+		return out
+	}
+	matchRate := func(levels int) int {
+		h := testHasher()
+		h.posterize = levels
+		matched := 0
+		for seed := int64(0); seed < 10; seed++ {
+			a, err := h.fingerprintDecoded(scan(page(seed), 2*seed+100))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := h.fingerprintDecoded(scan(page(seed), 2*seed+101))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a[0].diffbits(b[0]) < percentToBits(10) {
+				matched++
+			}
+		}
+		return matched
+	}
+	full, posterized := matchRate(256), matchRate(16)
+	t.Logf("noisy scans matched: %d of 10 at 256 levels, %d of 10 at 16 levels", full, posterized)
+	if posterized < full || posterized < 8 {
+		t.Errorf("16 levels matched %d of 10 noisy scans, want at least the %d that 256 levels matched, and at least 8", posterized, full)
+	}
+}
+
+func TestMaxGroupsKeepsLargestSavings(t *testing.T) {
+	// Groups of 2, 3, 4, and 2 copies of images of about the same size, so deleting the
+	// duplicates of the groups of 4 and 3 frees the most.
+	dir := t.TempDir()
+	for seed, copies := range map[int]int{1: 2, 2: 3, 3: 4, 4: 2} {
+		for i := 0; i < copies; i++ {
+			writeTestPNG(t, filepath.Join(dir, fmt.Sprintf("%d-%d.png", seed, i)), testImage(100, 80, seed))
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	args := []string{"-max-groups", "2", "-format", "json", "-base", dir, dir}
+	if code := run(args, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	var groups []group
+	if err := json.Unmarshal(stdout.Bytes(), &groups); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, g := range groups {
+		got = append(got, fmt.Sprintf("%s:%d", strings.Split(g.Members[0].Path, "-")[0], len(g.Members)))
+	}
+	slices.Sort(got)
+	if want := []string{"2:3", "3:4"}; !slices.Equal(got, want) {
+		t.Errorf("got groups %q, want %q", got, want)
+	}
+	if want := "2 more groups not shown"; !strings.Contains(stderr.String(), want) {
+		t.Errorf("stderr %q doesn't contain %q", stderr.String(), want)
+	}
+}
+
+func TestQuadrantMatchExcludesCornerDifference(t *testing.T) {
+	// b differs from a by 20 bits, all in the top left quarter, and c by 20 bits spread over
+	// all four quarters. Both are under the threshold of 26 bits, but 20 is too many for one
+	// quarter, whose limit is 13.
+	var a fingerprint
+	b, c := a, a
+	for i := 0; i < 20; i++ {
+		b.setBit(i%8, i/8)
+	}
+	for q := 0; q < 4; q++ {
+		for i := 0; i < 5; i++ {
+			c.setBit(q%2*8+i, q/2*8+7)
+		}
+	}
+	exported := filepath.Join(t.TempDir(), "quadrants.jsonl")
+	images := []imageInfo{{Path: "a.png", Fingerprint: a}, {Path: "b.png", Fingerprint: b}, {Path: "c.png", Fingerprint: c}}
+	if err := exportFingerprints(exported, images, testHasher().version(), "hex"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "Possible matches: a.png b.png c.png"},
+		{[]string{"-quadrant-match"}, "Possible matches: a.png c.png"},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append(tc.args, "-import-fingerprints", exported)
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if got := strings.Join(strings.Fields(stdout.String()), " "); got != tc.want {
+			t.Errorf("%q: got %q, want %q", args, got, tc.want)
+		}
+	}
+}
+
+func TestShowResolutionOfScaledCopies(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPNG(t, filepath.Join(dir, "photo.png"), testImage(1920, 1080, 1))
+	writeTestPNG(t, filepath.Join(dir, "photo-720p.png"), testImage(1280, 720, 1))
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-show-resolution", "-base", dir, dir}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	if got, want := stdout.String(), "Possible matches:\nphoto-720p.png (1280x720)\nphoto.png (1920x1080)\n\n"; got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
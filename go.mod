@@ -1,3 +1,7 @@
 module github.com/swenson/findimagedupes
 
 go 1.21
+
+require github.com/fsnotify/fsnotify v1.7.0
+
+require golang.org/x/sys v0.5.0 // indirect
@@ -0,0 +1,150 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+)
+
+// hashFunc reduces an equalized grayscale image to a fingerprint.
+type hashFunc func(im image.Image) fingerprint
+
+// algorithms are the hashes that -algorithm can combine, by name.
+var algorithms = map[string]hashFunc{
+	"ahash":    medianHash,
+	"dhash":    differenceHash,
+	"edgehash": edgeHash,
+}
+
+// parseAlgorithms parses a list of algorithm names joined by "+", like "ahash+dhash", ignoring case.
+func parseAlgorithms(spec string) ([]string, []hashFunc, error) {
+	var names []string
+	var hashes []hashFunc
+	for _, name := range strings.Split(strings.ToLower(spec), "+") {
+		name = strings.TrimSpace(name)
+		hash, ok := algorithms[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown -algorithm %q; use ahash, dhash, edgehash, or several joined by +", name)
+		}
+		names = append(names, name)
+		hashes = append(hashes, hash)
+	}
+	return names, hashes, nil
+}
+
+// medianHash reduces the image to 16x16 and sets the pixels darker than the median, so about half
+// of the bits are set for any image.
+func medianHash(im image.Image) fingerprint {
+	im = resampleGray(im, hashSize, hashSize)
+	defer release(im)
+	cutoff := median(im)
+	gray := im.(*image.Gray)
+	var f fingerprint
+	for y := 0; y < hashSize; y++ {
+		for x := 0; x < hashSize; x++ {
+			if float64(gray.GrayAt(x, y).Y) < cutoff {
+				f.setBit(x, y)
+			}
+		}
+	}
+	return f
+}
+
+// multiscaleMargin is how many times larger the medianMargin of an image reduced to half of
+// -intermediate-size must be for -multiscale to hash it instead. Equalized images all have
+// margins close to a quarter of the gray levels, so smaller differences are mostly noise.
+const multiscaleMargin = 1.05
+
+// medianMargin is how far the pixels of an image reduced to 16x16 are from its median, on
+// average: the larger it is, the more a pixel has to change to flip a bit of medianHash.
+func medianMargin(im image.Image) float64 {
+	im = resampleGray(im, hashSize, hashSize)
+	defer release(im)
+	cutoff := median(im)
+	gray := im.(*image.Gray)
+	var sum float64
+	for y := 0; y < hashSize; y++ {
+		for x := 0; x < hashSize; x++ {
+			sum += math.Abs(float64(gray.GrayAt(x, y).Y) - cutoff)
+		}
+	}
+	return sum / (hashSize * hashSize)
+}
+
+// differenceHash reduces the image to 17x16 and sets the pixels darker than the pixel to their
+// right, so it follows the gradients of the image rather than its overall brightness.
+func differenceHash(im image.Image) fingerprint {
+	im = resampleGray(im, hashSize+1, hashSize)
+	defer release(im)
+	gray := im.(*image.Gray)
+	var f fingerprint
+	for y := 0; y < hashSize; y++ {
+		for x := 0; x < hashSize; x++ {
+			if gray.GrayAt(x, y).Y < gray.GrayAt(x+1, y).Y {
+				f.setBit(x, y)
+			}
+		}
+	}
+	return f
+}
+
+// edgeHash finds the edges in the image with sobel and sets the 16x16 areas with more edges than
+// the median, so that it follows the shapes in the image rather than its areas of light and dark.
+// Edges are thin, so each area is averaged rather than sampled at one pixel.
+func edgeHash(im image.Image) fingerprint {
+	edges := sobel(im).(*image.Gray)
+	defer release(edges)
+	b := edges.Bounds()
+	sums := newGray(image.Rect(0, 0, hashSize, hashSize))
+	defer release(sums)
+	for y := 0; y < hashSize; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/hashSize, b.Min.Y+(y+1)*b.Dy()/hashSize
+		for x := 0; x < hashSize; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/hashSize, b.Min.X+(x+1)*b.Dx()/hashSize
+			sum, n := 0, 0
+			for yy := y0; yy < y1; yy++ {
+				for xx := x0; xx < x1; xx++ {
+					sum += int(edges.GrayAt(xx, yy).Y)
+					n++
+				}
+			}
+			sums.SetGray(x, y, color.Gray{Y: uint8(sum / max(1, n))})
+		}
+	}
+	cutoff := median(sums)
+	var f fingerprint
+	for y := 0; y < hashSize; y++ {
+		for x := 0; x < hashSize; x++ {
+			if float64(sums.GrayAt(x, y).Y) > cutoff {
+				f.setBit(x, y)
+			}
+		}
+	}
+	return f
+}
+
+// sobel returns the strength of the edge at each pixel of a grayscale image, by the Sobel operator.
+// Pixels past the edges repeat the nearest ones.
+func sobel(im image.Image) image.Image {
+	gray := im.(*image.Gray)
+	b := gray.Bounds()
+	at := func(x, y int) int {
+		x = min(max(x, b.Min.X), b.Max.X-1)
+		y = min(max(y, b.Min.Y), b.Max.Y-1)
+		return int(gray.GrayAt(x, y).Y)
+	}
+	newim := newGray(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			gx := at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1)
+			gy := at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1)
+			// The largest possible magnitude is 4*255*sqrt(2).
+			g := math.Hypot(float64(gx), float64(gy)) / (4 * math.Sqrt2)
+			newim.SetGray(x, y, color.Gray{Y: uint8(min(255, g))})
+		}
+	}
+	return newim
+}
@@ -0,0 +1,235 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gradient is a size×size image that brightens from left to right, by one level a pixel, with a
+// jump of step levels halfway across.
+func gradient(size, step int) *image.Gray {
+	im := image.NewGray(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			v := x
+			if x >= size/2 {
+				v += step
+			}
+			im.SetGray(x, y, color.Gray{Y: uint8(v)})
+		}
+	}
+	return im
+}
+
+func TestEdgeHashSmoothGradient(t *testing.T) {
+	// A steady gradient is the same edge strength everywhere, so no area has more than the median.
+	if f := edgeHash(gradient(160, 0)); f != (fingerprint{}) {
+		t.Errorf("edgeHash of a smooth gradient = %v, want no bits set", f)
+	}
+}
+
+func TestEdgeHashStep(t *testing.T) {
+	// The only edge stronger than the gradient is the jump, between columns 7 and 8.
+	f := edgeHash(gradient(160, 60))
+	for y := 0; y < hashSize; y++ {
+		for x := 0; x < hashSize; x++ {
+			if want := x == 7 || x == 8; f.bit(x, y) != want {
+				t.Errorf("bit (%d, %d) = %v, want %v", x, y, f.bit(x, y), want)
+			}
+		}
+	}
+}
+
+func TestFingerprintDecodedMatchesFile(t *testing.T) {
+	// An image built in memory gets the same fingerprints as the file it is saved to.
+	h := testHasher()
+	h.algorithmNames, h.hashes, _ = parseAlgorithms("ahash+edgehash")
+	im := gradient(200, 60)
+	fs, err := h.fingerprintDecoded(im)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, im); err != nil {
+		t.Fatal(err)
+	}
+	info, err := h.fingerprintReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fs) != 2 || fs[0] != info.Fingerprint || len(info.Extra) != 1 || fs[1] != info.Extra[0] {
+		t.Errorf("fingerprintDecoded = %v, but the PNG of the same image gives %v and %v", fs, info.Fingerprint, info.Extra)
+	}
+}
+
+func TestCLAHEStableUnderLightingGradient(t *testing.T) {
+	// The same scene lit unevenly, from 30% brightness on the left to full on the right, as a
+	// scan with a shadow along one edge.
+	im := testImage(200, 150, 2)
+	lit := image.NewRGBA(im.Bounds())
+	for y := 0; y < 150; y++ {
+		for x := 0; x < 200; x++ {
+			c, f := im.RGBAAt(x, y), 0.3+0.7*float64(x)/200
+			lit.SetRGBA(x, y, color.RGBA{R: uint8(float64(c.R) * f), G: uint8(float64(c.G) * f), B: uint8(float64(c.B) * f), A: 0xff})
+		}
+	}
+	distance := func(h *hasher) int {
+		a, err := h.fingerprintDecoded(im)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := h.fingerprintDecoded(lit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a[0].diffbits(b[0])
+	}
+	global := distance(testHasher())
+	clipped := testHasher()
+	clipped.claheClip, clipped.claheTiles = 2, 8
+	local := distance(clipped)
+	if local >= percentToBits(10) || 2*local >= global {
+		t.Errorf("distance %d with -clahe-clip 2 and %d with global equalization; want under %d, and under half", local, global, percentToBits(10))
+	}
+}
+
+// fixedCutoffHash is medianHash as it was, setting the pixels darker than 128 rather than the median.
+func fixedCutoffHash(im image.Image) fingerprint {
+	im = resampleGray(im, hashSize, hashSize)
+	defer release(im)
+	gray := im.(*image.Gray)
+	var f fingerprint
+	for y := 0; y < hashSize; y++ {
+		for x := 0; x < hashSize; x++ {
+			if gray.GrayAt(x, y).Y < 128 {
+				f.setBit(x, y)
+			}
+		}
+	}
+	return f
+}
+
+func TestMedianCutoffSeparatesLabeledSet(t *testing.T) {
+	// Night scenes, dark and gently varying with a bright moon somewhere, each with a touched-up
+	// copy. -clahe-clip leaves them mostly dark, so a fixed cutoff sets nearly every bit of all
+	// of them alike.
+	night := func(seed int) *image.RGBA {
+		im := testImage(160, 120, seed)
+		mx, my := 20+37*seed%120, 15+23*seed%90
+		for y := 0; y < 120; y++ {
+			for x := 0; x < 160; x++ {
+				v := uint8(20 + int(im.RGBAAt(x, y).G)/8)
+				if (x-mx)*(x-mx)+(y-my)*(y-my) < 150 {
+					v = 240
+				}
+				im.SetRGBA(x, y, color.RGBA{R: v, G: v, B: v, A: 0xff})
+			}
+		}
+		return im
+	}
+	var images []image.Image
+	for seed := 1; seed <= 6; seed++ {
+		im := night(seed)
+		images = append(images, im, nearCopy(im))
+	}
+	// misjudged counts the pairs that match but are of different scenes, or the other way around.
+	misjudged := func(hash hashFunc) int {
+		h := testHasher()
+		h.hashes = []hashFunc{hash}
+		h.claheClip, h.claheTiles = 2, 8
+		fs := make([]fingerprint, len(images))
+		for i, im := range images {
+			f, err := h.fingerprintDecoded(im)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fs[i] = f[0]
+		}
+		n := 0
+		for i := range fs {
+			for j := i + 1; j < len(fs); j++ {
+				if match := fs[i].diffbits(fs[j]) < percentToBits(10); match != (i/2 == j/2) {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	if median, fixed := misjudged(medianHash), misjudged(fixedCutoffHash); median != 0 || fixed == 0 {
+		t.Errorf("%d pairs misjudged with the median cutoff and %d with a cutoff of 128; want none, and some", median, fixed)
+	}
+}
+
+func TestEdgeHashSeparatesStructure(t *testing.T) {
+	// The same ramp of light, overlaid with faint tiles of two sizes: alike in their areas of
+	// light and dark, but with edges in different places.
+	tiled := func(size int) *image.Gray {
+		im := image.NewGray(image.Rect(0, 0, 160, 160))
+		for y := 0; y < 160; y++ {
+			for x := 0; x < 160; x++ {
+				v := 40 + x*170/160 - 10
+				if (x/size+y/size)%2 == 0 {
+					v += 20
+				}
+				im.SetGray(x, y, color.Gray{Y: uint8(v)})
+			}
+		}
+		return im
+	}
+	dir := t.TempDir()
+	writeTestPNG(t, filepath.Join(dir, "large.png"), tiled(40))
+	writeTestPNG(t, filepath.Join(dir, "small.png"), tiled(20))
+
+	for _, tc := range []struct {
+		algorithm, want string
+	}{
+		{"ahash", "Possible matches: large.png small.png"},
+		{"edgehash", ""},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := []string{"-algorithm", tc.algorithm, "-quiet", "-base", dir, dir}
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if got := strings.Join(strings.Fields(stdout.String()), " "); got != tc.want {
+			t.Errorf("%q: got %q, want %q", args, got, tc.want)
+		}
+	}
+}
+
+func TestMultiscaleAtLeastAsStableUnderCrop(t *testing.T) {
+	// Images cropped by a few percent on two sides, as a copy trimmed by hand might be.
+	distance := func(h *hasher) int {
+		total := 0
+		for seed := 1; seed <= 16; seed++ {
+			var im image.Image = testImage(320+seed*7, 240, seed)
+			if seed%2 == 0 {
+				im = landscape(200 + seed*10)
+			}
+			b := im.Bounds()
+			f, err := h.fingerprintDecoded(im)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, crop := range []int{2, 3, 4} {
+				cropped, err := h.fingerprintDecoded(cropImage(im, image.Rect(b.Dx()*crop/100, 0, b.Dx(), b.Dy()-b.Dy()*crop/100)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				total += f[0].diffbits(cropped[0])
+			}
+		}
+		return total
+	}
+	multiscale := testHasher()
+	multiscale.multiscale = true
+	if single, multi := distance(testHasher()), distance(multiscale); multi > single {
+		t.Errorf("cropped copies differ by %d bits in all with -multiscale, more than the %d without", multi, single)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// HasherOptions configure a Hasher. The zero value is the defaults of the command line.
+type HasherOptions struct {
+	// Algorithm is one of the -algorithm names, or several joined with +. The default is ahash.
+	Algorithm string
+	// BlurRadius and IntermediateSize are -blur-radius and -intermediate-size; the defaults are
+	// 3 and 160. A negative BlurRadius disables the blur.
+	BlurRadius       int
+	IntermediateSize int
+	// Threshold is the -threshold percentage that Similar uses. The default is 0, which only
+	// matches identical fingerprints.
+	Threshold float64
+	// FlattenAlpha and TrimBorders run the -flatten-alpha and -trim-borders preprocessors.
+	FlattenAlpha bool
+	TrimBorders  bool
+}
+
+// Hasher fingerprints images with fixed options, for use outside the command line. It shares
+// nothing with other Hashers, and is safe to use from several goroutines.
+type Hasher struct {
+	h             *hasher
+	thresholdBits int
+}
+
+// NewHasher returns a Hasher with the given options, or an error if they are invalid.
+func NewHasher(opts HasherOptions) (*Hasher, error) {
+	h := &hasher{intermediateSize: 160, blurRadius: 3, strictDecode: true}
+	if opts.IntermediateSize != 0 {
+		if opts.IntermediateSize < hashSize {
+			return nil, fmt.Errorf("IntermediateSize must be at least %d", hashSize)
+		}
+		h.intermediateSize = opts.IntermediateSize
+	}
+	if opts.BlurRadius != 0 {
+		h.blurRadius = max(0, opts.BlurRadius)
+	}
+	if opts.Algorithm != "" && opts.Algorithm != "ahash" {
+		var err error
+		h.algorithmNames, h.hashes, err = parseAlgorithms(opts.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.FlattenAlpha {
+		h.withPreprocessor("flatten-alpha", flattenAlpha)
+	}
+	if opts.TrimBorders {
+		h.withPreprocessor("trim-borders", trimBorders)
+	}
+	return &Hasher{h: h, thresholdBits: percentToBits(opts.Threshold)}, nil
+}
+
+// Hash decodes the image read from r and returns its fingerprint by the first algorithm.
+func (h *Hasher) Hash(r io.Reader) (fingerprint, error) {
+	info, err := h.h.fingerprintReader(r)
+	if err != nil {
+		return fingerprint{}, err
+	}
+	return info.Fingerprint, nil
+}
+
+// Similar reports whether two fingerprints are within the Hasher's threshold of each other.
+func (h *Hasher) Similar(a, b fingerprint) bool {
+	return hamming(a, b) < h.thresholdBits
+}
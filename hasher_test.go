@@ -0,0 +1,73 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"sync"
+	"testing"
+)
+
+func TestHasherOptionsAreIndependent(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(120, 90, 2)); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	plain, err := NewHasher(HasherOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tuned, err := NewHasher(HasherOptions{Algorithm: "dhash", BlurRadius: -1, IntermediateSize: 96, Threshold: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[*Hasher]fingerprint{}
+	for h, internal := range map[*Hasher]*hasher{plain: testHasher(), tuned: {intermediateSize: 96, strictDecode: true}} {
+		if h == tuned {
+			internal.algorithmNames, internal.hashes, _ = parseAlgorithms("dhash")
+		}
+		info, err := internal.fingerprintReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[h] = info.Fingerprint
+	}
+	if want[plain] == want[tuned] {
+		t.Fatal("the two Hashers give the same fingerprint, so the test can't tell them apart")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		h := plain
+		if i%2 == 1 {
+			h = tuned
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got, err := h.Hash(bytes.NewReader(data)); err != nil || got != want[h] {
+				t.Errorf("Hash = %v, %v, want %v", got, err, want[h])
+			}
+		}()
+	}
+	wg.Wait()
+
+	// One bit apart is similar at a 10% threshold, but not at the default of 0.
+	near := want[plain]
+	near[0] ^= 1
+	if plain.Similar(want[plain], near) || !plain.Similar(want[plain], want[plain]) {
+		t.Error("with the default threshold, only identical fingerprints should be similar")
+	}
+	if !tuned.Similar(want[plain], near) {
+		t.Error("fingerprints one bit apart should be similar at a 10% threshold")
+	}
+}
+
+func TestNewHasherInvalidOptions(t *testing.T) {
+	for _, opts := range []HasherOptions{{Algorithm: "phash"}, {IntermediateSize: hashSize - 1}} {
+		if _, err := NewHasher(opts); err == nil {
+			t.Errorf("NewHasher(%+v) didn't return an error", opts)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// Windows icons hold the same picture at several sizes. Only the largest one is decoded, since it
+// has the most detail to fingerprint. Each image is either a PNG or a headerless BMP.
+
+func init() {
+	image.RegisterFormat("ico", "\x00\x00\x01\x00", decodeICO, decodeICOConfig)
+}
+
+var errBadICO = errors.New("ico: invalid format")
+
+// icoEntry is one image in an icon's directory.
+type icoEntry struct {
+	width, height int
+	size, offset  uint32
+}
+
+// readICODirectory reads the directory of images at the start of an icon.
+func readICODirectory(data []byte) ([]icoEntry, error) {
+	if len(data) < 6 {
+		return nil, errBadICO
+	}
+	n := int(binary.LittleEndian.Uint16(data[4:]))
+	if n == 0 || len(data) < 6+16*n {
+		return nil, errBadICO
+	}
+	entries := make([]icoEntry, n)
+	for i := range entries {
+		e := data[6+16*i:]
+		entries[i] = icoEntry{
+			width:  int(e[0]),
+			height: int(e[1]),
+			size:   binary.LittleEndian.Uint32(e[8:]),
+			offset: binary.LittleEndian.Uint32(e[12:]),
+		}
+		// A size of 0 means 256.
+		if entries[i].width == 0 {
+			entries[i].width = 256
+		}
+		if entries[i].height == 0 {
+			entries[i].height = 256
+		}
+	}
+	return entries, nil
+}
+
+// largestICOImage returns the data of the largest image in an icon.
+func largestICOImage(data []byte) ([]byte, error) {
+	entries, err := readICODirectory(data)
+	if err != nil {
+		return nil, err
+	}
+	best := entries[0]
+	for _, e := range entries[1:] {
+		if e.width*e.height > best.width*best.height {
+			best = e
+		}
+	}
+	end := uint64(best.offset) + uint64(best.size)
+	if end > uint64(len(data)) {
+		return nil, errBadICO
+	}
+	return data[best.offset:end], nil
+}
+
+// decodeICO decodes the largest image in an icon.
+func decodeICO(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	img, err := largestICOImage(data)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(img, []byte("\x89PNG")) {
+		return png.Decode(bytes.NewReader(img))
+	}
+	return decodeDIB(img)
+}
+
+// decodeICOConfig returns the size of the largest image in an icon.
+func decodeICOConfig(r io.Reader) (image.Config, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	img, err := largestICOImage(data)
+	if err != nil {
+		return image.Config{}, err
+	}
+	if bytes.HasPrefix(img, []byte("\x89PNG")) {
+		return png.DecodeConfig(bytes.NewReader(img))
+	}
+	width, height, _, err := dibHeader(img)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: color.NRGBAModel, Width: width, Height: height}, nil
+}
+
+// dibHeader reads the size and bit depth of an icon's BMP image. Its height counts both the
+// image and the transparency mask below it, so it is halved.
+func dibHeader(data []byte) (width, height, bitCount int, err error) {
+	if len(data) < 40 || binary.LittleEndian.Uint32(data) < 40 || binary.LittleEndian.Uint32(data) > uint32(len(data)) {
+		return 0, 0, 0, errBadICO
+	}
+	width = int(int32(binary.LittleEndian.Uint32(data[4:])))
+	height = int(int32(binary.LittleEndian.Uint32(data[8:]))) / 2
+	bitCount = int(binary.LittleEndian.Uint16(data[14:]))
+	if compression := binary.LittleEndian.Uint32(data[16:]); compression != 0 {
+		return 0, 0, 0, fmt.Errorf("ico: unsupported compression %d", compression)
+	}
+	if width <= 0 || height <= 0 || width > 1024 || height > 1024 {
+		return 0, 0, 0, errBadICO
+	}
+	return width, height, bitCount, nil
+}
+
+// decodeDIB decodes an icon's BMP image: a BITMAPINFOHEADER, a palette for 8 bits per pixel or
+// fewer, the pixels from the bottom row up, and a 1-bit mask of transparent pixels.
+func decodeDIB(data []byte) (image.Image, error) {
+	width, height, bitCount, err := dibHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	switch bitCount {
+	case 1, 4, 8, 24, 32:
+	default:
+		return nil, fmt.Errorf("ico: unsupported bit depth %d", bitCount)
+	}
+	// The palette or pixels follow the header, whose size dibHeader checked is within data.
+	pos := int(binary.LittleEndian.Uint32(data))
+	var palette []color.NRGBA
+	if bitCount <= 8 {
+		n := int(binary.LittleEndian.Uint32(data[32:]))
+		if n == 0 || n > 1<<bitCount {
+			n = 1 << bitCount
+		}
+		if len(data) < pos+4*n {
+			return nil, errBadICO
+		}
+		for i := 0; i < n; i++ {
+			p := data[pos+4*i:]
+			palette = append(palette, color.NRGBA{R: p[2], G: p[1], B: p[0], A: 0xff})
+		}
+		pos += 4 * n
+	}
+	// Rows are padded to a multiple of 4 bytes.
+	stride := (width*bitCount + 31) / 32 * 4
+	maskStride := (width + 31) / 32 * 4
+	if len(data) < pos+stride*height {
+		return nil, errBadICO
+	}
+	pixels := data[pos : pos+stride*height]
+	mask := data[pos+stride*height:]
+	if len(mask) < maskStride*height {
+		mask = nil
+	}
+
+	im := image.NewNRGBA(image.Rect(0, 0, width, height))
+	hasAlpha := false
+	for y := 0; y < height; y++ {
+		row := pixels[(height-1-y)*stride:]
+		for x := 0; x < width; x++ {
+			var c color.NRGBA
+			switch bitCount {
+			case 32:
+				c = color.NRGBA{R: row[4*x+2], G: row[4*x+1], B: row[4*x], A: row[4*x+3]}
+				hasAlpha = hasAlpha || c.A != 0
+			case 24:
+				c = color.NRGBA{R: row[3*x+2], G: row[3*x+1], B: row[3*x], A: 0xff}
+			default:
+				bit := x * bitCount
+				index := int(row[bit/8]>>(8-bitCount-bit%8)) & (1<<bitCount - 1)
+				if index < len(palette) {
+					c = palette[index]
+				}
+			}
+			im.SetNRGBA(x, y, c)
+		}
+	}
+	// 32-bit images carry their own transparency; the others, and 32-bit images that
+	// leave their alpha channel empty, use the mask.
+	if bitCount == 32 && hasAlpha {
+		return im, nil
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := im.NRGBAAt(x, y)
+			c.A = 0xff
+			if mask != nil && mask[(height-1-y)*maskStride+x/8]&(0x80>>(x%8)) != 0 {
+				c.A = 0
+			}
+			im.SetNRGBA(x, y, c)
+		}
+	}
+	return im, nil
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"testing"
+)
+
+// testDIB is im as an icon's 24-bit BMP image, with an empty transparency mask.
+func testDIB(im *image.RGBA) []byte {
+	w, h := im.Bounds().Dx(), im.Bounds().Dy()
+	header := make([]byte, 40)
+	binary.LittleEndian.PutUint32(header, 40)
+	binary.LittleEndian.PutUint32(header[4:], uint32(w))
+	binary.LittleEndian.PutUint32(header[8:], uint32(2*h))
+	binary.LittleEndian.PutUint16(header[12:], 1)
+	binary.LittleEndian.PutUint16(header[14:], 24)
+	stride, maskStride := (w*24+31)/32*4, (w+31)/32*4
+	data := append(header, make([]byte, (stride+maskStride)*h)...)
+	for y := 0; y < h; y++ {
+		row := data[40+(h-1-y)*stride:]
+		for x := 0; x < w; x++ {
+			c := im.RGBAAt(x, y)
+			row[3*x], row[3*x+1], row[3*x+2] = c.B, c.G, c.R
+		}
+	}
+	return data
+}
+
+// testICO is an icon holding the given images, each of which is the given size.
+func testICO(sizes []int, images [][]byte) []byte {
+	ico := []byte{0, 0, 1, 0, byte(len(images)), 0}
+	offset := 6 + 16*len(images)
+	for i, img := range images {
+		e := make([]byte, 16)
+		e[0], e[1] = byte(sizes[i]), byte(sizes[i])
+		binary.LittleEndian.PutUint32(e[8:], uint32(len(img)))
+		binary.LittleEndian.PutUint32(e[12:], uint32(offset))
+		ico = append(ico, e...)
+		offset += len(img)
+	}
+	for _, img := range images {
+		ico = append(ico, img...)
+	}
+	return ico
+}
+
+func TestICOUsesLargestImage(t *testing.T) {
+	large := testImage(64, 64, 1)
+	var largePNG bytes.Buffer
+	if err := png.Encode(&largePNG, large); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		images [][]byte
+		sizes  []int
+	}{
+		{"png", [][]byte{testDIB(testImage(16, 16, 2)), largePNG.Bytes(), testDIB(testImage(32, 32, 3))}, []int{16, 64, 32}},
+		{"bmp", [][]byte{testDIB(testImage(16, 16, 2)), testDIB(large), testDIB(testImage(32, 32, 3))}, []int{16, 64, 32}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ico := testICO(tc.sizes, tc.images)
+			config, format, err := image.DecodeConfig(bytes.NewReader(ico))
+			if err != nil || format != "ico" || config.Width != 64 || config.Height != 64 {
+				t.Errorf("DecodeConfig = %dx%d %q, %v, want 64x64 ico", config.Width, config.Height, format, err)
+			}
+			im, _, err := image.Decode(bytes.NewReader(ico))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if im.Bounds() != large.Bounds() {
+				t.Fatalf("decoded %v, want the largest image, %v", im.Bounds(), large.Bounds())
+			}
+			for _, p := range []image.Point{{0, 0}, {63, 0}, {10, 50}, {63, 63}} {
+				r, g, b, _ := im.At(p.X, p.Y).RGBA()
+				wr, wg, wb, _ := large.At(p.X, p.Y).RGBA()
+				if r != wr || g != wg || b != wb {
+					t.Errorf("pixel %v is %v, want %v", p, im.At(p.X, p.Y), large.At(p.X, p.Y))
+				}
+			}
+		})
+	}
+}
+
+func TestICOBadHeaderSize(t *testing.T) {
+	// A BMP header that claims to be longer than the image is rejected rather than read past.
+	for _, size := range []uint32{1 << 20, 1<<32 - 1} {
+		dib := testDIB(testImage(16, 16, 1))
+		binary.LittleEndian.PutUint32(dib, size)
+		ico := testICO([]int{16}, [][]byte{dib})
+		if _, err := decodeICO(bytes.NewReader(ico)); err != errBadICO {
+			t.Errorf("header size %d: decodeICO error %v, want %v", size, err, errBadICO)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// pathKey normalizes a path for comparison. Names that differ only in Unicode normalization
+// are left different, as they are different files on most filesystems; where they are the same
+// file, such as NFC and NFD names on macOS, inputSet.add finds it with os.SameFile.
+func pathKey(path string) string {
+	return filepath.Clean(path)
+}
+
+// dedupePaths removes images whose path is the same as an earlier image's.
+func dedupePaths(images []imageInfo) []imageInfo {
+	seen := map[string]bool{}
+	var unique []imageInfo
+	for _, im := range images {
+		key := pathKey(im.Path)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, im)
+	}
+	return unique
+}
+
+// inputSet remembers the files that have been scanned, so that a file reached more than once,
+// through repeated arguments, symlinks, or hard links, is only fingerprinted once.
+type inputSet struct {
+	paths map[string]bool
+	// bySize holds the files seen so far by size, to find the same file under another name.
+	bySize map[int64][]fs.FileInfo
+	// collapsed counts the files that were skipped for having been seen already.
+	collapsed int
+}
+
+func newInputSet() *inputSet {
+	return &inputSet{paths: map[string]bool{}, bySize: map[int64][]fs.FileInfo{}}
+}
+
+// add records the file at path and reports whether it hasn't been seen before.
+func (s *inputSet) add(path string) bool {
+	key := path
+	if abs, err := filepath.Abs(path); err == nil {
+		key = abs
+	}
+	if resolved, err := filepath.EvalSymlinks(key); err == nil {
+		key = resolved
+	}
+	key = pathKey(key)
+	if s.paths[key] {
+		s.collapsed++
+		return false
+	}
+	s.paths[key] = true
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return true
+	}
+	for _, other := range s.bySize[info.Size()] {
+		if os.SameFile(info, other) {
+			s.collapsed++
+			return false
+		}
+	}
+	s.bySize[info.Size()] = append(s.bySize[info.Size()], info)
+	return true
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// "café" with a precomposed é (NFC) and with e and a combining acute accent (NFD).
+const (
+	cafeNFC = "caf\u00e9.png"
+	cafeNFD = "cafe\u0301.png"
+)
+
+func TestInputSetUnicodeNormalization(t *testing.T) {
+	dir := t.TempDir()
+	nfc := filepath.Join(dir, cafeNFC)
+	nfd := filepath.Join(dir, cafeNFD)
+	if err := os.WriteFile(nfc, []byte("first"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// On filesystems that ignore normalization, like macOS's, both names open the same file,
+	// which must only be scanned once. Elsewhere they are two files, which must both be scanned.
+	_, err := os.Stat(nfd)
+	sameFile := err == nil
+	if errors.Is(err, fs.ErrNotExist) {
+		if err := os.WriteFile(nfd, []byte("other"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newInputSet()
+	if !s.add(nfc) {
+		t.Fatalf("add(%q) = false for the first file", nfc)
+	}
+	if got := s.add(nfd); got == sameFile {
+		t.Errorf("add(%q) = %v after adding %q; the names are the same file: %v", nfd, got, nfc, sameFile)
+	}
+}
+
+func TestDedupePathsKeepsUnicodeVariants(t *testing.T) {
+	images := []imageInfo{{Path: "a/" + cafeNFC}, {Path: "a/" + cafeNFD}, {Path: "a/./" + cafeNFC}}
+	unique := dedupePaths(images)
+	if len(unique) != 2 || unique[0].Path != images[0].Path || unique[1].Path != images[1].Path {
+		t.Errorf("dedupePaths kept %d of %d images, want the NFC and NFD names", len(unique), len(images))
+	}
+}
+
+func TestRepeatedInputsFingerprintedOnce(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.png")
+	writeTestPNG(t, a, testImage(100, 80, 1))
+	writeTestPNG(t, filepath.Join(dir, "b.png"), testImage(100, 80, 2))
+	if err := os.Symlink("a.png", filepath.Join(dir, "link.png")); err != nil {
+		t.Skip(err)
+	}
+
+	// The directory twice, and a.png on its own, reach seven files, of which only two are
+	// different; were any fingerprinted twice, it would match itself.
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-verbose", dir, dir, a}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	for _, want := range []string{"Ignoring 5 files that were seen more than once", "Cross-matching 2 files"} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, stdout.String())
+		}
+	}
+	if want := "No duplicate groups found (2 images scanned)"; strings.Contains(stdout.String(), "Possible matches") || !strings.Contains(stderr.String(), want) {
+		t.Errorf("output\n%s\nstderr %q, want no matches and %q", stdout.String(), stderr.String(), want)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// keepPolicy chooses which member of a group to keep if the others are deleted.
+type keepPolicy struct {
+	// order is largest, smallest, newest, or oldest.
+	order string
+	// prefer, if set, keeps members whose path matches it over those that don't. It sees
+	// where the file is, not the path as -base or -relative print it.
+	prefer *regexp.Regexp
+	// tiebreak is how a tie is settled: first-seen keeps the member found first, and path the
+	// member whose file path sorts first, which doesn't depend on the order of the arguments.
+	tiebreak string
+}
+
+// newKeepPolicy checks and compiles the -keep, -keep-prefer, and -tiebreak flags.
+func newKeepPolicy(order, prefer, tiebreak string) (*keepPolicy, error) {
+	switch order {
+	case "largest", "smallest", "newest", "oldest":
+	default:
+		return nil, fmt.Errorf("unknown keep policy %q", order)
+	}
+	if tiebreak != "first-seen" && tiebreak != "path" {
+		return nil, fmt.Errorf("-tiebreak must be first-seen or path, got %q", tiebreak)
+	}
+	p := &keepPolicy{order: order, tiebreak: tiebreak}
+	if prefer != "" {
+		re, err := regexp.Compile(prefer)
+		if err != nil {
+			return nil, fmt.Errorf("bad -keep-prefer: %w", err)
+		}
+		p.prefer = re
+	}
+	return p, nil
+}
+
+// better reports whether a should be kept rather than b. Ties are not better.
+func (p *keepPolicy) better(a, b *groupMember) bool {
+	if p.prefer != nil {
+		pa, pb := p.prefer.MatchString(a.file), p.prefer.MatchString(b.file)
+		if pa != pb {
+			return pa
+		}
+	}
+	switch p.order {
+	case "smallest":
+		return a.Size < b.Size
+	case "newest":
+		return a.ModTime.After(b.ModTime)
+	case "oldest":
+		return a.ModTime.Before(b.ModTime)
+	}
+	return a.Size > b.Size
+}
+
+// keeper returns the index of the member of g to keep, settling ties by p.tiebreak.
+func (p *keepPolicy) keeper(g *group) int {
+	k := 0
+	for i := range g.Members {
+		a, b := &g.Members[i], &g.Members[k]
+		if p.better(a, b) || p.tiebreak == "path" && !p.better(b, a) && a.file < b.file {
+			k = i
+		}
+	}
+	return k
+}
+
+// reclaimable returns how many bytes would be freed by deleting every member of g but the keeper.
+func (p *keepPolicy) reclaimable(g *group) int64 {
+	var total int64
+	for _, member := range g.Members {
+		total += member.Size
+	}
+	return total - g.Members[p.keeper(g)].Size
+}
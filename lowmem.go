@@ -0,0 +1,86 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// matchComponentsLowMemory groups the images like findMatches and findEquiv do, for -low-memory.
+// Each matching pair is written to a temporary file as it is found, rather than kept, and the
+// file is then read back into a union-find, so memory only grows with the number of images.
+// The groups are in the order of their first image, with their images in order. If ctx is done,
+// it groups the matches found so far.
+func (m *matcher) matchComponentsLowMemory(ctx context.Context, images []imageInfo) ([][]int, error) {
+	f, err := os.CreateTemp("", "findimagedupes-matches-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	var pair [8]byte
+	err = m.eachMatch(ctx, images, func(i, j int) error {
+		binary.LittleEndian.PutUint32(pair[:4], uint32(i))
+		binary.LittleEndian.PutUint32(pair[4:], uint32(j))
+		_, err := w.Write(pair[:])
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// parent is a union-find forest; the root of each tree is the smallest index in it.
+	parent := make([]int32, len(images))
+	for i := range parent {
+		parent[i] = int32(i)
+	}
+	find := func(i int32) int32 {
+		for parent[i] != i {
+			parent[i] = parent[parent[i]]
+			i = parent[i]
+		}
+		return i
+	}
+	matched := make([]bool, len(images))
+	r := bufio.NewReader(f)
+	for {
+		if _, err := io.ReadFull(r, pair[:]); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		i, j := int32(binary.LittleEndian.Uint32(pair[:4])), int32(binary.LittleEndian.Uint32(pair[4:]))
+		matched[i], matched[j] = true, true
+		ri, rj := find(i), find(j)
+		parent[max(ri, rj)] = min(ri, rj)
+	}
+
+	var components [][]int
+	component := map[int32]int{}
+	for i := range images {
+		if !matched[i] {
+			continue
+		}
+		root := find(int32(i))
+		c, ok := component[root]
+		if !ok {
+			c = len(components)
+			component[root] = c
+			components = append(components, nil)
+		}
+		components[c] = append(components[c], i)
+	}
+	return components, nil
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+func TestLowMemoryMatchesInMemory(t *testing.T) {
+	// Clusters of near copies, some of them chains whose ends are too far apart to match
+	// directly, among unrelated images, in shuffled order.
+	rng := rand.New(rand.NewSource(1))
+	flip := func(f fingerprint, n int) fingerprint {
+		for _, b := range rng.Perm(fingerprintBits)[:n] {
+			f[b/8] ^= 1 << (b % 8)
+		}
+		return f
+	}
+	var images []imageInfo
+	for c := 0; c < 40; c++ {
+		var f fingerprint
+		rng.Read(f[:])
+		images = append(images, imageInfo{Fingerprint: f})
+		for i := 0; i < c%4; i++ {
+			if c%3 == 0 {
+				f = flip(f, 20)
+				images = append(images, imageInfo{Fingerprint: f})
+			} else {
+				images = append(images, imageInfo{Fingerprint: flip(f, 5)})
+			}
+		}
+	}
+	rng.Shuffle(len(images), func(i, j int) { images[i], images[j] = images[j], images[i] })
+
+	m := &matcher{distance: hamming, thresholdBits: percentToBits(10)}
+	var want [][]int
+	matches := m.findMatches(context.Background(), images)
+	for i := range images {
+		if _, ok := matches[i]; !ok {
+			continue
+		}
+		equiv := findEquiv(matches, i)
+		for _, j := range equiv {
+			delete(matches, j)
+		}
+		slices.Sort(equiv)
+		want = append(want, equiv)
+	}
+	got, err := m.matchComponentsLowMemory(context.Background(), images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) < 20 {
+		t.Fatalf("only %d groups in memory, so the test isn't testing much", len(want))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("-low-memory groups\n%v\nwant the in-memory groups\n%v", got, want)
+	}
+}
+
+func TestLowMemoryRunOutput(t *testing.T) {
+	for _, args := range [][]string{{"testdata"}, {"-format", "json", "testdata"}, {"-threshold", "30", "-format", "delete-list", "testdata"}} {
+		var want, got, stderr bytes.Buffer
+		if code := run(args, &want, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if code := run(append([]string{"-low-memory"}, args...), &got, &stderr); code != 0 {
+			t.Fatalf("-low-memory %q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if got.String() != want.String() {
+			t.Errorf("-low-memory %q printed\n%s\nwant\n%s", args, got.String(), want.String())
+		}
+	}
+}
+
+func TestBucketByResolutionFindsNeighbors(t *testing.T) {
+	// Ten photos, each with a copy at the same size and one at half the size, and a thumbnail
+	// of the first that is far smaller than it, among unrelated images of every size.
+	rng := rand.New(rand.NewSource(1))
+	var images []imageInfo
+	add := func(f fingerprint, side int) int {
+		images = append(images, imageInfo{Path: fmt.Sprint(len(images)), Fingerprint: f, Width: side, Height: side * 3 / 4})
+		return len(images) - 1
+	}
+	var want [][2]int
+	var thumbnail [2]int
+	for i := 0; i < 10; i++ {
+		var f fingerprint
+		rng.Read(f[:])
+		side := 256 << (i % 5)
+		photo := add(f, side)
+		want = append(want, [2]int{photo, add(f, side)}, [2]int{photo, add(f, side/2)})
+		if i == 0 {
+			thumbnail = [2]int{photo, add(f, 32)}
+		}
+	}
+	for i := 0; i < 200; i++ {
+		var f fingerprint
+		rng.Read(f[:])
+		add(f, 32<<(i%9))
+	}
+
+	found := func(m *matcher) (map[int][]int, int) {
+		m.stats = &distanceStats{}
+		return m.findMatches(context.Background(), images), m.stats.pairs
+	}
+	all, allPairs := found(&matcher{distance: hamming, thresholdBits: percentToBits(10)})
+	bucketed, bucketedPairs := found(&matcher{distance: hamming, thresholdBits: percentToBits(10), byResolution: true})
+	for _, pair := range want {
+		if !slices.Contains(bucketed[pair[0]], pair[1]) {
+			t.Errorf("%v is missed with -bucket-by-resolution", pair)
+		}
+	}
+	// The thumbnail is the recall that is given up: it only matches without buckets.
+	if !slices.Contains(all[thumbnail[0]], thumbnail[1]) || slices.Contains(bucketed[thumbnail[0]], thumbnail[1]) {
+		t.Errorf("thumbnail %v matched %v without buckets and %v with them, want only without", thumbnail, all[thumbnail[0]], bucketed[thumbnail[0]])
+	}
+	t.Logf("%d comparisons without buckets, %d with them", allPairs, bucketedPairs)
+	if n := len(images); allPairs != n*(n-1)/2 || bucketedPairs > allPairs/2 {
+		t.Errorf("%d comparisons with buckets and %d without, want at most half of all %d pairs", bucketedPairs, allPairs, n*(n-1)/2)
+	}
+}
@@ -0,0 +1,8 @@
+// Copyright (c) 2023 Christopher Swenson
+
+//go:build !pdf
+
+package main
+
+// pdfExtensions are added to the default extensions when built with PDF support.
+var pdfExtensions []string
@@ -0,0 +1,455 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// group is a set of images that are possibly duplicates of each other.
+type group struct {
+	ID      int           `json:"id"`
+	Members []groupMember `json:"members"`
+	// Partial is set when -max-duration stopped the run, so the group may be missing members.
+	Partial bool `json:"partial,omitempty"`
+}
+
+// groupMember is one image in a group, described relative to the first member.
+type groupMember struct {
+	Path string `json:"path"`
+	// Distance is in the matcher's unit.
+	Distance  float64 `json:"distance"`
+	Transform string  `json:"transform,omitempty"`
+	// Origin is the positional argument the file was found under, counting from 1.
+	Origin  int       `json:"origin,omitempty"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Width   int       `json:"width"`
+	Height  int       `json:"height"`
+	// file is where the image is, since Path may be rewritten for printing by pathWriter.
+	file string
+}
+
+// newGroup builds the group of the given image indexes. Members are ordered as scanned.
+func (m *matcher) newGroup(id int, images []imageInfo, indexes []int) *group {
+	indexes = slices.Clone(indexes)
+	slices.Sort(indexes)
+	g := &group{ID: id}
+	first := &images[indexes[0]]
+	for _, j := range indexes {
+		d, t := m.compare(first, &images[j])
+		g.Members = append(g.Members, groupMember{
+			Path:      images[j].Path,
+			Distance:  m.unit.value(float64(d)),
+			Transform: t.String(),
+			Origin:    images[j].Origin,
+			Size:      images[j].Size,
+			ModTime:   images[j].ModTime,
+			Width:     images[j].Width,
+			Height:    images[j].Height,
+			file:      images[j].Path,
+		})
+	}
+	return g
+}
+
+// sizeMismatchRatio is how many times larger one file must be than another with an identical
+// fingerprint for identicalSizeMismatch to report them.
+const sizeMismatchRatio = 10
+
+// identicalSizeMismatch reports whether the members identical to the first member differ wildly in
+// file size, which suggests an identical fingerprint from something other than identical images.
+// It returns the sizes of the smallest and largest of those members.
+func (g *group) identicalSizeMismatch() (smallest, largest int64, ok bool) {
+	smallest = g.Members[0].Size
+	largest = g.Members[0].Size
+	for _, member := range g.Members[1:] {
+		if member.Distance != 0 {
+			continue
+		}
+		smallest = min(smallest, member.Size)
+		largest = max(largest, member.Size)
+	}
+	return smallest, largest, largest > sizeMismatchRatio*smallest
+}
+
+// groupWriter prints groups as they are found.
+type groupWriter interface {
+	writeGroup(g *group) error
+	close() error
+}
+
+// outputOptions are settings shared by the groupWriters.
+type outputOptions struct {
+	// origins, if set, are the positional arguments, to annotate text output with where files came from.
+	origins []string
+	// resolution annotates text output with the width and height of each image.
+	resolution bool
+	// keep chooses which file of each group would be kept.
+	keep *keepPolicy
+	// images returns all the images that were matched, for keep-list, which lists those that
+	// aren't in any group too. Their paths are printed in the style of paths, like pathWriter.
+	images func() []imageInfo
+	paths  pathStyle
+}
+
+// newGroupWriter returns a groupWriter for the named format.
+func newGroupWriter(format string, w io.Writer, opts outputOptions) (groupWriter, error) {
+	switch format {
+	case "text":
+		return &textWriter{w: w, origins: opts.origins, resolution: opts.resolution}, nil
+	case "delete-list":
+		return &deleteListWriter{w: w, keep: opts.keep}, nil
+	case "keep-list":
+		return &keepListWriter{w: w, keep: opts.keep, images: opts.images, paths: opts.paths, dropped: map[string]bool{}}, nil
+	case "json":
+		return &jsonWriter{w: w, groups: []*group{}}, nil
+	case "jsonl":
+		return &jsonlWriter{enc: json.NewEncoder(w)}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+// relativePath returns path relative to base. If base is empty or path can't be made relative to it,
+// path is returned unchanged.
+func relativePath(base, path string) string {
+	if base == "" {
+		return path
+	}
+	absBase, err := filepath.Abs(base)
+	if err != nil {
+		return path
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	rel, err := filepath.Rel(absBase, absPath)
+	if err != nil {
+		return path
+	}
+	return rel
+}
+
+// pathStyle is how paths are printed: relative to base, if it is set, and with / as the
+// separator on every platform if posix is set, so that reports can be compared across them.
+type pathStyle struct {
+	base  string
+	posix bool
+}
+
+func (p pathStyle) format(path string) string {
+	path = relativePath(p.base, path)
+	if p.posix {
+		path = filepath.ToSlash(path)
+	}
+	return path
+}
+
+// pathWriter prints the paths of each group in the style of paths before passing it on.
+type pathWriter struct {
+	groupWriter
+	paths pathStyle
+}
+
+func (r *pathWriter) writeGroup(g *group) error {
+	for i := range g.Members {
+		g.Members[i].Path = r.paths.format(g.Members[i].Path)
+	}
+	return r.groupWriter.writeGroup(g)
+}
+
+// topGroupsWriter collects all the groups and then passes on only the n that would free the most
+// bytes, by keep, the largest groups first among ties. Groups keep their IDs, so they can be
+// found in a full report. omitted is how many were left out, once it is closed.
+type topGroupsWriter struct {
+	groupWriter
+	keep    *keepPolicy
+	n       int
+	groups  []*group
+	omitted int
+}
+
+func (t *topGroupsWriter) writeGroup(g *group) error {
+	t.groups = append(t.groups, g)
+	return nil
+}
+
+func (t *topGroupsWriter) close() error {
+	reclaimable := map[*group]int64{}
+	for _, g := range t.groups {
+		reclaimable[g] = t.keep.reclaimable(g)
+	}
+	slices.SortStableFunc(t.groups, func(a, b *group) int {
+		if c := cmp.Compare(reclaimable[b], reclaimable[a]); c != 0 {
+			return c
+		}
+		return cmp.Compare(len(b.Members), len(a.Members))
+	})
+	if len(t.groups) > t.n {
+		t.omitted = len(t.groups) - t.n
+		t.groups = t.groups[:t.n]
+	}
+	for _, g := range t.groups {
+		if err := t.groupWriter.writeGroup(g); err != nil {
+			return err
+		}
+	}
+	return t.groupWriter.close()
+}
+
+// textWriter prints each group as a list of paths.
+type textWriter struct {
+	w          io.Writer
+	origins    []string
+	resolution bool
+}
+
+func (t *textWriter) writeGroup(g *group) error {
+	var names []string
+	for _, member := range g.Members {
+		name := member.Path
+		// Imported fingerprints from before sizes were saved have none.
+		if t.resolution && member.Width > 0 {
+			name = fmt.Sprintf("%s (%dx%d)", name, member.Width, member.Height)
+		}
+		if member.Transform != "" {
+			name = fmt.Sprintf("%s (%s)", name, member.Transform)
+		}
+		if t.origins != nil && member.Origin > 0 {
+			name = fmt.Sprintf("%s [from %s]", name, t.origins[member.Origin-1])
+		}
+		names = append(names, name)
+	}
+	_, err := fmt.Fprintf(t.w, "Possible matches:\n%s\n\n", strings.Join(names, "\n"))
+	return err
+}
+
+func (t *textWriter) close() error {
+	return nil
+}
+
+// deleteListWriter prints the path of every member of each group except the one to keep.
+type deleteListWriter struct {
+	w    io.Writer
+	keep *keepPolicy
+}
+
+func (d *deleteListWriter) writeGroup(g *group) error {
+	k := d.keep.keeper(g)
+	for i, member := range g.Members {
+		if i == k {
+			continue
+		}
+		if _, err := fmt.Fprintln(d.w, member.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *deleteListWriter) close() error {
+	return nil
+}
+
+// keepListWriter prints the path of every image that deleteListWriter wouldn't: the one to keep
+// of each group, and every image that isn't in a group, in the order they were scanned.
+type keepListWriter struct {
+	w       io.Writer
+	keep    *keepPolicy
+	images  func() []imageInfo
+	paths   pathStyle
+	dropped map[string]bool
+}
+
+func (k *keepListWriter) writeGroup(g *group) error {
+	keeper := k.keep.keeper(g)
+	for i, member := range g.Members {
+		if i != keeper {
+			k.dropped[member.Path] = true
+		}
+	}
+	return nil
+}
+
+func (k *keepListWriter) close() error {
+	for _, im := range k.images() {
+		path := k.paths.format(im.Path)
+		if k.dropped[path] {
+			continue
+		}
+		if _, err := fmt.Fprintln(k.w, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// summaryWriter prints only a count of the groups once they have all been found.
+type summaryWriter struct {
+	w           io.Writer
+	keep        *keepPolicy
+	groups      int
+	files       int
+	reclaimable int64
+}
+
+func (s *summaryWriter) writeGroup(g *group) error {
+	s.groups++
+	s.files += len(g.Members)
+	s.reclaimable += s.keep.reclaimable(g)
+	return nil
+}
+
+func (s *summaryWriter) close() error {
+	_, err := fmt.Fprintf(s.w, "%d duplicate groups covering %d files, %d bytes reclaimable\n", s.groups, s.files, s.reclaimable)
+	return err
+}
+
+// runSummary is what -summary-json saves: the counts and times of a run, for monitoring.
+type runSummary struct {
+	// Scanned is the number of images fingerprinted in this run, from files and URLs. Reused is
+	// the number whose fingerprints came from -since-index or -checkpoint instead, and Imported
+	// the number from -import-fingerprints. All of them are matched.
+	Scanned  int `json:"scanned"`
+	Reused   int `json:"reused"`
+	Imported int `json:"imported"`
+	// Skipped is the number of files that weren't images, were in unsupported formats, or were
+	// too large for -max-decode-bytes, and Failed the number that couldn't be read or decoded.
+	Skipped          int     `json:"skipped"`
+	Failed           int     `json:"failed"`
+	Groups           int     `json:"groups"`
+	FilesInGroups    int     `json:"filesInGroups"`
+	ReclaimableBytes int64   `json:"reclaimableBytes"`
+	ScanSeconds      float64 `json:"scanSeconds"`
+	MatchSeconds     float64 `json:"matchSeconds"`
+	// Partial is set when -max-duration stopped the run before it scanned and matched everything.
+	Partial bool `json:"partial"`
+}
+
+// add counts a group, and the bytes deleting all but the member keep chooses would free.
+func (s *runSummary) add(g *group, keep *keepPolicy) {
+	s.Groups++
+	s.FilesInGroups += len(g.Members)
+	s.ReclaimableBytes += keep.reclaimable(g)
+}
+
+// save writes the summary to the named file as a JSON object.
+func (s *runSummary) save(name string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(data, '\n'), 0o644)
+}
+
+// folderWriter collects all the groups and then prints them by folder: each folder that has
+// duplicates in it, followed by its files and the groups they are in.
+type folderWriter struct {
+	w       io.Writer
+	folders map[string][]groupMember
+	groupOf map[string]int
+}
+
+func (f *folderWriter) writeGroup(g *group) error {
+	if f.folders == nil {
+		f.folders = map[string][]groupMember{}
+		f.groupOf = map[string]int{}
+	}
+	for _, member := range g.Members {
+		dir := filepath.Dir(member.Path)
+		f.folders[dir] = append(f.folders[dir], member)
+		f.groupOf[member.Path] = g.ID
+	}
+	return nil
+}
+
+func (f *folderWriter) close() error {
+	dirs := make([]string, 0, len(f.folders))
+	for dir := range f.folders {
+		dirs = append(dirs, dir)
+	}
+	slices.Sort(dirs)
+	for _, dir := range dirs {
+		members := f.folders[dir]
+		slices.SortFunc(members, func(a, b groupMember) int { return strings.Compare(a.Path, b.Path) })
+		var ids []int
+		for _, member := range members {
+			ids = append(ids, f.groupOf[member.Path])
+		}
+		slices.Sort(ids)
+		var names []string
+		for _, id := range slices.Compact(ids) {
+			names = append(names, strconv.Itoa(id))
+		}
+		if _, err := fmt.Fprintf(f.w, "Folder %s (groups %s):\n", dir, strings.Join(names, ", ")); err != nil {
+			return err
+		}
+		for _, member := range members {
+			if _, err := fmt.Fprintf(f.w, "%s\tgroup %d\n", member.Path, f.groupOf[member.Path]); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintln(f.w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// templateWriter prints each group with a user-supplied template, followed by a newline.
+type templateWriter struct {
+	w    io.Writer
+	tmpl *template.Template
+}
+
+func (t *templateWriter) writeGroup(g *group) error {
+	if err := t.tmpl.Execute(t.w, g); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(t.w)
+	return err
+}
+
+func (t *templateWriter) close() error {
+	return nil
+}
+
+// jsonWriter collects all the groups and prints them as one JSON array.
+type jsonWriter struct {
+	w      io.Writer
+	groups []*group
+}
+
+func (j *jsonWriter) writeGroup(g *group) error {
+	j.groups = append(j.groups, g)
+	return nil
+}
+
+func (j *jsonWriter) close() error {
+	enc := json.NewEncoder(j.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(j.groups)
+}
+
+// jsonlWriter prints each group as a JSON object on its own line as soon as it is found.
+type jsonlWriter struct {
+	enc *json.Encoder
+}
+
+func (j *jsonlWriter) writeGroup(g *group) error {
+	return j.enc.Encode(g)
+}
+
+func (j *jsonlWriter) close() error {
+	return nil
+}
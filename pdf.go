@@ -0,0 +1,197 @@
+// Copyright (c) 2023 Christopher Swenson
+
+//go:build pdf
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"regexp"
+	"strconv"
+)
+
+// PDF support is meant for scanned documents. Rather than rendering the first page, the first image
+// embedded in the file is decoded, which for a scan is the first page. Build with -tags pdf to enable it.
+
+var pdfExtensions = []string{"pdf"}
+
+func init() {
+	image.RegisterFormat("pdf", "%PDF", decodePDF, decodePDFConfig)
+}
+
+var (
+	errNoPDFImage = errors.New("pdf: no supported image found")
+
+	pdfStreamStart = regexp.MustCompile(`>>\s*stream\r?\n`)
+	pdfImageType   = regexp.MustCompile(`/Subtype\s*/Image\b`)
+	pdfFilter      = regexp.MustCompile(`/Filter\s*\[?\s*/(\w+)\s*\]?`)
+	pdfColorSpace  = regexp.MustCompile(`/ColorSpace\s*/(\w+)`)
+	pdfInt         = func(key string) *regexp.Regexp { return regexp.MustCompile(`/` + key + `\s+(\d+)`) }
+	pdfWidth       = pdfInt("Width")
+	pdfHeight      = pdfInt("Height")
+	pdfBits        = pdfInt("BitsPerComponent")
+)
+
+// pdfMaxSide is the widest or tallest image stream that is decoded, which is more than a page
+// scanned at 1200 dpi, and small enough that the size of its pixels can't overflow an int.
+const pdfMaxSide = 1 << 14
+
+// decodePDF decodes the first supported image in a PDF.
+func decodePDF(r io.Reader) (image.Image, error) {
+	var im image.Image
+	err := pdfImages(r, func(dict, stream []byte) (err error) {
+		im, err = decodePDFImage(dict, stream)
+		return err
+	})
+	return im, err
+}
+
+// decodePDFConfig returns the dimensions of the image decodePDF would decode, reading only the
+// image's dictionary, or the header of an embedded JPEG.
+func decodePDFConfig(r io.Reader) (image.Config, error) {
+	var config image.Config
+	err := pdfImages(r, func(dict, stream []byte) (err error) {
+		switch pdfDictFilter(dict) {
+		case "DCTDecode":
+			config, err = jpeg.DecodeConfig(bytes.NewReader(stream))
+		case "FlateDecode", "":
+			config, err = pdfRawConfig(dict)
+		default:
+			err = errNoPDFImage
+		}
+		return err
+	})
+	return config, err
+}
+
+// pdfImages calls f with the dictionary and data of each image stream in a PDF, in order, until f
+// returns something other than errNoPDFImage, and returns that.
+func pdfImages(r io.Reader, f func(dict, stream []byte) error) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	for _, loc := range pdfStreamStart.FindAllIndex(data, -1) {
+		dict := pdfDict(data, loc[0])
+		if dict == nil || !pdfImageType.Match(dict) {
+			continue
+		}
+		end := bytes.Index(data[loc[1]:], []byte("endstream"))
+		if end < 0 {
+			continue
+		}
+		if err := f(dict, data[loc[1]:loc[1]+end]); !errors.Is(err, errNoPDFImage) {
+			return err
+		}
+	}
+	return errNoPDFImage
+}
+
+// pdfDict returns the dictionary that ends with the ">>" at end, or nil if it can't be found.
+func pdfDict(data []byte, end int) []byte {
+	depth := 0
+	for j := end + 1; j > 0; {
+		switch {
+		case data[j] == '>' && data[j-1] == '>':
+			depth++
+			j -= 2
+		case data[j] == '<' && data[j-1] == '<':
+			depth--
+			if depth == 0 {
+				return data[j-1 : end+2]
+			}
+			j -= 2
+		default:
+			j--
+		}
+	}
+	return nil
+}
+
+// decodePDFImage decodes an image stream: either an embedded JPEG, or 8-bit gray or RGB pixels
+// that are optionally compressed with zlib. Anything else is errNoPDFImage.
+func decodePDFImage(dict, stream []byte) (image.Image, error) {
+	switch pdfDictFilter(dict) {
+	case "DCTDecode":
+		return jpeg.Decode(bytes.NewReader(stream))
+	case "FlateDecode":
+		zr, err := zlib.NewReader(bytes.NewReader(stream))
+		if err != nil {
+			return nil, err
+		}
+		stream, err = io.ReadAll(zr)
+		if err != nil {
+			return nil, err
+		}
+	case "":
+	default:
+		return nil, errNoPDFImage
+	}
+
+	config, err := pdfRawConfig(dict)
+	if err != nil {
+		return nil, err
+	}
+	w, h := config.Width, config.Height
+	if config.ColorModel == color.GrayModel {
+		if len(stream) < w*h {
+			return nil, fmt.Errorf("pdf: image data is %d bytes, expected %d", len(stream), w*h)
+		}
+		im := image.NewGray(image.Rect(0, 0, w, h))
+		copy(im.Pix, stream)
+		return im, nil
+	}
+	if len(stream) < w*h*3 {
+		return nil, fmt.Errorf("pdf: image data is %d bytes, expected %d", len(stream), w*h*3)
+	}
+	im := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < w*h; i++ {
+		im.SetRGBA(i%w, i/w, color.RGBA{R: stream[3*i], G: stream[3*i+1], B: stream[3*i+2], A: 255})
+	}
+	return im, nil
+}
+
+// pdfRawConfig reads the size and color model of an image stream of 8-bit gray or RGB pixels from
+// its dictionary. Anything else, or a size that is out of range, is errNoPDFImage.
+func pdfRawConfig(dict []byte) (image.Config, error) {
+	w, h, bits := pdfDictInt(dict, pdfWidth), pdfDictInt(dict, pdfHeight), pdfDictInt(dict, pdfBits)
+	if w <= 0 || h <= 0 || w > pdfMaxSide || h > pdfMaxSide || bits != 8 {
+		return image.Config{}, errNoPDFImage
+	}
+	colorSpace := ""
+	if m := pdfColorSpace.FindSubmatch(dict); m != nil {
+		colorSpace = string(m[1])
+	}
+	switch colorSpace {
+	case "DeviceGray":
+		return image.Config{ColorModel: color.GrayModel, Width: w, Height: h}, nil
+	case "DeviceRGB":
+		return image.Config{ColorModel: color.RGBAModel, Width: w, Height: h}, nil
+	}
+	return image.Config{}, errNoPDFImage
+}
+
+// pdfDictFilter returns the name of the filter an image stream is compressed with, or "".
+func pdfDictFilter(dict []byte) string {
+	if m := pdfFilter.FindSubmatch(dict); m != nil {
+		return string(m[1])
+	}
+	return ""
+}
+
+// pdfDictInt finds an integer value in a dictionary, or returns 0.
+func pdfDictInt(dict []byte, re *regexp.Regexp) int {
+	m := re.FindSubmatch(dict)
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(string(m[1]))
+	return n
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2023 Christopher Swenson
+
+//go:build pdf
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/png"
+	"testing"
+)
+
+// testPDF is a one-page PDF of a scan: a page that only draws the image with the given dictionary
+// entries and stream data.
+func testPDF(entries string, stream []byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%%PDF-1.4\n1 0 obj\n<< /Type /Page /Resources << /XObject << /Im0 2 0 R >> >> >>\nendobj\n")
+	fmt.Fprintf(&buf, "2 0 obj\n<< /Type /XObject /Subtype /Image %s /Length %d >>\nstream\n", entries, len(stream))
+	buf.Write(stream)
+	fmt.Fprintf(&buf, "\nendstream\nendobj\n%%%%EOF\n")
+	return buf.Bytes()
+}
+
+func TestPDFMatchesItsRender(t *testing.T) {
+	im := testImage(200, 150, 1)
+	var pixels bytes.Buffer
+	zw := zlib.NewWriter(&pixels)
+	for y := 0; y < 150; y++ {
+		for x := 0; x < 200; x++ {
+			c := im.RGBAAt(x, y)
+			_, _ = zw.Write([]byte{c.R, c.G, c.B})
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	pdf := testPDF("/Width 200 /Height 150 /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /FlateDecode", pixels.Bytes())
+	var render bytes.Buffer
+	if err := png.Encode(&render, im); err != nil {
+		t.Fatal(err)
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(pdf))
+	if err != nil || format != "pdf" || config.Width != 200 || config.Height != 150 {
+		t.Errorf("DecodeConfig = %dx%d %q, %v, want 200x150 pdf", config.Width, config.Height, format, err)
+	}
+	h := testHasher()
+	fromPDF, err := h.fingerprintReader(bytes.NewReader(pdf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromPNG, err := h.fingerprintReader(&render)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fromPDF.Fingerprint != fromPNG.Fingerprint {
+		t.Errorf("PDF fingerprint %v, want the PNG render's %v", fromPDF.Fingerprint, fromPNG.Fingerprint)
+	}
+}
+
+func TestPDFRejectsHugeImages(t *testing.T) {
+	// Sizes whose pixels would overflow are rejected before anything is allocated.
+	for _, size := range []string{"/Width 3037000500 /Height 3037000500", "/Width 99999999999999999999 /Height 1", "/Width -4 /Height -4"} {
+		pdf := testPDF(size+" /ColorSpace /DeviceRGB /BitsPerComponent 8", []byte("tiny"))
+		if _, err := decodePDF(bytes.NewReader(pdf)); err != errNoPDFImage {
+			t.Errorf("%s: decodePDF error %v, want %v", size, err, errNoPDFImage)
+		}
+		if _, err := decodePDFConfig(bytes.NewReader(pdf)); err != errNoPDFImage {
+			t.Errorf("%s: decodePDFConfig error %v, want %v", size, err, errNoPDFImage)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"image"
+	"sync"
+)
+
+// The pipeline makes the same few sizes of intermediate image for every image it fingerprints,
+// so they are kept for reuse once they have been released, rather than left for the garbage
+// collector. Images that aren't released, like thumbnails, are collected as usual.
+var (
+	grayPool sync.Pool
+	rgbaPool sync.Pool
+	intsPool sync.Pool
+)
+
+// newGray is image.NewGray, reusing a released image if there is one big enough.
+func newGray(r image.Rectangle) *image.Gray {
+	n := r.Dx() * r.Dy()
+	if im, ok := grayPool.Get().(*image.Gray); ok && cap(im.Pix) >= n {
+		im.Pix = im.Pix[:n]
+		clear(im.Pix)
+		im.Stride = r.Dx()
+		im.Rect = r
+		return im
+	}
+	return image.NewGray(r)
+}
+
+// newRGBA is image.NewRGBA, reusing a released image if there is one big enough.
+func newRGBA(r image.Rectangle) *image.RGBA {
+	n := 4 * r.Dx() * r.Dy()
+	if im, ok := rgbaPool.Get().(*image.RGBA); ok && cap(im.Pix) >= n {
+		im.Pix = im.Pix[:n]
+		clear(im.Pix)
+		im.Stride = 4 * r.Dx()
+		im.Rect = r
+		return im
+	}
+	return image.NewRGBA(r)
+}
+
+// release gives an image made by newGray or newRGBA back for reuse. Nothing may use it after.
+func release(im image.Image) {
+	switch im := im.(type) {
+	case *image.Gray:
+		grayPool.Put(im)
+	case *image.RGBA:
+		rgbaPool.Put(im)
+	}
+}
+
+// newInts returns n zeros, reusing a slice given to releaseInts if there is one big enough.
+func newInts(n int) *[]int {
+	if s, ok := intsPool.Get().(*[]int); ok && cap(*s) >= n {
+		*s = (*s)[:n]
+		clear(*s)
+		return s
+	}
+	s := make([]int, n)
+	return &s
+}
+
+// releaseInts gives a slice made by newInts back for reuse.
+func releaseInts(s *[]int) {
+	intsPool.Put(s)
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// preprocessor transforms a decoded image before it is fingerprinted.
+type preprocessor func(image.Image) image.Image
+
+// withPreprocessor adds a step to run on each image before fingerprinting it, after any
+// already added. The name distinguishes its fingerprints from those made without it.
+func (h *hasher) withPreprocessor(name string, p preprocessor) *hasher {
+	h.preprocessors = append(h.preprocessors, p)
+	h.preprocessorNames = append(h.preprocessorNames, name)
+	return h
+}
+
+// flattenAlpha draws the image over a white background, so transparent areas hash as white
+// rather than black.
+func flattenAlpha(im image.Image) image.Image {
+	if opaque, ok := im.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return im
+	}
+	newim := image.NewRGBA(im.Bounds())
+	draw.Draw(newim, newim.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(newim, newim.Bounds(), im, im.Bounds().Min, draw.Over)
+	return newim
+}
+
+// borderTolerance is how far, per 16-bit channel, a pixel may be from the border color to count as border.
+const borderTolerance = 0x0800
+
+// trimBorders crops off any border that is the same color as the top-left pixel, such as letterboxing.
+func trimBorders(im image.Image) image.Image {
+	b := im.Bounds()
+	border := im.At(b.Min.X, b.Min.Y)
+	content := image.Rectangle{}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if !similarColor(im.At(x, y), border) {
+				content = content.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	if content.Empty() {
+		return im
+	}
+	return cropImage(im, content.Sub(b.Min))
+}
+
+// similarColor reports whether each channel of a and b are within borderTolerance of each other.
+func similarColor(a, b color.Color) bool {
+	ar, ag, ab, aa := a.RGBA()
+	br, bg, bb, ba := b.RGBA()
+	near := func(x, y uint32) bool {
+		return x-y < borderTolerance || y-x < borderTolerance
+	}
+	return near(ar, br) && near(ag, bg) && near(ab, bb) && near(aa, ba)
+}
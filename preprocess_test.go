@@ -0,0 +1,107 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCustomPreprocessorRunsOncePerImage(t *testing.T) {
+	dir := t.TempDir()
+	var names []string
+	for seed := 1; seed <= 3; seed++ {
+		im := testImage(100, 80, seed)
+		// A transparent corner, which flatten-alpha fills in before the custom step sees it.
+		for y := 0; y < 10; y++ {
+			for x := 0; x < 10; x++ {
+				im.Set(x, y, color.RGBA{})
+			}
+		}
+		name := filepath.Join(dir, fmt.Sprintf("%d.png", seed))
+		writeTestPNG(t, name, im)
+		names = append(names, name)
+	}
+
+	// Several algorithms and -multiscale reduce each image more than once, but preprocess it once.
+	h := testHasher()
+	h.multiscale = true
+	var err error
+	if h.algorithmNames, h.hashes, err = parseAlgorithms("ahash+dhash"); err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	h.withPreprocessor("flatten-alpha", flattenAlpha).withPreprocessor("count", func(im image.Image) image.Image {
+		calls++
+		if _, _, _, a := im.At(im.Bounds().Min.X, im.Bounds().Min.Y).RGBA(); a != 0xffff {
+			t.Error("the custom step ran before flatten-alpha")
+		}
+		return im
+	})
+	for _, name := range names {
+		if _, err := h.fingerprintImage(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != len(names) {
+		t.Errorf("preprocessor ran %d times for %d images", calls, len(names))
+	}
+	if v := h.version(); !strings.HasSuffix(v, ";flatten-alpha;count") {
+		t.Errorf("version %q doesn't name the preprocessors in order", v)
+	}
+}
+
+func TestDenoiseMatchesRecompressedJPEG(t *testing.T) {
+	// A grainy photo, saved as a JPEG and then saved again at quality 50. Unblurred, the block
+	// noise moves the pair just past a tight threshold, and the median filter takes it out.
+	im := testImage(160, 160, 4)
+	rng := rand.New(rand.NewSource(4))
+	for y := 0; y < 160; y++ {
+		for x := 0; x < 160; x++ {
+			c, d := im.RGBAAt(x, y), rng.Intn(61)-30
+			c.R = uint8(max(0, min(255, int(c.R)+d)))
+			c.G = uint8(max(0, min(255, int(c.G)+d)))
+			im.SetRGBA(x, y, c)
+		}
+	}
+	dir := t.TempDir()
+	encode := func(name string, im image.Image, quality int) image.Image {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, im, &jpeg.Options{Quality: quality}); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := jpeg.Decode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return decoded
+	}
+	encode("recompressed.jpg", encode("original.jpg", im, 95), 50)
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"-denoise"}, "Possible matches: original.jpg recompressed.jpg"},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append(tc.args, "-blur-radius", "0", "-threshold", "2", "-quiet", "-base", dir, dir)
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if got := strings.Join(strings.Fields(stdout.String()), " "); got != tc.want {
+			t.Errorf("%q: got %q, want %q", args, got, tc.want)
+		}
+	}
+}
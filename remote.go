@@ -0,0 +1,71 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// remoteIndex asks a -serve server for the images in its index that match local images, by
+// their fingerprints, so that the index doesn't have to be copied to every machine.
+type remoteIndex struct {
+	client *http.Client
+	// base is the server's address, like http://host:8080.
+	base string
+	// version is the hasher's version, which the server checks against its own.
+	version string
+}
+
+// match returns the images in the index that match the image's fingerprints, closest first.
+// Their distances are in the server's -distance-unit.
+func (r *remoteIndex) match(im imageInfo) ([]serveMatch, error) {
+	text, _ := im.Fingerprint.MarshalText()
+	q := url.Values{"fingerprint": {string(text)}, "version": {r.version}}
+	for _, f := range im.Extra {
+		text, _ := f.MarshalText()
+		q.Add("extra", string(text))
+	}
+	resp, err := r.client.Post(strings.TrimSuffix(r.base, "/")+"/match?"+q.Encode(), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var body serveResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Matches, nil
+}
+
+// writeMatches prints, for each image with any matches in the index, its path and then the
+// distance and path of each match, like -nearest. It stops at the first query that fails.
+func (r *remoteIndex) writeMatches(w io.Writer, images []imageInfo, paths pathStyle) error {
+	for _, im := range images {
+		matches, err := r.match(im)
+		if err != nil {
+			return fmt.Errorf("querying %s for %s: %w", r.base, im.Path, err)
+		}
+		if len(matches) == 0 {
+			continue
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "Matches for %s:\n", paths.format(im.Path))
+		for _, m := range matches {
+			fmt.Fprintf(&b, "%s\t%s\n", strconv.FormatFloat(m.Distance, 'f', -1, 64), m.Path)
+		}
+		b.WriteString("\n")
+		if _, err := io.WriteString(w, b.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// errorReporter reports files that are skipped or only partly used, either as messages or,
+// with -errors json, as one JSON object per line. It counts the files it skips.
+type errorReporter struct {
+	w       io.Writer
+	json    bool
+	skipped skipCounts
+}
+
+// fileError is how errorReporter reports a file as JSON.
+type fileError struct {
+	Path    string `json:"path"`
+	Kind    string `json:"kind"`
+	Error   string `json:"error"`
+	Skipped bool   `json:"skipped"`
+}
+
+// skip reports a file that was left out because of an error while doing action, like "decoding image".
+func (r *errorReporter) skip(action, path string, err error) {
+	r.skipped.add(err)
+	if r.json {
+		r.encode(fileError{Path: path, Kind: errorKind(err), Error: err.Error(), Skipped: true})
+	} else if errors.Is(err, errDecodeTimeout) {
+		_, _ = fmt.Fprintf(r.w, "Timed out decoding image %s; skipping.\n", path)
+	} else {
+		_, _ = fmt.Fprintf(r.w, "Error %s %s; ignoring. %v\n", action, path, err)
+	}
+}
+
+// partial reports an image that was used even though only part of it could be decoded.
+func (r *errorReporter) partial(path string) {
+	if r.json {
+		r.encode(fileError{Path: path, Kind: errorKind(errPartialImage), Error: errPartialImage.Error()})
+	} else {
+		_, _ = fmt.Fprintf(r.w, "Image %s is incomplete; using the part that could be decoded.\n", path)
+	}
+}
+
+func (r *errorReporter) encode(e fileError) {
+	_ = json.NewEncoder(r.w).Encode(e)
+}
+
+// summarize reports how many files were skipped of each kind, if any were. The JSON records
+// already say as much, so there is no summary with -errors json.
+func (r *errorReporter) summarize() {
+	if n := r.skipped.total(); n > 0 && !r.json {
+		_, _ = fmt.Fprintf(r.w, "Skipped %d files that could not be fingerprinted: %v.\n", n, &r.skipped)
+	}
+}
+
+// skipCounts counts the files that were skipped because of each kind of error.
+type skipCounts struct {
+	notImage, unsupported, tooLarge, corrupt, unreadable, timedOut, other int
+}
+
+// errorKind names the kind of error that err is, for -errors json and skipCounts.
+func errorKind(err error) string {
+	var pathErr *fs.PathError
+	switch {
+	case errors.Is(err, errPartialImage):
+		return "partial"
+	case errors.Is(err, errNotImage):
+		return "not-an-image"
+	case errors.Is(err, errUnsupportedFormat):
+		return "unsupported-format"
+	case errors.Is(err, errTooLarge):
+		return "too-large"
+	case errors.Is(err, errDecode):
+		return "corrupt"
+	case errors.Is(err, errIO), errors.As(err, &pathErr):
+		return "unreadable"
+	case errors.Is(err, errDecodeTimeout):
+		return "timed-out"
+	default:
+		return "other"
+	}
+}
+
+// add counts a file skipped because of err.
+func (c *skipCounts) add(err error) {
+	switch errorKind(err) {
+	case "not-an-image":
+		c.notImage++
+	case "unsupported-format":
+		c.unsupported++
+	case "too-large":
+		c.tooLarge++
+	case "corrupt":
+		c.corrupt++
+	case "unreadable":
+		c.unreadable++
+	case "timed-out":
+		c.timedOut++
+	default:
+		c.other++
+	}
+}
+
+// total is the number of files skipped.
+func (c *skipCounts) total() int {
+	return c.notImage + c.unsupported + c.tooLarge + c.corrupt + c.unreadable + c.timedOut + c.other
+}
+
+// String summarizes the counts, leaving out kinds with none, e.g. "2 unsupported format, 1 corrupt".
+func (c *skipCounts) String() string {
+	var parts []string
+	for _, k := range []struct {
+		n    int
+		name string
+	}{
+		{c.notImage, "not an image"},
+		{c.unsupported, "unsupported format"},
+		{c.tooLarge, "too large"},
+		{c.corrupt, "corrupt"},
+		{c.unreadable, "unreadable"},
+		{c.timedOut, "timed out"},
+		{c.other, "other errors"},
+	} {
+		if k.n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", k.n, k.name))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
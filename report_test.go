@@ -0,0 +1,58 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestErrorsJSONRecords(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPNG(t, filepath.Join(dir, "a.png"), testImage(64, 48, 1))
+	writeTestPNG(t, filepath.Join(dir, "b.png"), testImage(64, 48, 1))
+	var pngData, jpegData bytes.Buffer
+	if err := png.Encode(&pngData, testImage(64, 48, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := jpeg.Encode(&jpegData, testImage(160, 120, 3), nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		"corrupt.png":   pngData.Bytes()[:pngData.Len()/2],
+		"notes.png":     []byte("just some notes, not an image at all\n"),
+		"truncated.jpg": jpegData.Bytes()[:jpegData.Len()*9/10],
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-errors", "json", "-format", "json", "-strict-decode=false", dir}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	// Every line of stderr is a record of its own.
+	got := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSuffix(stderr.String(), "\n"), "\n") {
+		var e fileError
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("stderr line %q: %v", line, err)
+		}
+		got[filepath.Base(e.Path)] = fmt.Sprintf("%s skipped=%v", e.Kind, e.Skipped)
+	}
+	want := map[string]string{
+		"corrupt.png":   "corrupt skipped=true",
+		"notes.png":     "not-an-image skipped=true",
+		"truncated.jpg": "partial skipped=false",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("records %v, want %v", got, want)
+	}
+}
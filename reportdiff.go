@@ -0,0 +1,139 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// readReport reads the groups printed by an earlier run with -format json or -format jsonl.
+func readReport(name string) ([]group, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	// -format json is one array, and -format jsonl is one group per line.
+	start, err := r.Peek(1)
+	for err == nil && bytes.ContainsAny(start, " \t\r\n") {
+		_, _ = r.ReadByte()
+		start, err = r.Peek(1)
+	}
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(r)
+	var groups []group
+	if start[0] == '[' {
+		if err := dec.Decode(&groups); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		return groups, nil
+	}
+	for dec.More() {
+		var g group
+		if err := dec.Decode(&g); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+// groupKey identifies a group by its files, since group IDs depend on the order files were found in.
+func groupKey(g *group) string {
+	var paths []string
+	for _, member := range g.Members {
+		paths = append(paths, member.Path)
+	}
+	slices.Sort(paths)
+	return strings.Join(paths, "\x00")
+}
+
+// reportDiff is what changed between two reports.
+type reportDiff struct {
+	// addedGroups and removedGroups are the groups whose files are only grouped together in the new
+	// or the old report.
+	addedGroups, removedGroups []group
+	// addedFiles and removedFiles are the files that are only in a group in the new or the old report.
+	addedFiles, removedFiles []string
+}
+
+// diffReports compares the groups of an earlier report with those of a later one.
+func diffReports(older, newer []group) reportDiff {
+	var d reportDiff
+	oldKeys, newKeys := map[string]bool{}, map[string]bool{}
+	oldFiles, newFiles := map[string]bool{}, map[string]bool{}
+	for i := range older {
+		oldKeys[groupKey(&older[i])] = true
+		for _, member := range older[i].Members {
+			oldFiles[member.Path] = true
+		}
+	}
+	for i := range newer {
+		newKeys[groupKey(&newer[i])] = true
+		for _, member := range newer[i].Members {
+			newFiles[member.Path] = true
+			if !oldFiles[member.Path] {
+				d.addedFiles = append(d.addedFiles, member.Path)
+			}
+		}
+		if !oldKeys[groupKey(&newer[i])] {
+			d.addedGroups = append(d.addedGroups, newer[i])
+		}
+	}
+	for i := range older {
+		if !newKeys[groupKey(&older[i])] {
+			d.removedGroups = append(d.removedGroups, older[i])
+		}
+		for _, member := range older[i].Members {
+			if !newFiles[member.Path] {
+				d.removedFiles = append(d.removedFiles, member.Path)
+			}
+		}
+	}
+	return d
+}
+
+// write prints the differences, a section for each kind of change, or "No changes".
+func (d *reportDiff) write(w io.Writer) error {
+	var b strings.Builder
+	writeGroups := func(title string, groups []group) {
+		if len(groups) == 0 {
+			return
+		}
+		fmt.Fprintf(&b, "%s:\n", title)
+		for _, g := range groups {
+			fmt.Fprintf(&b, "group %d:\n", g.ID)
+			for _, member := range g.Members {
+				fmt.Fprintf(&b, "\t%s\n", member.Path)
+			}
+		}
+		b.WriteString("\n")
+	}
+	writeFiles := func(title string, paths []string) {
+		if len(paths) == 0 {
+			return
+		}
+		fmt.Fprintf(&b, "%s:\n%s\n\n", title, strings.Join(paths, "\n"))
+	}
+	writeGroups("New groups", d.addedGroups)
+	writeGroups("Groups that are gone", d.removedGroups)
+	writeFiles("Files newly in a group", d.addedFiles)
+	writeFiles("Files no longer in a group", d.removedFiles)
+	if b.Len() == 0 {
+		b.WriteString("No changes\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDedupeReportAddedAndRemoved(t *testing.T) {
+	dir := t.TempDir()
+	// Last week's report is -format json, this week's -format jsonl. a and b are still grouped,
+	// under another ID; e joined c and d, f and g are new, and h and i are gone.
+	older := filepath.Join(dir, "old.json")
+	newer := filepath.Join(dir, "new.jsonl")
+	files := map[string]string{
+		older: `[
+  {"id": 1, "members": [{"path": "a"}, {"path": "b"}]},
+  {"id": 2, "members": [{"path": "c"}, {"path": "d"}]},
+  {"id": 3, "members": [{"path": "h"}, {"path": "i"}]}
+]
+`,
+		newer: `{"id": 1, "members": [{"path": "f"}, {"path": "g"}]}
+{"id": 2, "members": [{"path": "b"}, {"path": "a"}]}
+{"id": 3, "members": [{"path": "c"}, {"path": "d"}, {"path": "e"}]}
+`,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(name, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-dedupe-report", older, newer}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	want := "New groups:\ngroup 1:\n\tf\n\tg\ngroup 3:\n\tc\n\td\n\te\n\n" +
+		"Groups that are gone:\ngroup 2:\n\tc\n\td\ngroup 3:\n\th\n\ti\n\n" +
+		"Files newly in a group:\nf\ng\ne\n\n" +
+		"Files no longer in a group:\nh\ni\n\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	stdout.Reset()
+	if code := run([]string{"-dedupe-report", newer, newer}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	if got := stdout.String(); got != "No changes\n" {
+		t.Errorf("comparing a report with itself gave %q", got)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// reviewer is the state of an interactive review of the groups: which group is shown, and which
+// file of each group is to be kept. It is driven one key at a time, so it doesn't need a terminal.
+type reviewer struct {
+	groups []*group
+	// keep is the index of the member of each group to keep, or -1 to keep all of them.
+	keep    []int
+	current int
+	// done is set when the review is over, and quit if it was abandoned without deleting anything.
+	done bool
+	quit bool
+}
+
+// newReviewer starts a review of groups, with the keepers chosen by keep.
+func newReviewer(groups []*group, keep *keepPolicy) *reviewer {
+	r := &reviewer{groups: groups}
+	for _, g := range groups {
+		r.keep = append(r.keep, keep.keeper(g))
+	}
+	r.done = len(groups) == 0
+	return r
+}
+
+// key handles one keystroke:
+//
+//	1-9      keep that file of the group and go on to the next one
+//	a        keep all the files of the group and go on
+//	n, space go on to the next group without changing it
+//	p        go back to the previous group
+//	w        finish, deleting the files that aren't kept
+//	q        quit without deleting anything
+//
+// Going on from the last group finishes the review. Other keys are ignored.
+func (r *reviewer) key(k rune) {
+	if r.done {
+		return
+	}
+	switch {
+	case k >= '1' && k <= '9':
+		i := int(k - '1')
+		if i >= len(r.groups[r.current].Members) {
+			return
+		}
+		r.keep[r.current] = i
+		r.next()
+	case k == 'a':
+		r.keep[r.current] = -1
+		r.next()
+	case k == 'n' || k == ' ':
+		r.next()
+	case k == 'p':
+		r.current = max(0, r.current-1)
+	case k == 'w':
+		r.done = true
+	case k == 'q':
+		r.done = true
+		r.quit = true
+	}
+}
+
+func (r *reviewer) next() {
+	r.current++
+	if r.current == len(r.groups) {
+		r.current--
+		r.done = true
+	}
+}
+
+// plan returns the files to delete: all but the one to keep of each group. It is empty if the review was quit.
+func (r *reviewer) plan() []string {
+	if r.quit {
+		return nil
+	}
+	var paths []string
+	for i, g := range r.groups {
+		if r.keep[i] < 0 {
+			continue
+		}
+		for j, member := range g.Members {
+			if j != r.keep[i] {
+				paths = append(paths, member.Path)
+			}
+		}
+	}
+	return paths
+}
+
+// show prints the current group, marking the file to keep.
+func (r *reviewer) show(w io.Writer) {
+	g := r.groups[r.current]
+	_, _ = fmt.Fprintf(w, "Group %d of %d:\n", r.current+1, len(r.groups))
+	for i, member := range g.Members {
+		mark := " "
+		if r.keep[r.current] < 0 || r.keep[r.current] == i {
+			mark = "*"
+		}
+		_, _ = fmt.Fprintf(w, "%s %d) %s  %dx%d, %d bytes, %s\n", mark, i+1, member.Path,
+			member.Width, member.Height, member.Size, member.ModTime.Format("2006-01-02 15:04"))
+	}
+	_, _ = fmt.Fprintf(w, "Keep [1-9], keep [a]ll, [n]ext, [p]revious, [w]rite, or [q]uit: ")
+}
+
+// review steps through the groups, reading keys from in a line at a time; an empty line goes
+// on to the next group. Once the review is done it asks for confirmation and deletes the files
+// that weren't kept, reporting any it can't delete to stderr.
+func review(in io.Reader, w, stderr io.Writer, groups []*group, keep *keepPolicy) error {
+	r := newReviewer(groups, keep)
+	lines := bufio.NewScanner(in)
+	for !r.done {
+		r.show(w)
+		if !lines.Scan() {
+			r.key('q')
+			break
+		}
+		if strings.TrimSpace(lines.Text()) == "" {
+			r.key('n')
+		} else {
+			for _, k := range lines.Text() {
+				r.key(k)
+			}
+		}
+		_, _ = fmt.Fprintln(w)
+	}
+	plan := r.plan()
+	if len(plan) == 0 {
+		_, err := fmt.Fprintf(w, "Nothing to delete.\n")
+		return err
+	}
+	_, _ = fmt.Fprintf(w, "Delete these %d files?\n%s\n[y/N]: ", len(plan), strings.Join(plan, "\n"))
+	if !lines.Scan() || strings.ToLower(strings.TrimSpace(lines.Text())) != "y" {
+		_, err := fmt.Fprintf(w, "Nothing deleted.\n")
+		return err
+	}
+	deleted := 0
+	for _, path := range plan {
+		if err := os.Remove(path); err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error deleting %s: %v\n", path, err)
+			continue
+		}
+		deleted++
+	}
+	_, err := fmt.Fprintf(w, "Deleted %d files.\n", deleted)
+	return err
+}
+
+// reviewWriter collects all the groups and then reviews them interactively.
+type reviewWriter struct {
+	in        io.Reader
+	w, stderr io.Writer
+	keep      *keepPolicy
+	groups    []*group
+}
+
+func (r *reviewWriter) writeGroup(g *group) error {
+	r.groups = append(r.groups, g)
+	return nil
+}
+
+func (r *reviewWriter) close() error {
+	return review(r.in, r.w, r.stderr, r.groups, r.keep)
+}
@@ -0,0 +1,312 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// scanRoot is a positional argument to scan for images.
+type scanRoot struct {
+	path string
+	// origin is the argument's position, counting from 1.
+	origin int
+	// jobs is how many directories to read and files to fingerprint at once under this root.
+	jobs int
+}
+
+// scanner fingerprints the images under the positional arguments.
+type scanner struct {
+	h             *hasher
+	extensions    []string
+	caseSensitive bool
+	includeHidden bool
+	// sniffExtensionless also fingerprints files without an extension that turn out to be images.
+	sniffExtensionless bool
+	// archives also fingerprints the images inside tar archives; see fingerprintTar.
+	archives bool
+	// exifConfirm reads each photo's EXIF data, for -exif-confirm.
+	exifConfirm bool
+	// dumpDir, if set, is where to save the steps of fingerprinting each file; see dumpIntermediates.
+	dumpDir string
+	inputs  *inputSet
+	errs    *errorReporter
+	// cp, if set, has the fingerprints saved by an earlier run, and saves the new ones as they
+	// are computed. cpMu guards it, since files are fingerprinted concurrently.
+	cp   *checkpoint
+	cpMu sync.Mutex
+	// indexed holds the fingerprints from -since-index that haven't been found again yet, by path.
+	indexed map[string]imageInfo
+	verbose bool
+	stdout  io.Writer
+	// fingerprinted counts the images scan fingerprinted, and reused those whose fingerprints it
+	// took from -since-index or the checkpoint instead.
+	fingerprinted, reused int
+}
+
+// scanFile is a file found by scan, and what became of it.
+type scanFile struct {
+	foundFile
+	im imageInfo
+	// entries are the images in the file, if it is an archive.
+	entries []archiveImage
+	// decodeErr is why the file couldn't be fingerprinted, or the archive read, recordErr why
+	// it couldn't be saved to the checkpoint, and dumpErr why its steps couldn't be saved.
+	decodeErr, recordErr, dumpErr error
+	// done is false for files that weren't reached before ctx was done.
+	done bool
+	// ignored is set for files without an extension that turned out not to be images.
+	ignored bool
+	// reused is set for files whose fingerprint was found by lookup.
+	reused bool
+}
+
+// scan fingerprints the files under each root that have one of the extensions. The roots are
+// scanned at the same time, each with its own jobs, so that a slow disk doesn't hold up a fast
+// one, but the images are returned in the order of the roots and then the order the files were
+// found in. Files that can't be fingerprinted are reported and skipped; it only fails if the
+// checkpoint can't be written. If ctx is done, it returns the images found so far.
+func (s *scanner) scan(ctx context.Context, roots []scanRoot) ([]imageInfo, error) {
+	if s.verbose {
+		for _, root := range roots {
+			_, _ = fmt.Fprintf(s.stdout, "Scanning %s\n", root.path)
+		}
+	}
+	found := make([][]foundFile, len(roots))
+	eachRoot(roots, func(i int, root scanRoot) {
+		found[i] = s.list(ctx, root)
+	})
+
+	// Which files are new is decided in order, so that a file reached through two roots counts
+	// as the first one's.
+	files := make([][]*scanFile, len(roots))
+	for i, root := range roots {
+		for _, f := range found[i] {
+			if f.err == nil && (!s.wanted(f.path) || !s.inputs.add(f.path)) {
+				continue
+			}
+			sf := &scanFile{foundFile: f}
+			if s.isArchive(f.path) {
+				// Archives are read again each time, since their entries aren't saved by path.
+			} else if saved, ok := s.lookup(f); ok {
+				saved.Origin = root.origin
+				sf.im, sf.done, sf.reused = saved, true, true
+			}
+			files[i] = append(files[i], sf)
+		}
+	}
+
+	eachRoot(roots, func(i int, root scanRoot) {
+		forEachParallel(ctx, len(files[i]), root.jobs, func(j int) {
+			if f := files[i][j]; f.err == nil && !f.done {
+				s.fingerprint(ctx, f, root.origin)
+			}
+		})
+	})
+
+	var images []imageInfo
+	for i := range roots {
+		for _, f := range files[i] {
+			if f.err != nil {
+				s.errs.skip("scanning", f.path, f.err)
+				continue
+			}
+			if !f.done || f.ignored {
+				continue
+			}
+			if s.isArchive(f.path) {
+				for _, entry := range f.entries {
+					if s.usable(entry.im.Path, entry.err) {
+						images = append(images, entry.im)
+						s.fingerprinted++
+					}
+				}
+				if f.decodeErr != nil {
+					s.errs.skip("reading archive", f.path, f.decodeErr)
+				}
+				continue
+			}
+			if !s.usable(f.path, f.decodeErr) {
+				continue
+			}
+			if f.recordErr != nil {
+				return images, f.recordErr
+			}
+			if f.dumpErr != nil {
+				_, _ = fmt.Fprintf(s.errs.w, "Error saving intermediates of %s: %v\n", f.path, f.dumpErr)
+			}
+			images = append(images, f.im)
+			if f.reused {
+				s.reused++
+			} else {
+				s.fingerprinted++
+			}
+		}
+	}
+	return images, nil
+}
+
+// wanted reports whether a file should be fingerprinted, by its name.
+func (s *scanner) wanted(path string) bool {
+	return hasExtension(path, s.extensions, s.caseSensitive) || s.isArchive(path) || s.isExtensionless(path)
+}
+
+// isExtensionless reports whether a file has no extension, and so is to be fingerprinted if its
+// contents are an image.
+func (s *scanner) isExtensionless(path string) bool {
+	return s.sniffExtensionless && filepath.Ext(path) == ""
+}
+
+// isArchive reports whether a file is an archive to look for images in.
+func (s *scanner) isArchive(path string) bool {
+	return s.archives && isTar(path)
+}
+
+// usable reports whether an image can be used despite the error fingerprinting it, if any,
+// reporting it if not.
+func (s *scanner) usable(path string, err error) bool {
+	if errors.Is(err, errSolidImage) {
+		if s.verbose {
+			_, _ = fmt.Fprintf(s.stdout, "Skipping solid color image %s\n", path)
+		}
+		return false
+	}
+	if errors.Is(err, errPartialImage) {
+		s.errs.partial(path)
+	} else if err != nil {
+		s.errs.skip("decoding image", path, err)
+		return false
+	}
+	return true
+}
+
+// eachRoot calls f for all the roots at once, and waits for them all.
+func eachRoot(roots []scanRoot, f func(i int, root scanRoot)) {
+	var wg sync.WaitGroup
+	for i, root := range roots {
+		wg.Add(1)
+		go func(i int, root scanRoot) {
+			defer wg.Done()
+			f(i, root)
+		}(i, root)
+	}
+	wg.Wait()
+}
+
+// list returns the files under root, or root itself if it is a file.
+func (s *scanner) list(ctx context.Context, root scanRoot) []foundFile {
+	info, err := os.Stat(root.path)
+	if err != nil {
+		return []foundFile{{path: root.path, err: err}}
+	}
+	// Files given directly, as scripts often do, don't need to be walked.
+	if info.Mode().IsRegular() {
+		return []foundFile{{path: root.path, info: info}}
+	}
+	return walkFiles(ctx, root.path, root.jobs, s.includeHidden)
+}
+
+// lookup returns the fingerprint of a file from -since-index or the checkpoint, if it has one.
+func (s *scanner) lookup(f foundFile) (imageInfo, bool) {
+	if saved, ok := s.indexed[f.path]; ok {
+		delete(s.indexed, f.path)
+		return saved, true
+	}
+	if s.cp != nil {
+		return s.cp.lookup(f.path, f.info)
+	}
+	return imageInfo{}, false
+}
+
+// fingerprint fingerprints a file and saves it to the checkpoint, or fingerprints the images in an archive.
+// If ctx is done before the file is fingerprinted, it is left as not reached.
+func (s *scanner) fingerprint(ctx context.Context, f *scanFile, origin int) {
+	f.done = true
+	if s.isArchive(f.path) {
+		f.entries, f.decodeErr = s.h.fingerprintTar(f.path, s.extensions, s.caseSensitive, s.includeHidden)
+		for i := range f.entries {
+			f.entries[i].im.Origin = origin
+		}
+		return
+	}
+	if s.isExtensionless(f.path) && !isImageFile(f.path) {
+		f.ignored = true
+		return
+	}
+	f.im, f.decodeErr = fingerprintUntil(ctx, s.h, f.path)
+	if ctx.Err() != nil && errors.Is(f.decodeErr, ctx.Err()) {
+		f.done = false
+		return
+	}
+	if f.decodeErr != nil && !errors.Is(f.decodeErr, errPartialImage) {
+		return
+	}
+	f.im.Path = f.path
+	f.im.Size = f.info.Size()
+	f.im.ModTime = f.info.ModTime()
+	f.im.Origin = origin
+	if s.exifConfirm {
+		f.im.EXIF, _ = readEXIFFile(f.path)
+	}
+	if s.dumpDir != "" {
+		f.dumpErr = s.h.dumpIntermediates(s.dumpDir, f.path)
+	}
+	if s.cp != nil {
+		s.cpMu.Lock()
+		f.recordErr = s.cp.record(f.im)
+		s.cpMu.Unlock()
+	}
+}
+
+// fingerprintUntil fingerprints the named image, but returns ctx.Err() if ctx is done first, so
+// that -max-duration isn't held up by a slow decode. Like a decode that runs past
+// -decode-timeout, the fingerprint is left to finish in the background.
+func fingerprintUntil(ctx context.Context, h *hasher, name string) (imageInfo, error) {
+	if ctx.Done() == nil {
+		return h.fingerprintImage(name)
+	}
+	type result struct {
+		im  imageInfo
+		err error
+	}
+	// done is buffered so that the goroutine can always send its result and exit.
+	done := make(chan result, 1)
+	go func() {
+		im, err := h.fingerprintImage(name)
+		done <- result{im, err}
+	}()
+	select {
+	case res := <-done:
+		return res.im, res.err
+	case <-ctx.Done():
+		return imageInfo{}, ctx.Err()
+	}
+}
+
+// forEachParallel calls f with each of 0 to n-1, jobs at a time, and waits for them all.
+// Once ctx is done, the calls that haven't started yet are skipped.
+func forEachParallel(ctx context.Context, n, jobs int, f func(i int)) {
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < max(1, jobs); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if ctx.Err() == nil {
+					f(i)
+				}
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// busyMagic starts the files of a test format whose decoder takes a while, and counts how many
+// files with the same tag, which follows the magic, it is decoding at once.
+const busyMagic = "BUSYTEST"
+
+var busy struct {
+	mu       sync.Mutex
+	now, max map[string]int
+}
+
+func init() {
+	decode := func(r io.Reader) (image.Image, error) {
+		data, _ := io.ReadAll(r)
+		tag := strings.TrimPrefix(string(data), busyMagic)
+		busy.mu.Lock()
+		busy.now[tag]++
+		busy.max[tag] = max(busy.max[tag], busy.now[tag])
+		busy.mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		busy.mu.Lock()
+		busy.now[tag]--
+		busy.mu.Unlock()
+		return nil, io.ErrUnexpectedEOF
+	}
+	image.RegisterFormat("busytest", busyMagic, decode, func(r io.Reader) (image.Config, error) {
+		_, err := decode(r)
+		return image.Config{}, err
+	})
+}
+
+func TestListFileArgumentsWithoutWalking(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.png"), filepath.Join(dir, "b.png")
+	writeTestPNG(t, a, testImage(64, 48, 1))
+	writeTestPNG(t, b, testImage(64, 48, 1))
+
+	// Walking a file fails, since it can't be read as a directory, so a file listed without an
+	// error wasn't walked.
+	if files := walkFiles(context.Background(), a, 1, false); len(files) != 1 || files[0].err == nil {
+		t.Fatalf("walking a file gave %+v, want an error", files)
+	}
+	s := &scanner{}
+	for _, name := range []string{a, b} {
+		files := s.list(context.Background(), scanRoot{path: name, jobs: 1})
+		if len(files) != 1 || files[0].path != name || files[0].err != nil || files[0].info == nil || files[0].info.Name() != filepath.Base(name) {
+			t.Errorf("list(%q) = %+v, want just the file, as it is", name, files)
+		}
+	}
+	if files := s.list(context.Background(), scanRoot{path: dir, jobs: 1}); len(files) != 2 {
+		t.Errorf("list(%q) = %+v, want the two files in it", dir, files)
+	}
+}
+
+func TestWorkersPerDiskSetsJobsPerRoot(t *testing.T) {
+	busy.now, busy.max = map[string]int{}, map[string]int{}
+	var args []string
+	for _, tag := range []string{"ssd", "hdd"} {
+		dir := t.TempDir()
+		for i := 0; i < 8; i++ {
+			if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.png", i)), []byte(busyMagic+tag), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		args = append(args, dir)
+	}
+	var stdout, stderr bytes.Buffer
+	args = append([]string{"-jobs", "2", "-workers-per-disk", "4,1"}, args...)
+	if code := run(args, &stdout, &stderr); code != 0 {
+		t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+	}
+	busy.mu.Lock()
+	defer busy.mu.Unlock()
+	if busy.max["ssd"] != 4 || busy.max["hdd"] != 1 {
+		t.Errorf("decoded up to %d files at once from the first argument and %d from the second, want 4 and 1", busy.max["ssd"], busy.max["hdd"])
+	}
+}
+
+func TestSniffExtensionlessFindsJPEG(t *testing.T) {
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(160, 120, 1), &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		"photo.jpg": buf.Bytes(),
+		"IMG_0001":  buf.Bytes(),
+		"README":    []byte("not an image, and not worth mentioning\n"),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"-sniff-extensionless"}, "Possible matches: IMG_0001 photo.jpg"},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append(tc.args, "-quiet", "-base", dir, dir)
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if got := strings.Join(strings.Fields(stdout.String()), " "); got != tc.want {
+			t.Errorf("%q: got %q, want %q", args, got, tc.want)
+		}
+		// Files without an extension that aren't images are left out without a word.
+		if stderr.Len() > 0 {
+			t.Errorf("%q: unexpected stderr %q", args, stderr.String())
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// serveMaxUpload is the largest image that -serve accepts.
+const serveMaxUpload = 64 << 20
+
+// server answers -serve queries for the images that match an uploaded image or fingerprint.
+type server struct {
+	h      *hasher
+	m      *matcher
+	images []imageInfo
+	paths  pathStyle
+	// mu makes queries take turns, since the matcher caches the crops of -crop-tolerant and
+	// counts -stats as it goes.
+	mu sync.Mutex
+}
+
+// serveMatch is one image in the response to a query.
+type serveMatch struct {
+	Path string `json:"path"`
+	// Distance is in the matcher's unit.
+	Distance float64 `json:"distance"`
+}
+
+// serveResponse is the response to a query: the matches, closest first.
+type serveResponse struct {
+	Matches []serveMatch `json:"matches"`
+}
+
+// ServeHTTP answers POST /match. The body is an image to fingerprint, or, with a fingerprint
+// parameter, empty. With more than one -algorithm, the fingerprint of the first comes with an
+// extra parameter for each of the others. A fingerprint can come with the version it was
+// computed with, which must be this server's, so that fingerprints from different settings
+// aren't compared. The response is a serveResponse.
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/match" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var q imageInfo
+	if text := r.URL.Query().Get("fingerprint"); text != "" {
+		f, err := parseFingerprint(text)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if v := r.URL.Query().Get("version"); v != "" && v != s.h.version() {
+			http.Error(w, fmt.Sprintf("fingerprint version %q doesn't match the index's %q", v, s.h.version()), http.StatusConflict)
+			return
+		}
+		q.Fingerprint = f
+		// Every hash of -algorithm has to match, so all of them are needed.
+		for _, text := range r.URL.Query()["extra"] {
+			f, err := parseFingerprint(text)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			q.Extra = append(q.Extra, f)
+		}
+		if want := max(1, len(s.h.hashes)) - 1; len(q.Extra) != want {
+			http.Error(w, fmt.Sprintf("got %d extra fingerprints, but the index has %d for each image", len(q.Extra), want), http.StatusBadRequest)
+			return
+		}
+	} else {
+		// The body is read before decoding, since a decode that runs past -decode-timeout carries
+		// on reading in the background, after the request is over.
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, serveMaxUpload))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("images are limited to %d bytes", serveMaxUpload), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("reading image: %v", err), http.StatusBadRequest)
+			return
+		}
+		q, err = s.h.fingerprintReader(bytes.NewReader(data))
+		if err != nil && !errors.Is(err, errPartialImage) {
+			http.Error(w, fmt.Sprintf("decoding image: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	matches := s.m.matchesOf(s.images, &q)
+	s.mu.Unlock()
+	resp := serveResponse{Matches: []serveMatch{}}
+	for _, n := range matches {
+		resp.Matches = append(resp.Matches, serveMatch{
+			Path:     s.paths.format(s.images[n.index].Path),
+			Distance: s.m.unit.value(float64(n.distance)),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// serve answers queries for the images that match images on addr, like ":8080", until it fails.
+func (s *server) serve(addr string, stdout io.Writer, verbose bool) error {
+	if verbose {
+		_, _ = fmt.Fprintf(stdout, "Serving %d images on %s\n", len(s.images), addr)
+	}
+	return http.ListenAndServe(addr, s)
+}
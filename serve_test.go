@@ -0,0 +1,138 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testServer serves the testdata images, fingerprinted with the given -algorithm.
+func testServer(t *testing.T, algorithm string) *server {
+	t.Helper()
+	h := testHasher()
+	var err error
+	h.algorithmNames, h.hashes, err = parseAlgorithms(algorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var images []imageInfo
+	for _, name := range testdataImages {
+		im, err := h.fingerprintImage(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		im.Path = name
+		images = append(images, im)
+	}
+	m := &matcher{distance: hamming, thresholdBits: percentToBits(10)}
+	return &server{h: h, m: m, images: images}
+}
+
+func TestServeNeedsEveryHash(t *testing.T) {
+	s := testServer(t, "ahash+dhash")
+	text, _ := s.images[0].Fingerprint.MarshalText()
+	extra, _ := s.images[0].Extra[0].MarshalText()
+	for _, tc := range []struct {
+		query string
+		code  int
+	}{
+		{"fingerprint=" + string(text), http.StatusBadRequest},
+		{"fingerprint=" + string(text) + "&extra=" + string(extra), http.StatusOK},
+		{"fingerprint=" + string(text) + "&extra=" + string(extra) + "&extra=" + string(extra), http.StatusBadRequest},
+		{"fingerprint=" + string(text) + "&extra=nothex", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/match?"+tc.query, nil))
+		if w.Code != tc.code {
+			t.Errorf("%s: status %d, want %d; %s", tc.query, w.Code, tc.code, w.Body)
+		}
+	}
+}
+
+func TestRemoteIndexMatchesLocally(t *testing.T) {
+	s := testServer(t, "ahash+dhash")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	remote := &remoteIndex{client: ts.Client(), base: ts.URL, version: s.h.version()}
+	// The last query has the first image's first hash, but a second hash unlike any other, so
+	// it mustn't match anything.
+	queries := append([]imageInfo(nil), s.images...)
+	unlike := s.images[0]
+	unlike.Extra = []fingerprint{s.images[0].Extra[0]}
+	for i := range unlike.Extra[0] {
+		unlike.Extra[0][i] ^= 0xff
+	}
+	queries = append(queries, unlike)
+	for _, q := range queries {
+		got, err := remote.match(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The server doesn't know the query's path, so it matches the image itself too.
+		local := q
+		local.Path = ""
+		want := s.m.matchesOf(s.images, &local)
+		var gotPaths, wantPaths []string
+		for _, m := range got {
+			gotPaths = append(gotPaths, m.Path)
+		}
+		for _, n := range want {
+			wantPaths = append(wantPaths, s.images[n.index].Path)
+		}
+		if strings.Join(gotPaths, " ") != strings.Join(wantPaths, " ") {
+			t.Errorf("%s: the server matched %q, but locally it matches %q", q.Path, gotPaths, wantPaths)
+		}
+	}
+}
+
+func TestServeMatchesUploadedImage(t *testing.T) {
+	s := testServer(t, "ahash")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	// The waves saved again as a JPEG, which isn't in the index itself.
+	f, err := os.Open(filepath.Join("testdata", "a", "waves.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	im, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	if err := jpeg.Encode(&body, im, &jpeg.Options{Quality: 75}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ts.Client().Post(ts.URL+"/match", "image/jpeg", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var got serveResponse
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for i, m := range got.Matches {
+		paths = append(paths, m.Path)
+		if i > 0 && m.Distance < got.Matches[i-1].Distance {
+			t.Errorf("match %d, %s, is at distance %v, closer than the one before", i, m.Path, m.Distance)
+		}
+	}
+	slices.Sort(paths)
+	if want := []string{"a/waves.jpg", "a/waves.png", "b/waves_small.gif"}; !slices.Equal(paths, want) {
+		t.Errorf("matched %q, want %q", paths, want)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strings"
+)
+
+// statsBucketBits is how many bits of distance each bar of the -stats histogram covers.
+const statsBucketBits = 16
+
+// distanceStats counts the distances between the pairs of images compared, for -stats.
+// Distances are at most fingerprintBits, so a count of each is all it needs to keep.
+type distanceStats struct {
+	counts [fingerprintBits + 1]int
+	pairs  int
+}
+
+func (s *distanceStats) add(d int) {
+	s.counts[min(max(d, 0), len(s.counts)-1)]++
+	s.pairs++
+}
+
+// median returns the middle distance, or the mean of the middle two.
+func (s *distanceStats) median() float64 {
+	lower, upper := -1, -1
+	seen := 0
+	for d, n := range s.counts {
+		seen += n
+		if lower < 0 && seen > (s.pairs-1)/2 {
+			lower = d
+		}
+		if seen > s.pairs/2 {
+			upper = d
+			break
+		}
+	}
+	return float64(lower+upper) / 2
+}
+
+// histogram returns how many pairs are in each bucket of statsBucketBits distances.
+// The last bucket also holds the largest possible distance.
+func (s *distanceStats) histogram() []int {
+	buckets := make([]int, (len(s.counts)-1)/statsBucketBits)
+	for d, n := range s.counts {
+		buckets[min(d/statsBucketBits, len(buckets)-1)] += n
+	}
+	return buckets
+}
+
+// write prints the minimum, maximum, mean, and median distance in unit, and a histogram of them.
+func (s *distanceStats) write(w io.Writer, unit distanceUnit) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Distances between %d pairs:\n", s.pairs)
+	if s.pairs == 0 {
+		_, err := io.WriteString(w, b.String())
+		return err
+	}
+	least, most, sum := -1, 0, 0
+	for d, n := range s.counts {
+		if n == 0 {
+			continue
+		}
+		if least < 0 {
+			least = d
+		}
+		most = d
+		sum += d * n
+	}
+	mean := math.Round(float64(sum)/float64(s.pairs)*10) / 10
+	fmt.Fprintf(&b, "min %s, max %s, mean %s, median %s\n", unit.format(float64(least)), unit.format(float64(most)),
+		unit.format(mean), unit.format(s.median()))
+	buckets := s.histogram()
+	widest := slices.Max(buckets)
+	for i, n := range buckets {
+		high := (i+1)*statsBucketBits - 1
+		if i == len(buckets)-1 {
+			high = len(s.counts) - 1
+		}
+		label := fmt.Sprintf("%d-%d", i*statsBucketBits, high)
+		if unit == unitPercent {
+			label = fmt.Sprintf("%.1f-%.1f%%", unit.value(float64(i*statsBucketBits)), unit.value(float64(high)))
+		}
+		line := fmt.Sprintf("%-11s %8d %s", label, n, strings.Repeat("#", (n*50+widest-1)/widest))
+		b.WriteString(strings.TrimRight(line, " ") + "\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPercentOfBits(t *testing.T) {
+	for _, tc := range []struct {
+		percent float64
+		bits    int
+		want    int
+	}{
+		{10, 64, 6},
+		{10, 256, 26},
+		{50, 64, 32},
+		{100, 64, 64},
+		// Never less than 1, so that identical fingerprints still match.
+		{0.5, 64, 1},
+		{0, 256, 1},
+	} {
+		if got := percentOfBits(tc.percent, tc.bits); got != tc.want {
+			t.Errorf("percentOfBits(%v, %d) = %d, want %d", tc.percent, tc.bits, got, tc.want)
+		}
+	}
+	if got, want := percentToBits(10), percentOfBits(10, fingerprintBits); got != want {
+		t.Errorf("percentToBits(10) = %d, want %d for a %d-bit fingerprint", got, want, fingerprintBits)
+	}
+}
+
+func TestStatsCoverFingerprintBits(t *testing.T) {
+	// The histogram spans every distance a fingerprint allows, so percentages end at 100%, and
+	// -threshold 10 falls in the bucket that is labeled with it.
+	s := &distanceStats{}
+	for d := 0; d <= fingerprintBits; d++ {
+		s.add(d)
+	}
+	s.add(percentToBits(10))
+	var b strings.Builder
+	if err := s.write(&b, unitPercent); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{"min 0%, max 100%", "6.2-12.1%         17 ", "93.8-100.0%       17 "} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestStatsHistogramCountsEveryPair(t *testing.T) {
+	dir := t.TempDir()
+	for i := 1; i <= 5; i++ {
+		writeTestPNG(t, filepath.Join(dir, fmt.Sprintf("%d.png", i)), testImage(64, 48, i%3))
+	}
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-stats", dir}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	out := stderr.String()
+	// Five images make ten pairs, and each of them is in one bar of the histogram.
+	if !strings.Contains(out, "Distances between 10 pairs:") {
+		t.Fatalf("stderr doesn't count 10 pairs:\n%s", out)
+	}
+	sum, bars := 0, 0
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.Contains(fields[0], "-") {
+			continue
+		}
+		n, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		sum += n
+		bars++
+	}
+	if bars != fingerprintBits/statsBucketBits || sum != 10 {
+		t.Errorf("%d bars of the histogram add up to %d pairs, want %d bars and 10 pairs:\n%s", bars, sum, fingerprintBits/statsBucketBits, out)
+	}
+}
+
+func TestDistanceUnitRendersSamePair(t *testing.T) {
+	// Two fingerprints 12 bits apart, which is 12/256 = 4.6875% of a fingerprint.
+	var a fingerprint
+	b := a
+	b[0], b[1] = 0xff, 0x0f
+	exported := filepath.Join(t.TempDir(), "pair.jsonl")
+	images := []imageInfo{{Path: "a.png", Fingerprint: a}, {Path: "b.png", Fingerprint: b}}
+	if err := exportFingerprints(exported, images, testHasher().version(), "hex"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		unit    string
+		json    float64
+		nearest string
+	}{
+		{"bits", 12, "12\tb.png"},
+		{"percent", 4.6875, "4.69%\tb.png"},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := []string{"-distance-unit", tc.unit, "-format", "json", "-import-fingerprints", exported}
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		var groups []group
+		if err := json.Unmarshal(stdout.Bytes(), &groups); err != nil {
+			t.Fatal(err)
+		}
+		if len(groups) != 1 || len(groups[0].Members) != 2 || groups[0].Members[1].Distance != tc.json {
+			t.Errorf("%q: got %s, want b.png at distance %v", args, stdout.String(), tc.json)
+		}
+
+		stdout.Reset()
+		args = []string{"-distance-unit", tc.unit, "-nearest", "1", "-import-fingerprints", exported}
+		if code := run(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%q: exit status %d; stderr %q", args, code, stderr.String())
+		}
+		if !strings.Contains(stdout.String(), "Nearest to a.png:\n"+tc.nearest+"\n") {
+			t.Errorf("%q: got\n%s\nwant a.png's nearest to be %q", args, stdout.String(), tc.nearest)
+		}
+	}
+}
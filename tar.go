@@ -0,0 +1,100 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// archiveSeparator separates the path of an archive from the name of an entry in it, as in
+// "photos.tar!2019/beach.jpg".
+const archiveSeparator = "!"
+
+// isTar reports whether path names a tar archive, compressed with gzip or not.
+func isTar(path string) bool {
+	lower := strings.ToLower(path)
+	return strings.HasSuffix(lower, ".tar") || strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz")
+}
+
+// archiveImage is an image in an archive, or an entry that couldn't be fingerprinted, with err set.
+type archiveImage struct {
+	im  imageInfo
+	err error
+}
+
+// fingerprintTar fingerprints the regular files in a tar archive that have one of the extensions,
+// reading it once from start to end. Compression with gzip is detected from the contents rather
+// than the name. Each image's path is the archive's path and the entry's name joined by
+// archiveSeparator, and hidden entries are left out unless includeHidden is set. An error
+// reading the archive itself is returned with the images before it.
+func (h *hasher) fingerprintTar(name string, extensions []string, caseSensitive, includeHidden bool) ([]archiveImage, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errIO, err)
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errDecode, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	var images []archiveImage
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return images, nil
+		}
+		if err != nil {
+			return images, fmt.Errorf("%w: %w", errDecode, err)
+		}
+		if hdr.Typeflag != tar.TypeReg || !hasExtension(hdr.Name, extensions, caseSensitive) {
+			continue
+		}
+		if !includeHidden && hiddenEntry(hdr.Name) {
+			continue
+		}
+		im, err := h.fingerprintEntry(tr, hdr.Size)
+		im.Path = name + archiveSeparator + path.Clean(hdr.Name)
+		im.Size = hdr.Size
+		im.ModTime = hdr.ModTime
+		images = append(images, archiveImage{im: im, err: err})
+	}
+}
+
+// fingerprintEntry fingerprints the current entry of an archive, of the given size. The entry is
+// read into memory first, since a decode that runs past -decode-timeout carries on reading in the
+// background, while r has to move on to the next entry.
+func (h *hasher) fingerprintEntry(r io.Reader, size int64) (imageInfo, error) {
+	// An image is almost never larger encoded than decoded, so there is no need to read it.
+	if h.maxDecodeBytes > 0 && size > h.maxDecodeBytes {
+		return imageInfo{}, errTooLarge
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return imageInfo{}, fmt.Errorf("%w: %w", errIO, err)
+	}
+	return h.fingerprintReader(bytes.NewReader(data))
+}
+
+// hiddenEntry reports whether the name of an archive entry, or any directory it is in, is hidden.
+func hiddenEntry(name string) bool {
+	for _, part := range strings.Split(path.Clean(name), "/") {
+		if isHidden(part) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestTar saves a tar archive of n PNGs, 0.png to n-1.png, each a different testImage.
+func writeTestTar(t *testing.T, name string, n int) {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := 0; i < n; i++ {
+		var im bytes.Buffer
+		if err := png.Encode(&im, testImage(96, 64, i)); err != nil {
+			t.Fatal(err)
+		}
+		hdr := &tar.Header{Name: fmt.Sprintf("%d.png", i), Mode: 0o644, Size: int64(im.Len()), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(im.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFingerprintTarDecodeTimeout(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "images.tar")
+	writeTestTar(t, name, 6)
+	want, err := testHasher().fingerprintTar(name, defaultExtensions, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Decodes that time out mustn't disturb the entries after them. Run with -race to check
+	// that they don't read from the archive in the background.
+	h := testHasher()
+	h.decodeTimeout = time.Nanosecond
+	got, err := h.fingerprintTar(name, defaultExtensions, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries with -decode-timeout, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i].im.Path != want[i].im.Path {
+			t.Errorf("entry %d is %s, want %s", i, got[i].im.Path, want[i].im.Path)
+		}
+		if got[i].err == nil && got[i].im.Fingerprint != want[i].im.Fingerprint {
+			t.Errorf("%s: fingerprint %v, want %v", got[i].im.Path, got[i].im.Fingerprint, want[i].im.Fingerprint)
+		}
+	}
+
+	h.decodeTimeout = time.Minute
+	got, err = h.fingerprintTar(name, defaultExtensions, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		if got[i].err != nil || got[i].im.Fingerprint != want[i].im.Fingerprint {
+			t.Errorf("%s: fingerprint %v, %v, want %v", got[i].im.Path, got[i].im.Fingerprint, got[i].err, want[i].im.Fingerprint)
+		}
+	}
+}
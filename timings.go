@@ -0,0 +1,42 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+// writeTimings prints how long the n slowest images took to decode and hash, and if each is set,
+// every image's times first. Images that weren't decoded in this run, like imported ones, are
+// left out.
+func writeTimings(w io.Writer, images []imageInfo, n int, each bool) error {
+	var timed []*imageInfo
+	for i := range images {
+		if images[i].decodeTime > 0 {
+			timed = append(timed, &images[i])
+		}
+	}
+	var b strings.Builder
+	line := func(im *imageInfo) {
+		fmt.Fprintf(&b, "%10v %10v  %s\n", im.decodeTime.Round(time.Microsecond), im.hashTime.Round(time.Microsecond), im.Path)
+	}
+	if each {
+		fmt.Fprintf(&b, "Time to decode and hash each image:\n")
+		for _, im := range timed {
+			line(im)
+		}
+	}
+	slices.SortStableFunc(timed, func(a, b *imageInfo) int {
+		return cmp.Compare(b.decodeTime+b.hashTime, a.decodeTime+a.hashTime)
+	})
+	fmt.Fprintf(&b, "Slowest %d of %d images to decode and hash:\n", min(n, len(timed)), len(timed))
+	for _, im := range timed[:min(n, len(timed))] {
+		line(im)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
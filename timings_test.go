@@ -0,0 +1,34 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTimingsSlowestFirst(t *testing.T) {
+	// Differences of more than about 2.1s don't fit in an int on 32-bit platforms.
+	images := []imageInfo{
+		{Path: "fast.png", decodeTime: 500 * time.Millisecond, hashTime: time.Millisecond},
+		{Path: "slowest.png", decodeTime: 10 * time.Second, hashTime: time.Second},
+		{Path: "imported.png"},
+		{Path: "slow.png", decodeTime: 3 * time.Second, hashTime: time.Millisecond},
+	}
+	var b strings.Builder
+	if err := writeTimings(&b, images, 3, false); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if lines[0] != "Slowest 3 of 3 images to decode and hash:" {
+		t.Errorf("heading %q", lines[0])
+	}
+	var order []string
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		order = append(order, fields[len(fields)-1])
+	}
+	if got, want := strings.Join(order, " "), "slowest.png slow.png fast.png"; got != want {
+		t.Errorf("order %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+// transform is one of the eight rotations and mirrorings of a square image.
+type transform int
+
+const (
+	identity transform = iota
+	rotate90
+	rotate180
+	rotate270
+	mirror
+	mirrorRotate90
+	mirrorRotate180
+	mirrorRotate270
+)
+
+var transformNames = []string{
+	"",
+	"rotated 90°",
+	"rotated 180°",
+	"rotated 270°",
+	"mirrored",
+	"mirrored and rotated 90°",
+	"mirrored and rotated 180°",
+	"mirrored and rotated 270°",
+}
+
+// String describes the transform; the identity is the empty string.
+func (t transform) String() string {
+	return transformNames[t]
+}
+
+// bit reports whether the pixel at (x, y) of the 16x16 fingerprint is set.
+func (a fingerprint) bit(x, y int) bool {
+	return a[y*2+x/8]&(1<<(7-x%8)) != 0
+}
+
+// setBit sets the pixel at (x, y) of the 16x16 fingerprint.
+func (a *fingerprint) setBit(x, y int) {
+	a[y*2+x/8] |= 1 << (7 - x%8)
+}
+
+// quadrant returns the fingerprint with only the bits of one 8x8 quarter of it left: 0 is the
+// top left, 1 the top right, 2 the bottom left, and 3 the bottom right.
+func (a fingerprint) quadrant(q int) fingerprint {
+	var f fingerprint
+	// Each row is two bytes, the left half and then the right.
+	for y := q / 2 * hashSize / 2; y < (q/2+1)*hashSize/2; y++ {
+		i := y*2 + q%2
+		f[i] = a[i]
+	}
+	return f
+}
+
+// transform returns the fingerprint of the image after mirroring it horizontally (if requested)
+// and then rotating it clockwise.
+func (a fingerprint) transform(t transform) fingerprint {
+	var out fingerprint
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			if !a.bit(x, y) {
+				continue
+			}
+			nx, ny := x, y
+			if t >= mirror {
+				nx = 15 - nx
+			}
+			for r := identity; r < t%4; r++ {
+				nx, ny = 15-ny, nx
+			}
+			out.setBit(nx, ny)
+		}
+	}
+	return out
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// landscape is a square image of smooth, lopsided hills, so that turning or flipping it changes
+// its fingerprint, but not so sharp that resampling moves the edges.
+func landscape(size int) *image.RGBA {
+	im := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			u, v := float64(x)/float64(size), float64(y)/float64(size)
+			g := 127 + 50*math.Sin(2*math.Pi*u*1.3+0.4) + 40*math.Cos(2*math.Pi*v*0.8) + 30*(u-v*v)
+			im.Set(x, y, color.Gray{Y: uint8(max(0, min(255, g)))})
+		}
+	}
+	return im
+}
+
+// rotateClockwise turns im a quarter turn clockwise.
+func rotateClockwise(im *image.RGBA) *image.RGBA {
+	b := im.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, b.Dy(), b.Dx()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			out.Set(b.Dy()-1-y, x, im.At(x, y))
+		}
+	}
+	return out
+}
+
+// mirrorImage flips im left to right.
+func mirrorImage(im *image.RGBA) *image.RGBA {
+	b := im.Bounds()
+	out := image.NewRGBA(b)
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			out.Set(b.Dx()-1-x, y, im.At(x, y))
+		}
+	}
+	return out
+}
+
+func TestInvariantLabelsTransforms(t *testing.T) {
+	dir := t.TempDir()
+	// At the intermediate size, resampling leaves the image as it is, so the turned copies
+	// fingerprint like the turned fingerprint.
+	im := landscape(160)
+	writeTestPNG(t, filepath.Join(dir, "a.png"), im)
+	writeTestPNG(t, filepath.Join(dir, "b.png"), rotateClockwise(im))
+	writeTestPNG(t, filepath.Join(dir, "c.png"), rotateClockwise(rotateClockwise(im)))
+	writeTestPNG(t, filepath.Join(dir, "d.png"), mirrorImage(im))
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-invariant", "-base", dir, dir}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	want := "Possible matches:\na.png\nb.png (rotated 90°)\nc.png (rotated 180°)\nd.png (mirrored)\n\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// Without -invariant, the rotations aren't found at all.
+	stdout.Reset()
+	if code := run([]string{"-base", dir, dir}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit status %d; stderr %q", code, stderr.String())
+	}
+	if strings.Contains(stdout.String(), "rotated") || strings.Contains(stdout.String(), "b.png") {
+		t.Errorf("without -invariant, got\n%s", stdout.String())
+	}
+}
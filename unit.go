@@ -0,0 +1,58 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// distanceUnit is how distances are shown: as the number of bits that differ, or as a percentage
+// of the bits in a fingerprint, like -threshold.
+type distanceUnit string
+
+const (
+	unitBits    distanceUnit = "bits"
+	unitPercent distanceUnit = "percent"
+)
+
+// fingerprintBits is the number of bits in a fingerprint.
+const fingerprintBits = hashSize * hashSize
+
+// parseDistanceUnit checks the -distance-unit flag.
+func parseDistanceUnit(s string) (distanceUnit, error) {
+	switch u := distanceUnit(s); u {
+	case unitBits, unitPercent:
+		return u, nil
+	}
+	return "", fmt.Errorf("-distance-unit must be bits or percent, got %q", s)
+}
+
+// value converts a distance in bits to the unit.
+func (u distanceUnit) value(d float64) float64 {
+	if u == unitPercent {
+		return d * 100 / fingerprintBits
+	}
+	return d
+}
+
+// format converts a distance in bits to the unit and prints it. Percentages are rounded to two
+// decimal places and have a % sign.
+func (u distanceUnit) format(d float64) string {
+	if u == unitPercent {
+		return strconv.FormatFloat(math.Round(u.value(d)*100)/100, 'f', -1, 64) + "%"
+	}
+	return strconv.FormatFloat(d, 'f', -1, 64)
+}
+
+// percentToBits converts a percentage of the bits in a fingerprint, like -threshold, to a
+// threshold in bits. Images match when they differ by fewer bits than the threshold, so it is at
+// least 1, or small percentages would round down to a threshold that even identical images miss.
+func percentToBits(percent float64) int {
+	return percentOfBits(percent, fingerprintBits)
+}
+
+// percentOfBits is percentToBits for a fingerprint of the given number of bits.
+func percentOfBits(percent float64, bits int) int {
+	return max(1, int(math.Round(float64(bits)*percent/100)))
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// verifyPairs reads "keeper,candidate" pairs of paths from the named CSV file and reports, for
+// each one, PASS if the candidate is within the threshold of its keeper and FAIL if it isn't,
+// followed by the distance and the two paths. It returns how many pairs didn't pass, including
+// ones where a file couldn't be fingerprinted, which are reported to stderr.
+func (m *matcher) verifyPairs(w, stderr io.Writer, h *hasher, name string) (int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 2
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+
+	images := map[string]*imageInfo{}
+	fingerprintOf := func(path string) (*imageInfo, error) {
+		if im, ok := images[path]; ok {
+			return im, nil
+		}
+		im, err := h.fingerprintImage(path)
+		if err != nil && !errors.Is(err, errPartialImage) {
+			return nil, err
+		}
+		im.Path = path
+		images[path] = &im
+		return &im, nil
+	}
+
+	failed := 0
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return failed, nil
+		}
+		if err != nil {
+			return failed, err
+		}
+		keeper, err := fingerprintOf(record[0])
+		if err != nil {
+			failed++
+			_, _ = fmt.Fprintf(stderr, "Error decoding image %s: %v\n", record[0], err)
+			continue
+		}
+		candidate, err := fingerprintOf(record[1])
+		if err != nil {
+			failed++
+			_, _ = fmt.Fprintf(stderr, "Error decoding image %s: %v\n", record[1], err)
+			continue
+		}
+		verdict := "PASS"
+		d, ok := m.similar(keeper, candidate)
+		if !ok {
+			verdict = "FAIL"
+			failed++
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", verdict, m.unit.format(float64(d)), record[0], record[1]); err != nil {
+			return failed, err
+		}
+	}
+}
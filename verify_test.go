@@ -0,0 +1,46 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyPairs(t *testing.T) {
+	dir := t.TempDir()
+	keeper, copied, other := filepath.Join(dir, "keeper.png"), filepath.Join(dir, "copy.png"), filepath.Join(dir, "other.png")
+	im := testImage(120, 90, 1)
+	writeTestPNG(t, keeper, im)
+	writeTestPNG(t, copied, nearCopy(im))
+	writeTestPNG(t, other, testImage(120, 90, 2))
+	distance := func(a, b string) int {
+		t.Helper()
+		fa, err := testHasher().fingerprintImage(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fb, err := testHasher().fingerprintImage(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fa.Fingerprint.diffbits(fb.Fingerprint)
+	}
+
+	pairs := filepath.Join(t.TempDir(), "pairs.csv")
+	csv := fmt.Sprintf("# keeper,candidate\n%s,%s\n%s, %s\n", keeper, copied, keeper, other)
+	if err := os.WriteFile(pairs, []byte(csv), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	// A pair that fails makes the exit status 1.
+	if code := run([]string{"-verify", pairs}, &stdout, &stderr); code != 1 {
+		t.Fatalf("exit status %d, want 1; stderr %q", code, stderr.String())
+	}
+	want := fmt.Sprintf("PASS\t%d\t%s\t%s\nFAIL\t%d\t%s\t%s\n", distance(keeper, copied), keeper, copied, distance(keeper, other), keeper, other)
+	if got := stdout.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
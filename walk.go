@@ -0,0 +1,65 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// foundFile is a file found by walkFiles, or a file or directory that couldn't be read, with err set.
+type foundFile struct {
+	path string
+	info fs.FileInfo
+	err  error
+}
+
+// walkFiles lists the files under the directory root in the same order as filepath.Walk, but
+// reads up to jobs directories at once, which is much faster for deep trees on network
+// filesystems. Hidden files and directories are left out unless includeHidden is set. Anything
+// that can't be read is listed with its error, and the rest of the tree is still walked. If ctx
+// is done, it stops and returns the files found so far.
+func walkFiles(ctx context.Context, root string, jobs int, includeHidden bool) []foundFile {
+	sem := make(chan struct{}, max(1, jobs))
+	var walk func(dir string) []foundFile
+	walk = func(dir string) []foundFile {
+		if ctx.Err() != nil {
+			return nil
+		}
+		sem <- struct{}{}
+		entries, err := os.ReadDir(dir)
+		<-sem
+		if err != nil {
+			return []foundFile{{path: dir, err: err}}
+		}
+		// Each subdirectory is walked by its own goroutine, and its files are put in its place
+		// in the listing afterwards, so the order doesn't depend on which finishes first.
+		found := make([][]foundFile, len(entries))
+		var wg sync.WaitGroup
+		for i, entry := range entries {
+			if !includeHidden && isHidden(entry.Name()) {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			if entry.IsDir() {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					found[i] = walk(path)
+				}(i)
+				continue
+			}
+			info, err := entry.Info()
+			found[i] = []foundFile{{path: path, info: info, err: err}}
+		}
+		wg.Wait()
+		var files []foundFile
+		for _, f := range found {
+			files = append(files, f...)
+		}
+		return files
+	}
+	return walk(root)
+}
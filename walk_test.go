@@ -0,0 +1,77 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// deepTree makes a tree of directories depth levels deep, each with fanout subdirectories and a
+// few files, under a temporary directory, and returns its root.
+func deepTree(tb testing.TB, depth, fanout int) string {
+	tb.Helper()
+	root := tb.TempDir()
+	var fill func(dir string, level int)
+	fill = func(dir string, level int) {
+		for i := 0; i < 3; i++ {
+			if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.jpg", i)), nil, 0o644); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		if level == depth {
+			return
+		}
+		for i := 0; i < fanout; i++ {
+			sub := filepath.Join(dir, fmt.Sprintf("d%d", i))
+			if err := os.Mkdir(sub, 0o755); err != nil {
+				tb.Fatal(err)
+			}
+			fill(sub, level+1)
+		}
+	}
+	fill(root, 0)
+	return root
+}
+
+func TestWalkFilesFindsEveryFile(t *testing.T) {
+	root := deepTree(t, 4, 3)
+	var want []string
+	err := filepath.Walk(root, func(path string, info fs.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			want = append(want, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, jobs := range []int{1, 8} {
+		var got []string
+		for _, f := range walkFiles(context.Background(), root, jobs, false) {
+			if f.err != nil {
+				t.Errorf("%s: %v", f.path, f.err)
+			}
+			got = append(got, f.path)
+		}
+		// In the same order, too, so the output doesn't depend on which directory is read first.
+		if !slices.Equal(got, want) {
+			t.Errorf("with %d jobs, found %d files, want the %d filepath.Walk finds in the same order", jobs, len(got), len(want))
+		}
+	}
+}
+
+func BenchmarkWalkFiles(b *testing.B) {
+	root := deepTree(b, 5, 4)
+	for _, jobs := range []int{1, 16} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				walkFiles(context.Background(), root, jobs, false)
+			}
+		})
+	}
+}
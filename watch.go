@@ -0,0 +1,159 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchSettle is how long a file must go without changing before it is fingerprinted, so that
+// images that are still being written, like downloads, are only hashed once they are complete.
+const watchSettle = 500 * time.Millisecond
+
+// watcher keeps an in-memory index of the images in a directory and reports new images that
+// duplicate one already in it.
+type watcher struct {
+	w, stderr     io.Writer
+	h             *hasher
+	m             *matcher
+	extensions    []string
+	caseSensitive bool
+	includeHidden bool
+	verbose       bool
+	// index holds the images seen so far, by path.
+	index map[string]imageInfo
+}
+
+// watch fingerprints the images already in dir and then watches it, and the directories under
+// it, for new and changed images, reporting each one that duplicates an image seen before.
+// The index starts out with images, such as imported fingerprints. It returns nil once ctx is
+// done, or the error that stopped it.
+func (h *hasher) watch(ctx context.Context, w, stderr io.Writer, m *matcher, dir string, images []imageInfo, extensions []string, caseSensitive, includeHidden, verbose bool) error {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer fsw.Close()
+
+	wt := &watcher{
+		w:             w,
+		stderr:        stderr,
+		h:             h,
+		m:             m,
+		extensions:    extensions,
+		caseSensitive: caseSensitive,
+		includeHidden: includeHidden,
+		verbose:       verbose,
+		index:         map[string]imageInfo{},
+	}
+	for _, im := range images {
+		wt.index[im.Path] = im
+	}
+	if err := wt.add(fsw, dir, false); err != nil {
+		return err
+	}
+	if verbose {
+		_, _ = fmt.Fprintf(w, "Watching %s with %d images\n", dir, len(wt.index))
+	}
+
+	timers := map[string]*time.Timer{}
+	defer func() {
+		for _, t := range timers {
+			t.Stop()
+		}
+	}()
+	ready := make(chan string)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-fsw.Events:
+			if !ok {
+				return nil
+			}
+			if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+				delete(wt.index, event.Name)
+				continue
+			}
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			if t, ok := timers[event.Name]; ok {
+				t.Reset(watchSettle)
+				continue
+			}
+			name := event.Name
+			timers[name] = time.AfterFunc(watchSettle, func() {
+				select {
+				case ready <- name:
+				case <-ctx.Done():
+				}
+			})
+		case name := <-ready:
+			delete(timers, name)
+			if err := wt.add(fsw, name, true); err != nil {
+				_, _ = fmt.Fprintf(stderr, "Error watching %s: %v\n", name, err)
+			}
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// add indexes the image at path, or watches the directory at path and indexes the images in it.
+// If report is set, images that duplicate one already indexed are reported.
+func (wt *watcher) add(fsw *fsnotify.Watcher, root string, report bool) error {
+	return filepath.Walk(root, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// Removed before we got to it.
+				return nil
+			}
+			return err
+		}
+		if path != root && !wt.includeHidden && isHidden(info.Name()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return fsw.Add(path)
+		}
+		if !hasExtension(path, wt.extensions, wt.caseSensitive) {
+			return nil
+		}
+		im, err := wt.h.fingerprintImage(path)
+		if err != nil && !errors.Is(err, errPartialImage) {
+			if !errors.Is(err, errSolidImage) {
+				_, _ = fmt.Fprintf(wt.stderr, "Error decoding image %s; ignoring. %v\n", path, err)
+			}
+			return nil
+		}
+		im.Path = path
+		im.Size = info.Size()
+		im.ModTime = info.ModTime()
+		delete(wt.index, path)
+		if report {
+			for _, other := range wt.index {
+				if d, ok := wt.m.similar(&im, &other); ok {
+					_, _ = fmt.Fprintf(wt.w, "%s duplicates %s (distance %s)\n", path, other.Path, wt.m.unit.format(float64(d)))
+				}
+			}
+		} else if wt.verbose {
+			_, _ = fmt.Fprintf(wt.w, "Indexed %s\n", path)
+		}
+		wt.index[path] = im
+		return nil
+	})
+}
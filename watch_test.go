@@ -0,0 +1,79 @@
+// Copyright (c) 2023 Christopher Swenson
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer that one goroutine can write while another reads it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// waitFor polls b until it contains s, failing the test if it doesn't within a few seconds.
+func (b *lockedBuffer) waitFor(t *testing.T, s string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(b.String(), s); {
+		if time.Now().After(deadline) {
+			t.Fatalf("output %q doesn't contain %q", b.String(), s)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestWatchReportsNewDuplicate(t *testing.T) {
+	dir := t.TempDir()
+	original := filepath.Join(dir, "original.png")
+	writeTestPNG(t, original, testImage(100, 80, 1))
+	writeTestPNG(t, filepath.Join(dir, "other.png"), testImage(100, 80, 2))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var stdout, stderr lockedBuffer
+	m := &matcher{distance: hamming, thresholdBits: percentToBits(10)}
+	done := make(chan error)
+	go func() {
+		done <- testHasher().watch(ctx, &stdout, &stderr, m, dir, nil, []string{"png"}, false, false, true)
+	}()
+	stdout.waitFor(t, "Watching "+dir+" with 2 images")
+
+	duplicate := filepath.Join(dir, "sub", "copy.png")
+	if err := os.Mkdir(filepath.Dir(duplicate), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestPNG(t, duplicate, testImage(100, 80, 1))
+	stdout.waitFor(t, duplicate+" duplicates "+original)
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("watch returned %v once cancelled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch didn't return once cancelled")
+	}
+	if strings.Contains(stdout.String(), "other.png duplicates") || stderr.String() != "" {
+		t.Errorf("unexpected output %q, stderr %q", stdout.String(), stderr.String())
+	}
+}